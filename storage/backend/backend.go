@@ -0,0 +1,387 @@
+// Package backend defines the storage interface ProviderGRPC serves from
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Done is returned by an iterator's Next method when iteration is complete
+	Done = errors.New("no more items in iterator")
+	// ErrBucketNotExist is returned when a bucket cannot be found
+	ErrBucketNotExist = errors.New("bucket does not exist")
+	// ErrObjectNotExist is returned when an object cannot be found
+	ErrObjectNotExist = errors.New("object does not exist")
+	// ErrBucketExist is returned by Create when the bucket name is taken
+	ErrBucketExist = errors.New("bucket already exists")
+	// ErrBucketNotEmpty is returned by Delete when the bucket still holds objects
+	ErrBucketNotEmpty = errors.New("bucket is not empty")
+	// ErrInvalidRange is returned when a read starts beyond the end of an object
+	ErrInvalidRange = errors.New("requested range not satisfiable")
+	// ErrBucketOwned is returned by Create when the project already owns the bucket
+	ErrBucketOwned = errors.New("bucket already owned by project")
+	// ErrNotSupported is returned for bucket settings a backend cannot store
+	// and for versioning on backends without generations
+	ErrNotSupported = errors.New("not supported by this backend")
+	// ErrPreconditionFailed is returned when the Conditions of a write or
+	// delete do not hold
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrPermissionDenied is returned when the backend refuses the
+	// credentials it was given access to a bucket or object
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrQuotaExceeded is returned when the backend is rate limiting or out
+	// of quota
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrStorageClassNotSupported is returned for a storage class the backend
+	// has no equivalent of that can be read without a restore
+	ErrStorageClassNotSupported = errors.New("storage class not supported by this backend")
+)
+
+// MaxSignedURLExpiry is the longest GCS and S3 allow a signed URL to stay valid
+const MaxSignedURLExpiry = 7 * 24 * time.Hour
+
+// Lifecycle rule actions
+const (
+	LifecycleDelete          = "Delete"
+	LifecycleSetStorageClass = "SetStorageClass"
+)
+
+// Backend is a storage provider holding buckets of objects
+type Backend interface {
+	Bucket(name string) BucketHandle
+	Buckets(ctx context.Context, projectID string) BucketIterator
+	Close() error
+}
+
+// BucketHandle provides operations on a single bucket
+// The bucket need not exist until Create is called
+type BucketHandle interface {
+	Create(ctx context.Context, projectID string, attrs *BucketAttrs) error
+	Delete(ctx context.Context) error
+	Attrs(ctx context.Context) (*BucketAttrs, error)
+	// InProject reports whether the bucket was created by the project, or
+	// fails with ErrBucketNotExist
+	InProject(ctx context.Context, projectID string) (bool, error)
+	// Update changes the bucket settings set in attrs and returns the result
+	Update(ctx context.Context, attrs BucketAttrsToUpdate) (*BucketAttrs, error)
+	Object(name string) ObjectHandle
+	Objects(ctx context.Context, q *Query) ObjectIterator
+	// SignedURL returns a URL that allows the request described by opts on
+	// the named object without credentials
+	SignedURL(name string, opts SignedURLOptions) (string, error)
+}
+
+// ObjectHandle provides operations on a single object within a bucket
+// Handles refer to the live object unless Generation picks another version
+type ObjectHandle interface {
+	// Generation returns a handle to one generation of the object, which may
+	// be a noncurrent version; deleting it removes that version for good
+	Generation(gen int64) ObjectHandle
+	// If returns a handle whose writes and deletes fail with
+	// ErrPreconditionFailed unless conds hold for the live object
+	If(conds Conditions) ObjectHandle
+	Attrs(ctx context.Context) (*ObjectAttrs, error)
+	NewReader(ctx context.Context) (io.ReadCloser, error)
+	// NewRangeReader reads length bytes from offset; a negative length reads to the end
+	NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+	// NewWriter returns a writer that commits the object on Close
+	// The content type, cache control, content disposition and metadata of
+	// attrs are stored with the object; attrs may be nil
+	NewWriter(ctx context.Context, attrs *ObjectAttrs) io.WriteCloser
+	// CopyTo copies the object and its metadata to dst, a handle from the
+	// same backend whose conditions apply to the copy, and returns the
+	// attributes of the copy
+	CopyTo(ctx context.Context, dst ObjectHandle) (*ObjectAttrs, error)
+	// Delete removes the live object, keeping it as a noncurrent version
+	// when the bucket has versioning enabled
+	Delete(ctx context.Context) error
+}
+
+// CommittedWriter is implemented by the writers of backends that report the
+// object a writer committed, so callers can act on that generation alone
+// Attrs returns its attributes once Close has succeeded, nil before
+type CommittedWriter interface {
+	io.WriteCloser
+	Attrs() *ObjectAttrs
+}
+
+// Conditions make a write or delete depend on the live object
+// The zero value has no conditions
+type Conditions struct {
+	// GenerationMatch requires the live object to have this generation
+	GenerationMatch int64
+	// DoesNotExist requires there to be no live object
+	DoesNotExist bool
+}
+
+// Check returns ErrPreconditionFailed unless the conditions hold for live,
+// which is nil when there is no live object
+func (c Conditions) Check(live *ObjectAttrs) error {
+	if c.DoesNotExist && live != nil {
+		return ErrPreconditionFailed
+	}
+	if c.GenerationMatch != 0 && (live == nil || live.Generation != c.GenerationMatch) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// BucketIterator iterates over bucket attributes
+type BucketIterator interface {
+	Next() (*BucketAttrs, error)
+}
+
+// ObjectIterator iterates over object attributes
+type ObjectIterator interface {
+	Next() (*ObjectAttrs, error)
+}
+
+// BucketAttrs represents the metadata of a bucket
+type BucketAttrs struct {
+	Name              string
+	StorageClass      string
+	Location          string
+	Labels            map[string]string
+	Created           time.Time
+	VersioningEnabled bool
+	Lifecycle         []LifecycleRule
+	CORS              []CORS
+	ObjectDefaults    ObjectDefaults
+}
+
+// BucketAttrsToUpdate holds the bucket settings to change
+// Nil fields are left as they are; an empty, non-nil slice clears the rules
+type BucketAttrsToUpdate struct {
+	VersioningEnabled *bool
+	Lifecycle         []LifecycleRule
+	CORS              []CORS
+	ObjectDefaults    *ObjectDefaults
+}
+
+// LifecycleRule deletes, or changes the storage class of, objects AgeInDays
+// after they were created
+// An empty Prefix matches every object in the bucket
+type LifecycleRule struct {
+	Action       string
+	StorageClass string
+	AgeInDays    int64
+	Prefix       string
+}
+
+// CORS is a cross-origin resource sharing rule for browser requests
+type CORS struct {
+	Origins         []string
+	Methods         []string
+	ResponseHeaders []string
+	MaxAge          time.Duration
+}
+
+// ObjectDefaults are stored with new objects that do not set them
+// Metadata keys set on the object take precedence over the defaults
+type ObjectDefaults struct {
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+}
+
+// ObjectAttrs represents the metadata of an object
+// When listing with a delimiter only Prefix is set for synthetic directories
+// Deleted is when a noncurrent version stopped being live, zero otherwise
+type ObjectAttrs struct {
+	Bucket             string
+	Name               string
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	Metadata           map[string]string
+	StorageClass       string
+	Generation         int64
+	Size               int64
+	Created            time.Time
+	Updated            time.Time
+	Deleted            time.Time
+	MD5                []byte
+	CRC32C             uint32
+	Prefix             string
+}
+
+// SignedURLOptions describe the request a signed URL allows
+type SignedURLOptions struct {
+	// Method is GET or PUT
+	Method  string
+	Expires time.Time
+	// ContentType, when set, must be sent with a PUT
+	ContentType string
+}
+
+// Query filters the objects returned by BucketHandle.Objects
+// StartAfter skips every entry whose name, or prefix, sorts at or before it
+// Versions lists noncurrent versions too, each name's versions oldest first
+type Query struct {
+	Prefix     string
+	Delimiter  string
+	StartAfter string
+	Versions   bool
+}
+
+// Pager is implemented by bucket handles that list objects a page at a time
+// with tokens of their own, which is cheaper than StartAfter when the
+// backend cannot start a listing part way through
+// ObjectsPage returns up to pageSize entries of q after the page token,
+// and the token of the next page or "" after the last one
+type Pager interface {
+	ObjectsPage(ctx context.Context, q *Query, pageSize int, token string) ([]*ObjectAttrs, string, error)
+}
+
+// NameError is returned for a bucket or object name a backend cannot store
+type NameError struct {
+	// Kind is "bucket" or "object"
+	Kind string
+	Name string
+}
+
+func (e *NameError) Error() string {
+	if e.Name == "" {
+		return e.Kind + " name must not be empty"
+	}
+	return fmt.Sprintf("invalid %s name: %s", e.Kind, e.Name)
+}
+
+// ValidateBucketName rejects names the local backends cannot store safely
+func ValidateBucketName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return &NameError{Kind: "bucket", Name: name}
+	}
+	return nil
+}
+
+// ValidateObjectName rejects names that would escape the bucket when used as a path
+func ValidateObjectName(name string) error {
+	if name == "" {
+		return &NameError{Kind: "object", Name: name}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return &NameError{Kind: "object", Name: name}
+		}
+	}
+	return nil
+}
+
+// ValidateRange checks a read starting at offset fits an object of size bytes
+func ValidateRange(offset, size int64) error {
+	if offset < 0 || (offset > 0 && offset >= size) {
+		return ErrInvalidRange
+	}
+	return nil
+}
+
+// ApplyDefaults fills the fields of attrs the object did not set from defaults
+func ApplyDefaults(attrs *ObjectAttrs, defaults ObjectDefaults) {
+	if attrs.CacheControl == "" {
+		attrs.CacheControl = defaults.CacheControl
+	}
+	if attrs.ContentDisposition == "" {
+		attrs.ContentDisposition = defaults.ContentDisposition
+	}
+	if len(defaults.Metadata) == 0 {
+		return
+	}
+	metadata := make(map[string]string, len(defaults.Metadata)+len(attrs.Metadata))
+	for k, v := range defaults.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range attrs.Metadata {
+		metadata[k] = v
+	}
+	attrs.Metadata = metadata
+}
+
+// ApplyUpdate changes attrs as described by u, for backends that keep bucket
+// attributes themselves
+func ApplyUpdate(attrs *BucketAttrs, u BucketAttrsToUpdate) {
+	if u.VersioningEnabled != nil {
+		attrs.VersioningEnabled = *u.VersioningEnabled
+	}
+	if u.Lifecycle != nil {
+		attrs.Lifecycle = append([]LifecycleRule(nil), u.Lifecycle...)
+	}
+	if u.CORS != nil {
+		attrs.CORS = make([]CORS, len(u.CORS))
+		for i, c := range u.CORS {
+			attrs.CORS[i] = CORS{
+				Origins:         append([]string(nil), c.Origins...),
+				Methods:         append([]string(nil), c.Methods...),
+				ResponseHeaders: append([]string(nil), c.ResponseHeaders...),
+				MaxAge:          c.MaxAge,
+			}
+		}
+	}
+	if u.ObjectDefaults != nil {
+		attrs.ObjectDefaults = *u.ObjectDefaults
+		attrs.ObjectDefaults.Metadata = nil
+		if u.ObjectDefaults.Metadata != nil {
+			attrs.ObjectDefaults.Metadata = map[string]string{}
+			for k, v := range u.ObjectDefaults.Metadata {
+				attrs.ObjectDefaults.Metadata[k] = v
+			}
+		}
+	}
+}
+
+// CopyObject copies src to dst by streaming it through the server, for
+// backends without a native copy
+func CopyObject(ctx context.Context, src, dst ObjectHandle) (*ObjectAttrs, error) {
+	attrs, err := src.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := src.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := dst.NewWriter(wctx, &ObjectAttrs{
+		ContentType:        attrs.ContentType,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		Metadata:           attrs.Metadata,
+	})
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return dst.Attrs(ctx)
+}
+
+// lastGeneration is the most recent value handed out by NewGeneration
+var lastGeneration int64
+
+// NewGeneration returns a generation number for a new object version
+// Like GCS it is the write time in microseconds, bumped when needed so each
+// call in a process returns a larger value than the last
+func NewGeneration() int64 {
+	for {
+		last := atomic.LoadInt64(&lastGeneration)
+		gen := time.Now().UnixNano() / int64(time.Microsecond)
+		if gen <= last {
+			gen = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastGeneration, last, gen) {
+			return gen
+		}
+	}
+}
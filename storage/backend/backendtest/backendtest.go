@@ -0,0 +1,731 @@
+// Package backendtest provides a conformance suite for storage backends
+package backendtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+const (
+	projectID = "test-project"
+	otherID   = "other-project"
+)
+
+// Run exercises a backend against the behaviour ProviderGRPC relies on
+// newBackend must return an empty backend each time it is called
+func Run(t *testing.T, newBackend func(t *testing.T) backend.Backend) {
+	t.Run("Create", func(t *testing.T) { testCreate(t, newBackend(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, newBackend(t)) })
+	t.Run("Buckets", func(t *testing.T) { testBuckets(t, newBackend(t)) })
+	t.Run("Objects", func(t *testing.T) { testObjects(t, newBackend(t)) })
+	t.Run("ReadWrite", func(t *testing.T) { testReadWrite(t, newBackend(t)) })
+	t.Run("Metadata", func(t *testing.T) { testMetadata(t, newBackend(t)) })
+	t.Run("Copy", func(t *testing.T) { testCopy(t, newBackend(t)) })
+	t.Run("Update", func(t *testing.T) { testUpdate(t, newBackend(t)) })
+	t.Run("Versions", func(t *testing.T) { testVersions(t, newBackend(t)) })
+	t.Run("RangeRead", func(t *testing.T) { testRangeRead(t, newBackend(t)) })
+	t.Run("Abort", func(t *testing.T) { testAbort(t, newBackend(t)) })
+	t.Run("DeleteObject", func(t *testing.T) { testDeleteObject(t, newBackend(t)) })
+}
+
+// CreateBucket creates a bucket owned by the suite's project or fails the test
+func CreateBucket(t *testing.T, b backend.Backend, name string) backend.BucketHandle {
+	t.Helper()
+	bkt := b.Bucket(name)
+	if err := bkt.Create(context.Background(), projectID, nil); err != nil {
+		t.Fatalf("Create(%s) = %v", name, err)
+	}
+	return bkt
+}
+
+// WriteObject writes content to an object or fails the test
+func WriteObject(t *testing.T, bkt backend.BucketHandle, name string, content []byte) {
+	t.Helper()
+	w := bkt.Object(name).NewWriter(context.Background(), nil)
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Write(%s) = %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%s) = %v", name, err)
+	}
+}
+
+// ReadObject returns the content of an object or fails the test
+func ReadObject(t *testing.T, bkt backend.BucketHandle, name string) []byte {
+	t.Helper()
+	r, err := bkt.Object(name).NewReader(context.Background())
+	if err != nil {
+		t.Fatalf("NewReader(%s) = %v", name, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll(%s) = %v", name, err)
+	}
+	return data
+}
+
+func testCreate(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+
+	if err := bkt.Create(ctx, projectID, nil); err != backend.ErrBucketOwned {
+		t.Errorf("duplicate Create by owner = %v, want %v", err, backend.ErrBucketOwned)
+	}
+	if err := bkt.Create(ctx, otherID, nil); err != backend.ErrBucketExist {
+		t.Errorf("duplicate Create by other project = %v, want %v", err, backend.ErrBucketExist)
+	}
+	if err := b.Bucket("").Create(ctx, projectID, nil); err == nil {
+		t.Errorf("empty bucket name should return error")
+	}
+
+	attrs, err := bkt.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != "songs" {
+		t.Errorf("Attrs().Name = %q, want %q", attrs.Name, "songs")
+	}
+	if _, err := b.Bucket("missing").Attrs(ctx); err != backend.ErrBucketNotExist {
+		t.Errorf("Attrs() on missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+	if ok, err := bkt.InProject(ctx, projectID); !ok || err != nil {
+		t.Errorf("InProject() by owner = %v, %v, want true", ok, err)
+	}
+	if ok, err := bkt.InProject(ctx, otherID); ok || err != nil {
+		t.Errorf("InProject() by other project = %v, %v, want false", ok, err)
+	}
+	if _, err := b.Bucket("missing").InProject(ctx, projectID); err != backend.ErrBucketNotExist {
+		t.Errorf("InProject() on missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+
+	t.Run("Attributes should be stored", func(t *testing.T) {
+		labels := map[string]string{"team": "mastering", "tier": "archive"}
+		err := b.Bucket("archive").Create(ctx, projectID, &backend.BucketAttrs{
+			StorageClass: "COLDLINE",
+			Labels:       labels,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := b.Bucket("archive").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.StorageClass != "COLDLINE" || !reflect.DeepEqual(attrs.Labels, labels) {
+			t.Errorf("Attrs() = %+v, want class COLDLINE and labels %v", attrs, labels)
+		}
+
+		it := b.Buckets(ctx, projectID)
+		for {
+			listed, err := it.Next()
+			if err == backend.Done {
+				t.Fatalf("Buckets() did not return archive")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if listed.Name == "archive" {
+				if !reflect.DeepEqual(listed.Labels, labels) {
+					t.Errorf("Buckets() labels = %v, want %v", listed.Labels, labels)
+				}
+				break
+			}
+		}
+	})
+}
+
+func testDelete(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+	WriteObject(t, bkt, "track.flac", []byte("flac"))
+
+	if err := bkt.Delete(ctx); err != backend.ErrBucketNotEmpty {
+		t.Errorf("Delete() on non-empty bucket = %v, want %v", err, backend.ErrBucketNotEmpty)
+	}
+	if err := bkt.Object("track.flac").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := bkt.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := bkt.Delete(ctx); err != backend.ErrBucketNotExist {
+		t.Errorf("Delete() on missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+	// the name is free again once deleted
+	CreateBucket(t, b, "songs")
+}
+
+func testBuckets(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	CreateBucket(t, b, "b-songs")
+	CreateBucket(t, b, "a-songs")
+	if err := b.Bucket("theirs").Create(ctx, otherID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	it := b.Buckets(ctx, projectID)
+	for {
+		attrs, err := it.Next()
+		if err == backend.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, attrs.Name)
+	}
+	if len(names) != 2 || names[0] != "a-songs" || names[1] != "b-songs" {
+		t.Errorf("Buckets() = %v, want [a-songs b-songs]", names)
+	}
+}
+
+func testObjects(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+	for _, name := range []string{
+		"artist/album-a/01.flac",
+		"artist/album-a/02.flac",
+		"artist/album-b/01.flac",
+		"artist/cover.jpg",
+		"readme.txt",
+	} {
+		WriteObject(t, bkt, name, []byte(name))
+	}
+
+	tests := map[string]struct {
+		query *backend.Query
+		want  []string
+	}{
+		"all": {nil, []string{
+			"artist/album-a/01.flac",
+			"artist/album-a/02.flac",
+			"artist/album-b/01.flac",
+			"artist/cover.jpg",
+			"readme.txt",
+		}},
+		"prefix":             {&backend.Query{Prefix: "artist/album-a/"}, []string{"artist/album-a/01.flac", "artist/album-a/02.flac"}},
+		"delimiter":          {&backend.Query{Delimiter: "/"}, []string{"artist/", "readme.txt"}},
+		"both":               {&backend.Query{Prefix: "artist/", Delimiter: "/"}, []string{"artist/album-a/", "artist/album-b/", "artist/cover.jpg"}},
+		"start after name":   {&backend.Query{StartAfter: "artist/album-b/01.flac"}, []string{"artist/cover.jpg", "readme.txt"}},
+		"start after prefix": {&backend.Query{Prefix: "artist/", Delimiter: "/", StartAfter: "artist/album-a/"}, []string{"artist/album-b/", "artist/cover.jpg"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			it := bkt.Objects(ctx, test.query)
+			for {
+				attrs, err := it.Next()
+				if err == backend.Done {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if attrs.Prefix != "" {
+					got = append(got, attrs.Prefix)
+				} else {
+					got = append(got, attrs.Name)
+				}
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("Objects() = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("Objects() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+
+	if _, err := b.Bucket("missing").Objects(ctx, nil).Next(); err != backend.ErrBucketNotExist {
+		t.Errorf("Objects() on missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+}
+
+func testReadWrite(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+
+	WriteObject(t, bkt, "artist/track.wav", content)
+	if got := ReadObject(t, bkt, "artist/track.wav"); !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes, want %d", len(got), len(content))
+	}
+
+	attrs, err := bkt.Object("artist/track.wav").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != int64(len(content)) || attrs.Name != "artist/track.wav" || attrs.Bucket != "songs" {
+		t.Errorf("Attrs() = %+v", attrs)
+	}
+	sum := md5.Sum(content)
+	if attrs.MD5 != nil && !bytes.Equal(attrs.MD5, sum[:]) {
+		t.Errorf("Attrs().MD5 = %x, want %x", attrs.MD5, sum)
+	}
+
+	// overwrite replaces the object
+	WriteObject(t, bkt, "artist/track.wav", []byte("short"))
+	if got := ReadObject(t, bkt, "artist/track.wav"); string(got) != "short" {
+		t.Errorf("read %q after overwrite, want %q", got, "short")
+	}
+	// backends without generations report 0
+	if attrs.Generation != 0 {
+		over, err := bkt.Object("artist/track.wav").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if over.Generation <= attrs.Generation {
+			t.Errorf("Generation after overwrite = %d, want above %d", over.Generation, attrs.Generation)
+		}
+	}
+
+	// empty objects are valid
+	w := bkt.Object("empty").NewWriter(ctx, nil)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := ReadObject(t, bkt, "empty"); len(got) != 0 {
+		t.Errorf("read %q from empty object", got)
+	}
+
+	if _, err := bkt.Object("missing").NewReader(ctx); err != backend.ErrObjectNotExist {
+		t.Errorf("NewReader() on missing object = %v, want %v", err, backend.ErrObjectNotExist)
+	}
+	if _, err := bkt.Object("missing").Attrs(ctx); err != backend.ErrObjectNotExist {
+		t.Errorf("Attrs() on missing object = %v, want %v", err, backend.ErrObjectNotExist)
+	}
+
+	w = b.Bucket("missing").Object("track.wav").NewWriter(ctx, nil)
+	w.Write(content)
+	if err := w.Close(); err == nil {
+		t.Errorf("Close() on writer to missing bucket should return error")
+	}
+}
+
+func testMetadata(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+
+	want := &backend.ObjectAttrs{
+		ContentType:        "audio/flac",
+		CacheControl:       "public, max-age=3600",
+		ContentDisposition: `attachment; filename="track.flac"`,
+		Metadata:           map[string]string{"artist": "eph", "bpm": "120"},
+	}
+	w := bkt.Object("track.bin").NewWriter(ctx, want)
+	w.Write([]byte("fLaC"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bkt.Object("track.bin").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ContentType != want.ContentType {
+		t.Errorf("ContentType = %q, want %q", got.ContentType, want.ContentType)
+	}
+	if got.CacheControl != want.CacheControl {
+		t.Errorf("CacheControl = %q, want %q", got.CacheControl, want.CacheControl)
+	}
+	if got.ContentDisposition != want.ContentDisposition {
+		t.Errorf("ContentDisposition = %q, want %q", got.ContentDisposition, want.ContentDisposition)
+	}
+	if !reflect.DeepEqual(got.Metadata, want.Metadata) {
+		t.Errorf("Metadata = %v, want %v", got.Metadata, want.Metadata)
+	}
+
+	t.Run("Overwrite should replace metadata", func(t *testing.T) {
+		WriteObject(t, bkt, "track.bin", []byte("fLaC"))
+		got, err := bkt.Object("track.bin").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.CacheControl != "" || len(got.Metadata) != 0 {
+			t.Errorf("Overwritten object kept metadata: %+v", got)
+		}
+	})
+}
+
+func testUpdate(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+
+	enabled := true
+	lifecycle := []backend.LifecycleRule{
+		{Action: backend.LifecycleDelete, AgeInDays: 30, Prefix: "tmp/"},
+	}
+	cors := []backend.CORS{{
+		Origins:         []string{"https://eph.example.com"},
+		Methods:         []string{"GET", "HEAD"},
+		ResponseHeaders: []string{"Content-Type"},
+		MaxAge:          time.Hour,
+	}}
+	attrs, err := bkt.Update(ctx, backend.BucketAttrsToUpdate{
+		VersioningEnabled: &enabled,
+		Lifecycle:         lifecycle,
+		CORS:              cors,
+	})
+	if err == backend.ErrNotSupported {
+		t.Skip("backend cannot match lifecycle rules by prefix")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(t *testing.T, attrs *backend.BucketAttrs) {
+		t.Helper()
+		if !attrs.VersioningEnabled {
+			t.Errorf("VersioningEnabled = false, want true")
+		}
+		if !reflect.DeepEqual(attrs.Lifecycle, lifecycle) {
+			t.Errorf("Lifecycle = %+v, want %+v", attrs.Lifecycle, lifecycle)
+		}
+		if !reflect.DeepEqual(attrs.CORS, cors) {
+			t.Errorf("CORS = %+v, want %+v", attrs.CORS, cors)
+		}
+	}
+	check(t, attrs)
+	if attrs, err = bkt.Attrs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(t, attrs)
+
+	if _, err := b.Bucket("missing").Update(ctx, backend.BucketAttrsToUpdate{CORS: cors}); err != backend.ErrBucketNotExist {
+		t.Errorf("Update() on missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+
+	t.Run("Empty rules should be cleared and others kept", func(t *testing.T) {
+		attrs, err := bkt.Update(ctx, backend.BucketAttrsToUpdate{CORS: []backend.CORS{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attrs.CORS) != 0 {
+			t.Errorf("CORS = %+v, want none", attrs.CORS)
+		}
+		if !attrs.VersioningEnabled || !reflect.DeepEqual(attrs.Lifecycle, lifecycle) {
+			t.Errorf("Update() changed settings it was not given: %+v", attrs)
+		}
+	})
+
+	t.Run("Object defaults should apply to new objects", func(t *testing.T) {
+		_, err := bkt.Update(ctx, backend.BucketAttrsToUpdate{
+			ObjectDefaults: &backend.ObjectDefaults{
+				CacheControl: "public, max-age=86400",
+				Metadata:     map[string]string{"label": "eph", "year": "2018"},
+			},
+		})
+		if err == backend.ErrNotSupported {
+			t.Skip("backend has no default object metadata")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := bkt.Object("track.flac").NewWriter(ctx, &backend.ObjectAttrs{
+			Metadata: map[string]string{"year": "2019"},
+		})
+		w.Write([]byte("fLaC"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bkt.Object("track.flac").Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.CacheControl != "public, max-age=86400" {
+			t.Errorf("CacheControl = %q, want the bucket default", got.CacheControl)
+		}
+		want := map[string]string{"label": "eph", "year": "2019"}
+		if !reflect.DeepEqual(got.Metadata, want) {
+			t.Errorf("Metadata = %v, want %v", got.Metadata, want)
+		}
+	})
+}
+
+// writeIf writes content through a handle and returns the error of Close
+func writeIf(obj backend.ObjectHandle, content string) error {
+	w := obj.NewWriter(context.Background(), nil)
+	w.Write([]byte(content))
+	return w.Close()
+}
+
+// listVersions returns every version of name, oldest first
+func listVersions(t *testing.T, bkt backend.BucketHandle, name string) []*backend.ObjectAttrs {
+	t.Helper()
+	var res []*backend.ObjectAttrs
+	it := bkt.Objects(context.Background(), &backend.Query{Prefix: name, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == backend.Done {
+			return res
+		}
+		if err == backend.ErrNotSupported {
+			t.Skip("backend has no object versions")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Name == name {
+			res = append(res, attrs)
+		}
+	}
+}
+
+func testVersions(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+	enabled := true
+	if _, err := bkt.Update(ctx, backend.BucketAttrsToUpdate{VersioningEnabled: &enabled}); err != nil {
+		t.Fatal(err)
+	}
+	obj := bkt.Object("mix.wav")
+
+	WriteObject(t, bkt, "mix.wav", []byte("take one"))
+	WriteObject(t, bkt, "mix.wav", []byte("take two"))
+	versions := listVersions(t, bkt, "mix.wav")
+	if len(versions) != 2 {
+		t.Fatalf("Versions listing returned %d versions, want 2", len(versions))
+	}
+	first, second := versions[0], versions[1]
+	if first.Generation >= second.Generation || first.Deleted.IsZero() || !second.Deleted.IsZero() {
+		t.Errorf("Versions = %+v, %+v, want the first noncurrent and older", first, second)
+	}
+	if data := ReadObject(t, bkt, "mix.wav"); string(data) != "take two" {
+		t.Errorf("live content = %q, want take two", data)
+	}
+
+	t.Run("Generation should read a noncurrent version", func(t *testing.T) {
+		r, err := obj.Generation(first.Generation).NewReader(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if data, _ := ioutil.ReadAll(r); string(data) != "take one" {
+			t.Errorf("content = %q, want take one", data)
+		}
+		if _, err := obj.Generation(first.Generation + 1).Attrs(ctx); err != backend.ErrObjectNotExist {
+			t.Errorf("Attrs() of unknown generation = %v, want %v", err, backend.ErrObjectNotExist)
+		}
+	})
+
+	t.Run("Conditions should guard writes and deletes", func(t *testing.T) {
+		if err := writeIf(obj.If(backend.Conditions{DoesNotExist: true}), "lost"); err != backend.ErrPreconditionFailed {
+			t.Errorf("write if not exists = %v, want %v", err, backend.ErrPreconditionFailed)
+		}
+		stale := obj.If(backend.Conditions{GenerationMatch: first.Generation})
+		if err := writeIf(stale, "lost"); err != backend.ErrPreconditionFailed {
+			t.Errorf("write on stale generation = %v, want %v", err, backend.ErrPreconditionFailed)
+		}
+		if err := stale.Delete(ctx); err != backend.ErrPreconditionFailed {
+			t.Errorf("delete on stale generation = %v, want %v", err, backend.ErrPreconditionFailed)
+		}
+		if err := writeIf(obj.If(backend.Conditions{GenerationMatch: second.Generation}), "take three"); err != nil {
+			t.Errorf("write on live generation = %v", err)
+		}
+		created := bkt.Object("new.wav")
+		if err := writeIf(created.If(backend.Conditions{DoesNotExist: true}), "new"); err != nil {
+			t.Fatalf("write if not exists on new object = %v", err)
+		}
+		attrs, err := created.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := created.Generation(attrs.Generation).Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Delete should keep the live version", func(t *testing.T) {
+		if err := obj.Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := obj.Attrs(ctx); err != backend.ErrObjectNotExist {
+			t.Errorf("Attrs() after delete = %v, want %v", err, backend.ErrObjectNotExist)
+		}
+		if n := len(listVersions(t, bkt, "mix.wav")); n != 3 {
+			t.Errorf("Versions listing returned %d versions, want 3", n)
+		}
+		if err := bkt.Delete(ctx); err != backend.ErrBucketNotEmpty {
+			t.Errorf("Delete() of bucket with versions = %v, want %v", err, backend.ErrBucketNotEmpty)
+		}
+	})
+
+	t.Run("Copying a generation should restore it", func(t *testing.T) {
+		attrs, err := obj.Generation(first.Generation).CopyTo(ctx, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Generation <= second.Generation {
+			t.Errorf("restored generation %d should be newer than %d", attrs.Generation, second.Generation)
+		}
+		if data := ReadObject(t, bkt, "mix.wav"); string(data) != "take one" {
+			t.Errorf("live content = %q, want take one", data)
+		}
+	})
+
+	t.Run("Deleting a generation should remove it for good", func(t *testing.T) {
+		if err := obj.Generation(second.Generation).Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := obj.Generation(second.Generation).Attrs(ctx); err != backend.ErrObjectNotExist {
+			t.Errorf("Attrs() of deleted generation = %v, want %v", err, backend.ErrObjectNotExist)
+		}
+		for _, v := range listVersions(t, bkt, "mix.wav") {
+			if v.Generation == second.Generation {
+				t.Errorf("deleted generation is still listed")
+			}
+		}
+	})
+
+	t.Run("Unversioned buckets should not keep versions", func(t *testing.T) {
+		plain := CreateBucket(t, b, "a-songs")
+		WriteObject(t, plain, "mix.wav", []byte("take one"))
+		WriteObject(t, plain, "mix.wav", []byte("take two"))
+		if n := len(listVersions(t, plain, "mix.wav")); n != 1 {
+			t.Errorf("Versions listing returned %d versions, want 1", n)
+		}
+	})
+}
+
+func testCopy(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	src := CreateBucket(t, b, "staging")
+	CreateBucket(t, b, "release")
+
+	w := src.Object("master.flac").NewWriter(ctx, &backend.ObjectAttrs{
+		ContentType: "audio/flac",
+		Metadata:    map[string]string{"artist": "eph"},
+	})
+	w.Write([]byte("master"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		bucket string
+		name   string
+	}{
+		"same bucket":  {"staging", "renamed/master.flac"},
+		"other bucket": {"release", "master.flac"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			attrs, err := src.Object("master.flac").CopyTo(ctx, b.Bucket(test.bucket).Object(test.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.Bucket != test.bucket || attrs.Name != test.name || attrs.Size != 6 {
+				t.Errorf("CopyTo() = %+v", attrs)
+			}
+			bkt := b.Bucket(test.bucket)
+			if got := ReadObject(t, bkt, test.name); string(got) != "master" {
+				t.Errorf("read %q from copy, want %q", got, "master")
+			}
+			got, err := bkt.Object(test.name).Attrs(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ContentType != "audio/flac" || got.Metadata["artist"] != "eph" {
+				t.Errorf("copy lost metadata: %+v", got)
+			}
+		})
+	}
+
+	if got := ReadObject(t, src, "master.flac"); string(got) != "master" {
+		t.Errorf("source changed by copy, read %q", got)
+	}
+	if _, err := src.Object("missing").CopyTo(ctx, b.Bucket("release").Object("x")); err != backend.ErrObjectNotExist {
+		t.Errorf("CopyTo() from missing object = %v, want %v", err, backend.ErrObjectNotExist)
+	}
+	if _, err := src.Object("master.flac").CopyTo(ctx, b.Bucket("missing").Object("x")); err != backend.ErrBucketNotExist {
+		t.Errorf("CopyTo() into missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+}
+
+func testRangeRead(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+	WriteObject(t, bkt, "track.wav", []byte("0123456789"))
+
+	tests := map[string]struct {
+		offset int64
+		length int64
+		want   string
+	}{
+		"whole":       {0, -1, "0123456789"},
+		"from offset": {4, -1, "456789"},
+		"span":        {2, 3, "234"},
+		"past end":    {8, 10, "89"},
+		"empty":       {5, 0, ""},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r, err := bkt.Object("track.wav").NewRangeReader(ctx, test.offset, test.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("NewRangeReader(%d, %d) read %q, want %q", test.offset, test.length, got, test.want)
+			}
+		})
+	}
+
+	for _, offset := range []int64{10, 11, -1} {
+		if _, err := bkt.Object("track.wav").NewRangeReader(ctx, offset, -1); err != backend.ErrInvalidRange {
+			t.Errorf("NewRangeReader(%d, -1) = %v, want %v", offset, err, backend.ErrInvalidRange)
+		}
+	}
+	if _, err := bkt.Object("missing").NewRangeReader(ctx, 0, 1); err != backend.ErrObjectNotExist {
+		t.Errorf("NewRangeReader() on missing object = %v, want %v", err, backend.ErrObjectNotExist)
+	}
+}
+
+func testAbort(t *testing.T, b backend.Backend) {
+	bkt := CreateBucket(t, b, "songs")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := bkt.Object("partial.wav").NewWriter(ctx, nil)
+	if _, err := w.Write([]byte("first chunk")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	w.Write([]byte("second chunk"))
+	if err := w.Close(); err == nil {
+		t.Errorf("Close() after cancel should return error")
+	}
+	if _, err := bkt.Object("partial.wav").Attrs(context.Background()); err != backend.ErrObjectNotExist {
+		t.Errorf("cancelled write should not commit object, Attrs() = %v", err)
+	}
+}
+
+func testDeleteObject(t *testing.T, b backend.Backend) {
+	ctx := context.Background()
+	bkt := CreateBucket(t, b, "songs")
+	WriteObject(t, bkt, "artist/album/track.flac", []byte("flac"))
+
+	if err := bkt.Object("artist/album/track.flac").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := bkt.Object("artist/album/track.flac").Delete(ctx); err != backend.ErrObjectNotExist {
+		t.Errorf("second Delete() = %v, want %v", err, backend.ErrObjectNotExist)
+	}
+	if _, err := bkt.Objects(ctx, nil).Next(); err != backend.Done {
+		t.Errorf("bucket should be empty after delete, Next() = %v", err)
+	}
+}
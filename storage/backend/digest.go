@@ -0,0 +1,38 @@
+package backend
+
+import (
+	"crypto/md5"
+	"hash"
+	"hash/crc32"
+)
+
+// crc32cTable uses the Castagnoli polynomial as GCS does
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Digest computes the MD5 and CRC32C checksums of content written to it
+type Digest struct {
+	md5 hash.Hash
+	crc hash.Hash32
+}
+
+// NewDigest returns an empty digest
+func NewDigest() *Digest {
+	return &Digest{md5.New(), crc32.New(crc32cTable)}
+}
+
+// Write adds p to both checksums
+func (d *Digest) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.crc.Write(p)
+	return len(p), nil
+}
+
+// MD5 returns the MD5 of the content written so far
+func (d *Digest) MD5() []byte {
+	return d.md5.Sum(nil)
+}
+
+// CRC32C returns the CRC32C of the content written so far
+func (d *Digest) CRC32C() uint32 {
+	return d.crc.Sum32()
+}
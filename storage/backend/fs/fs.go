@@ -0,0 +1,737 @@
+// Package fs implements the storage backend on a local filesystem
+// Buckets map to directories and objects to files under a root directory
+package fs
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+// metaDir holds bucket metadata and temp files; bucket names cannot start with a dot
+const metaDir = ".eph"
+
+// Backend stores buckets as directories under root
+type Backend struct {
+	root string
+
+	// mu serializes bucket updates, which rewrite the bucket metadata, and
+	// object commits and deletes, which check conditions and keep versions
+	mu sync.Mutex
+}
+
+// bucketMeta is persisted for each bucket alongside the data directories
+type bucketMeta struct {
+	Name         string            `json:"name"`
+	ProjectID    string            `json:"project_id"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Location     string            `json:"location,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Created      time.Time         `json:"created"`
+
+	Versioning     bool                    `json:"versioning,omitempty"`
+	Lifecycle      []backend.LifecycleRule `json:"lifecycle,omitempty"`
+	CORS           []backend.CORS          `json:"cors,omitempty"`
+	ObjectDefaults backend.ObjectDefaults  `json:"object_defaults"`
+}
+
+// New creates a filesystem backend rooted at root, creating it if needed
+func New(root string) (*Backend, error) {
+	if root == "" {
+		return nil, errors.New("root directory must be specified")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backend{root: root}
+	for _, dir := range []string{b.bucketsDir(), b.objectsDir(), b.tmpDir(), b.versionsDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *Backend) bucketsDir() string {
+	return filepath.Join(b.root, metaDir, "buckets")
+}
+
+func (b *Backend) objectsDir() string {
+	return filepath.Join(b.root, metaDir, "objects")
+}
+
+func (b *Backend) tmpDir() string {
+	return filepath.Join(b.root, metaDir, "tmp")
+}
+
+// Bucket returns a handle for the named bucket
+func (b *Backend) Bucket(name string) backend.BucketHandle {
+	return &bucketHandle{b, name}
+}
+
+// Buckets iterates over the buckets created by a project
+func (b *Backend) Buckets(ctx context.Context, projectID string) backend.BucketIterator {
+	files, err := ioutil.ReadDir(b.bucketsDir())
+	if err != nil {
+		return backend.NewErrorBucketIterator(err)
+	}
+	var res []*backend.BucketAttrs
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		m, err := b.readMeta(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return backend.NewErrorBucketIterator(err)
+		}
+		if m.ProjectID == projectID {
+			res = append(res, m.attrs())
+		}
+	}
+	return backend.NewBucketIterator(res)
+}
+
+// Close is a no-op for the filesystem
+func (b *Backend) Close() error {
+	return nil
+}
+
+func (b *Backend) readMeta(name string) (*bucketMeta, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.bucketsDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return nil, backend.ErrBucketNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &bucketMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b *Backend) writeMeta(m *bucketMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.writeFile(filepath.Join(b.bucketsDir(), m.Name+".json"), data)
+}
+
+// writeFile atomically replaces path with data via a temp file and rename
+func (b *Backend) writeFile(path string, data []byte) error {
+	tmp, err := b.stageFile(data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// stageFile writes data to a temp file for the caller to rename into place
+func (b *Backend) stageFile(data []byte) (string, error) {
+	f, err := ioutil.TempFile(b.tmpDir(), "meta-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// objectMeta is persisted for each object with what a file cannot record
+type objectMeta struct {
+	ContentType        string            `json:"content_type,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	StorageClass       string            `json:"storage_class,omitempty"`
+	Generation         int64             `json:"generation"`
+	MD5                []byte            `json:"md5,omitempty"`
+	CRC32C             uint32            `json:"crc32c"`
+	Created            time.Time         `json:"created"`
+}
+
+func (m *bucketMeta) attrs() *backend.BucketAttrs {
+	return &backend.BucketAttrs{
+		Name:         m.Name,
+		StorageClass: m.StorageClass,
+		Location:     m.Location,
+		Labels:       m.Labels,
+		Created:      m.Created,
+
+		VersioningEnabled: m.Versioning,
+		Lifecycle:         m.Lifecycle,
+		CORS:              m.CORS,
+		ObjectDefaults:    m.ObjectDefaults,
+	}
+}
+
+type bucketHandle struct {
+	b    *Backend
+	name string
+}
+
+func (h *bucketHandle) dir() string {
+	return filepath.Join(h.b.root, h.name)
+}
+
+func (h *bucketHandle) Create(ctx context.Context, projectID string, attrs *backend.BucketAttrs) error {
+	if err := backend.ValidateBucketName(h.name); err != nil {
+		return err
+	}
+	if err := os.Mkdir(h.dir(), 0755); err != nil {
+		if !os.IsExist(err) {
+			return err
+		}
+		m, err := h.b.readMeta(h.name)
+		if err != nil {
+			return err
+		}
+		if m.ProjectID == projectID {
+			return backend.ErrBucketOwned
+		}
+		return backend.ErrBucketExist
+	}
+
+	m := &bucketMeta{Name: h.name, ProjectID: projectID, Created: time.Now().UTC()}
+	if attrs != nil {
+		m.StorageClass = attrs.StorageClass
+		m.Location = attrs.Location
+		m.Labels = attrs.Labels
+	}
+	if err := h.b.writeMeta(m); err != nil {
+		os.Remove(h.dir())
+		return err
+	}
+	return nil
+}
+
+func (h *bucketHandle) Delete(ctx context.Context) error {
+	if _, err := h.b.readMeta(h.name); err != nil {
+		return err
+	}
+	empty, err := isEmptyDir(h.dir())
+	if err != nil {
+		return err
+	}
+	if empty {
+		// noncurrent versions keep a bucket from being deleted too
+		empty, err = isEmptyDir(h.versionsDir())
+		if os.IsNotExist(err) {
+			empty, err = true, nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !empty {
+		return backend.ErrBucketNotEmpty
+	}
+	if err := os.Remove(h.dir()); err != nil {
+		// an object written since the check
+		if errors.Is(err, syscall.ENOTEMPTY) {
+			return backend.ErrBucketNotEmpty
+		}
+		return err
+	}
+	if err := os.RemoveAll(h.metaDir()); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(h.versionsDir()); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(h.b.bucketsDir(), h.name+".json"))
+}
+
+// metaDir holds the object metadata files of the bucket
+func (h *bucketHandle) metaDir() string {
+	return filepath.Join(h.b.objectsDir(), h.name)
+}
+
+func (h *bucketHandle) Attrs(ctx context.Context) (*backend.BucketAttrs, error) {
+	m, err := h.b.readMeta(h.name)
+	if err != nil {
+		return nil, err
+	}
+	return m.attrs(), nil
+}
+
+func (h *bucketHandle) InProject(ctx context.Context, projectID string) (bool, error) {
+	m, err := h.b.readMeta(h.name)
+	if err != nil {
+		return false, err
+	}
+	return m.ProjectID == projectID, nil
+}
+
+// Update stores the settings; lifecycle rules are kept but not enforced
+func (h *bucketHandle) Update(ctx context.Context, uattrs backend.BucketAttrsToUpdate) (*backend.BucketAttrs, error) {
+	h.b.mu.Lock()
+	defer h.b.mu.Unlock()
+	m, err := h.b.readMeta(h.name)
+	if err != nil {
+		return nil, err
+	}
+	attrs := m.attrs()
+	backend.ApplyUpdate(attrs, uattrs)
+	m.Versioning = attrs.VersioningEnabled
+	m.Lifecycle = attrs.Lifecycle
+	m.CORS = attrs.CORS
+	m.ObjectDefaults = attrs.ObjectDefaults
+	if err := h.b.writeMeta(m); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func (h *bucketHandle) Object(name string) backend.ObjectHandle {
+	return &objectHandle{bkt: h, name: name}
+}
+
+// SignedURL is not supported, the server signs URLs for its own HTTP
+// handler instead
+func (h *bucketHandle) SignedURL(name string, opts backend.SignedURLOptions) (string, error) {
+	return "", backend.ErrNotSupported
+}
+
+func (h *bucketHandle) Objects(ctx context.Context, q *backend.Query) backend.ObjectIterator {
+	if _, err := h.b.readMeta(h.name); err != nil {
+		return backend.NewErrorObjectIterator(err)
+	}
+	var all []*backend.ObjectAttrs
+	err := filepath.Walk(h.dir(), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(h.dir(), p)
+		if err != nil {
+			return err
+		}
+		all = append(all, h.objectAttrs(filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err != nil {
+		return backend.NewErrorObjectIterator(err)
+	}
+	if q != nil && q.Versions {
+		versions, err := h.versions()
+		if err != nil {
+			return backend.NewErrorObjectIterator(err)
+		}
+		all = append(all, versions...)
+	}
+	return backend.NewObjectIterator(backend.FilterObjects(all, q))
+}
+
+// objectAttrs combines the file info with the object's metadata file
+// Files without metadata, e.g. copied in by hand, fall back to the file info
+func (h *bucketHandle) objectAttrs(name string, info os.FileInfo) *backend.ObjectAttrs {
+	attrs := &backend.ObjectAttrs{
+		Bucket:      h.name,
+		Name:        name,
+		ContentType: mime.TypeByExtension(path.Ext(name)),
+		Size:        info.Size(),
+		Created:     info.ModTime().UTC(),
+		Updated:     info.ModTime().UTC(),
+	}
+	data, err := ioutil.ReadFile(h.metaPath(name))
+	if err != nil {
+		return attrs
+	}
+	m := &objectMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return attrs
+	}
+	if m.ContentType != "" {
+		attrs.ContentType = m.ContentType
+	}
+	attrs.CacheControl = m.CacheControl
+	attrs.ContentDisposition = m.ContentDisposition
+	attrs.Metadata = m.Metadata
+	attrs.StorageClass = m.StorageClass
+	attrs.Generation = m.Generation
+	attrs.MD5 = m.MD5
+	attrs.CRC32C = m.CRC32C
+	attrs.Created = m.Created
+	return attrs
+}
+
+// metaPath is keyed by a hash of the name so metadata files cannot collide
+// with the directories of other objects
+func (h *bucketHandle) metaPath(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return filepath.Join(h.metaDir(), hex.EncodeToString(sum[:])+".json")
+}
+
+type objectHandle struct {
+	bkt   *bucketHandle
+	name  string
+	gen   int64
+	conds backend.Conditions
+}
+
+func (o *objectHandle) Generation(gen int64) backend.ObjectHandle {
+	c := *o
+	c.gen = gen
+	return &c
+}
+
+func (o *objectHandle) If(conds backend.Conditions) backend.ObjectHandle {
+	c := *o
+	c.conds = conds
+	return &c
+}
+
+func (o *objectHandle) path() string {
+	return filepath.Join(o.bkt.dir(), filepath.FromSlash(o.name))
+}
+
+// check validates the object name and that the bucket exists
+func (o *objectHandle) check() error {
+	if err := backend.ValidateObjectName(o.name); err != nil {
+		return err
+	}
+	_, err := o.bkt.b.readMeta(o.bkt.name)
+	return err
+}
+
+// live returns the attributes of the live object, nil if there is none
+func (o *objectHandle) live() (*backend.ObjectAttrs, error) {
+	info, err := os.Stat(o.path())
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o.bkt.objectAttrs(o.name, info), nil
+}
+
+// locate finds the data file and attributes of the handle's generation
+func (o *objectHandle) locate() (string, *backend.ObjectAttrs, error) {
+	if err := o.check(); err != nil {
+		return "", nil, err
+	}
+	live, err := o.live()
+	if err != nil {
+		return "", nil, err
+	}
+	if live != nil && (o.gen == 0 || live.Generation == o.gen) {
+		return o.path(), live, nil
+	}
+	if o.gen == 0 {
+		return "", nil, backend.ErrObjectNotExist
+	}
+	m, err := o.bkt.version(o.name, o.gen)
+	if err != nil {
+		return "", nil, err
+	}
+	return o.bkt.versionPath(o.name, o.gen, ".data"), m.attrs(o.bkt.name), nil
+}
+
+func (o *objectHandle) Attrs(ctx context.Context) (*backend.ObjectAttrs, error) {
+	_, attrs, err := o.locate()
+	return attrs, err
+}
+
+func (o *objectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return o.NewRangeReader(ctx, 0, -1)
+}
+
+func (o *objectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	p, _, err := o.locate()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, backend.ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	// stat the open file so the range is checked against what will be read
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = backend.ErrObjectNotExist
+	}
+	if err == nil {
+		err = backend.ValidateRange(offset, info.Size())
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedFile{io.LimitReader(f, length), f}, nil
+}
+
+// limitedFile reads a span of a file and closes the file
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+func (o *objectHandle) NewWriter(ctx context.Context, attrs *backend.ObjectAttrs) io.WriteCloser {
+	w := &writer{ctx: ctx, obj: o}
+	if attrs != nil {
+		w.attrs = *attrs
+	}
+	return w
+}
+
+// CopyTo streams the object through a writer so the copy is committed
+// atomically like any other write
+func (o *objectHandle) CopyTo(ctx context.Context, dst backend.ObjectHandle) (*backend.ObjectAttrs, error) {
+	return backend.CopyObject(ctx, o, dst)
+}
+
+// Delete with a generation removes that version, live or noncurrent, for good
+func (o *objectHandle) Delete(ctx context.Context) error {
+	o.bkt.b.mu.Lock()
+	defer o.bkt.b.mu.Unlock()
+	_, attrs, err := o.locate()
+	if err != nil {
+		return err
+	}
+	live, err := o.live()
+	if err != nil {
+		return err
+	}
+	if err := o.conds.Check(live); err != nil {
+		return err
+	}
+	if !attrs.Deleted.IsZero() {
+		return o.removeVersion(o.gen)
+	}
+	if o.gen == 0 {
+		bm, err := o.bkt.b.readMeta(o.bkt.name)
+		if err != nil {
+			return err
+		}
+		if err := o.archive(bm.Versioning); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(o.path()); err != nil {
+		if os.IsNotExist(err) {
+			return backend.ErrObjectNotExist
+		}
+		return err
+	}
+	os.Remove(o.bkt.metaPath(o.name))
+	o.prune()
+	return nil
+}
+
+// prune removes directories left empty between the object and its bucket
+func (o *objectHandle) prune() {
+	dir := filepath.Dir(o.path())
+	for dir != o.bkt.dir() && strings.HasPrefix(dir, o.bkt.dir()) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// writer streams into a temp file and renames it into place on Close
+// so readers never observe a partially written object
+type writer struct {
+	ctx    context.Context
+	obj    *objectHandle
+	attrs  backend.ObjectAttrs
+	f      *os.File
+	digest *backend.Digest
+	err    error
+	done   bool
+	// committed is the object written by Close
+	committed *backend.ObjectAttrs
+}
+
+func (w *writer) open() error {
+	if w.f != nil || w.err != nil {
+		return w.err
+	}
+	if w.err = w.obj.check(); w.err != nil {
+		return w.err
+	}
+	w.f, w.err = ioutil.TempFile(w.obj.bkt.b.tmpDir(), "object-")
+	w.digest = backend.NewDigest()
+	return w.err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write on closed writer")
+	}
+	if err := w.ctx.Err(); err != nil {
+		w.abort()
+		return 0, err
+	}
+	if err := w.open(); err != nil {
+		return 0, err
+	}
+	n, err := w.f.Write(p)
+	w.digest.Write(p[:n])
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *writer) Close() error {
+	if w.done {
+		return w.err
+	}
+	if err := w.open(); err != nil {
+		w.done = true
+		return err
+	}
+	w.done = true
+	if err := w.ctx.Err(); err != nil {
+		w.abort()
+		return err
+	}
+	if w.err = w.f.Close(); w.err != nil {
+		os.Remove(w.f.Name())
+		return w.err
+	}
+	// objects take the storage class of their bucket when written
+	bm, err := w.obj.bkt.b.readMeta(w.obj.bkt.name)
+	if err != nil {
+		w.err = err
+		os.Remove(w.f.Name())
+		return w.err
+	}
+	// the metadata is staged before anything is replaced, so the only step
+	// that can fail between the data and metadata going live is a rename
+	attrs := w.attrs
+	backend.ApplyDefaults(&attrs, bm.ObjectDefaults)
+	meta, err := w.obj.stageMeta(&objectMeta{
+		ContentType:        attrs.ContentType,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		Metadata:           attrs.Metadata,
+		StorageClass:       bm.StorageClass,
+		Generation:         backend.NewGeneration(),
+		MD5:                w.digest.MD5(),
+		CRC32C:             w.digest.CRC32C(),
+		Created:            time.Now().UTC(),
+	})
+	if err != nil {
+		w.err = err
+		os.Remove(w.f.Name())
+		return w.err
+	}
+	b := w.obj.bkt.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	live, err := w.obj.live()
+	if err == nil {
+		err = w.obj.conds.Check(live)
+	}
+	if err == nil {
+		err = w.obj.archive(bm.Versioning)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(w.obj.path()), 0755)
+	}
+	if err != nil {
+		w.err = err
+		os.Remove(w.f.Name())
+		os.Remove(meta)
+		return w.err
+	}
+	if w.err = os.Rename(w.f.Name(), w.obj.path()); w.err != nil {
+		os.Remove(w.f.Name())
+		os.Remove(meta)
+		return w.err
+	}
+	// the data is live, an object whose metadata cannot follow is removed
+	// rather than left with the generation and checksums of the last one
+	if w.err = os.Rename(meta, w.obj.bkt.metaPath(w.obj.name)); w.err != nil {
+		os.Remove(meta)
+		os.Remove(w.obj.path())
+		os.Remove(w.obj.bkt.metaPath(w.obj.name))
+		return w.err
+	}
+	// the object is committed, a failed read only loses the report of it
+	w.committed, _ = w.obj.live()
+	return nil
+}
+
+func (w *writer) Attrs() *backend.ObjectAttrs {
+	return w.committed
+}
+
+// stageMeta writes m to a temp file to be renamed to the metadata path
+func (o *objectHandle) stageMeta(m *objectMeta) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(o.bkt.metaDir(), 0755); err != nil {
+		return "", err
+	}
+	return o.bkt.b.stageFile(data)
+}
+
+// abort discards the temp file without committing the object
+func (w *writer) abort() {
+	w.done = true
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+	}
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err = f.Readdirnames(1); err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,153 @@
+package fs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/backendtest"
+	"github.com/evanharmon/eph-music-micro/storage/backend/fs"
+)
+
+func newBackend(t *testing.T) backend.Backend {
+	t.Helper()
+	b, err := fs.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, newBackend)
+}
+
+func TestNew(t *testing.T) {
+	if _, err := fs.New(""); err == nil {
+		t.Errorf("Empty root should throw error")
+	}
+}
+
+func TestWriterCleansUpTempFiles(t *testing.T) {
+	root := t.TempDir()
+	b, err := fs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkt := backendtest.CreateBucket(t, b, "songs")
+	backendtest.WriteObject(t, bkt, "track.flac", []byte("flac"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := bkt.Object("partial.flac").NewWriter(ctx, nil)
+	w.Write([]byte("partial"))
+	cancel()
+	w.Close()
+
+	files, err := ioutil.ReadDir(filepath.Join(root, ".eph", "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("temp dir should be empty, found %d files", len(files))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "songs", "track.flac"))
+	if err != nil || string(data) != "flac" {
+		t.Errorf("object should be stored at bucket/name, got %q, %v", data, err)
+	}
+}
+
+func TestMetadataPersists(t *testing.T) {
+	root := t.TempDir()
+	b, err := fs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkt := backendtest.CreateBucket(t, b, "songs")
+	backendtest.WriteObject(t, bkt, "artist/track.flac", []byte("flac"))
+
+	// a new backend on the same root sees the same metadata
+	b, err = fs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := b.Bucket("songs").Object("artist/track.flac").Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := backend.NewDigest()
+	d.Write([]byte("flac"))
+	if attrs.CRC32C != d.CRC32C() || string(attrs.MD5) != string(d.MD5()) {
+		t.Errorf("Attrs() checksums = %x %x, want %x %x", attrs.MD5, attrs.CRC32C, d.MD5(), d.CRC32C())
+	}
+}
+
+func TestVersionsSidecar(t *testing.T) {
+	root := t.TempDir()
+	b, err := fs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkt := backendtest.CreateBucket(t, b, "songs")
+	enabled := true
+	if _, err := bkt.Update(context.Background(), backend.BucketAttrsToUpdate{VersioningEnabled: &enabled}); err != nil {
+		t.Fatal(err)
+	}
+	backendtest.WriteObject(t, bkt, "mix.wav", []byte("take one"))
+	backendtest.WriteObject(t, bkt, "mix.wav", []byte("take two"))
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "songs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("bucket directory should only hold the live object, found %d files", len(files))
+	}
+	dirs, err := ioutil.ReadDir(filepath.Join(root, ".eph", "versions", "songs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 {
+		t.Errorf("versions should be kept in one sidecar directory, found %d", len(dirs))
+	}
+}
+
+func TestWriterKeepsDataAndMetadataTogether(t *testing.T) {
+	root := t.TempDir()
+	b, err := fs.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkt := backendtest.CreateBucket(t, b, "songs")
+	backendtest.WriteObject(t, bkt, "track.flac", []byte("flac"))
+
+	// a directory in place of the metadata file makes its rename fail
+	metas, err := filepath.Glob(filepath.Join(root, ".eph", "objects", "songs", "*.json"))
+	if err != nil || len(metas) != 1 {
+		t.Fatalf("expected one metadata file, got %v, %v", metas, err)
+	}
+	if err := os.Remove(metas[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(metas[0], "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := bkt.Object("track.flac").NewWriter(context.Background(), nil)
+	w.Write([]byte("new flac"))
+	if err := w.Close(); err == nil {
+		t.Fatal("Close() should fail when the metadata cannot be written")
+	}
+	if _, err := bkt.Object("track.flac").Attrs(context.Background()); err != backend.ErrObjectNotExist {
+		t.Errorf("new data should not be live without its metadata, got %v", err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(root, ".eph", "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("temp dir should be empty, found %d files", len(files))
+	}
+}
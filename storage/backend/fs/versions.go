@@ -0,0 +1,176 @@
+package fs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+// Noncurrent versions live in a sidecar directory under metaDir, one
+// directory per object named by a hash of the object name, holding a data
+// file and a metadata file per generation
+
+// versionMeta is persisted for each noncurrent version
+type versionMeta struct {
+	objectMeta
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Updated time.Time `json:"updated"`
+	Deleted time.Time `json:"deleted"`
+}
+
+func (b *Backend) versionsDir() string {
+	return filepath.Join(b.root, metaDir, "versions")
+}
+
+// versionsDir holds the noncurrent versions of every object in the bucket
+func (h *bucketHandle) versionsDir() string {
+	return filepath.Join(h.b.versionsDir(), h.name)
+}
+
+// versionDir holds the noncurrent versions of one object
+func (h *bucketHandle) versionDir(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return filepath.Join(h.versionsDir(), hex.EncodeToString(sum[:]))
+}
+
+func (h *bucketHandle) versionPath(name string, gen int64, ext string) string {
+	return filepath.Join(h.versionDir(name), strconv.FormatInt(gen, 10)+ext)
+}
+
+func (m *versionMeta) attrs(bucket string) *backend.ObjectAttrs {
+	return &backend.ObjectAttrs{
+		Bucket:             bucket,
+		Name:               m.Name,
+		ContentType:        m.ContentType,
+		CacheControl:       m.CacheControl,
+		ContentDisposition: m.ContentDisposition,
+		Metadata:           m.Metadata,
+		StorageClass:       m.StorageClass,
+		Generation:         m.Generation,
+		Size:               m.Size,
+		Created:            m.Created,
+		Updated:            m.Updated,
+		Deleted:            m.Deleted,
+		MD5:                m.MD5,
+		CRC32C:             m.CRC32C,
+	}
+}
+
+// version reads the metadata of a noncurrent version
+func (h *bucketHandle) version(name string, gen int64) (*versionMeta, error) {
+	data, err := ioutil.ReadFile(h.versionPath(name, gen, ".json"))
+	if os.IsNotExist(err) {
+		return nil, backend.ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &versionMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// versions returns the attributes of every noncurrent version in the bucket
+func (h *bucketHandle) versions() ([]*backend.ObjectAttrs, error) {
+	var res []*backend.ObjectAttrs
+	err := filepath.Walk(h.versionsDir(), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		m := &versionMeta{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return err
+		}
+		res = append(res, m.attrs(h.name))
+		return nil
+	})
+	return res, err
+}
+
+// archive keeps the live object as a noncurrent version when the bucket has
+// versioning enabled; the live file is hard linked so it stays readable
+// until the caller replaces or removes it
+// Callers must hold the backend lock
+func (o *objectHandle) archive(versioning bool) error {
+	if !versioning {
+		return nil
+	}
+	live, err := o.live()
+	if err != nil || live == nil {
+		return err
+	}
+	if live.Generation == 0 {
+		// files copied in by hand have no generation yet
+		live.Generation = backend.NewGeneration()
+	}
+	if err := os.MkdirAll(o.bkt.versionDir(o.name), 0755); err != nil {
+		return err
+	}
+	data := o.bkt.versionPath(o.name, live.Generation, ".data")
+	if err := os.Link(o.path(), data); err != nil {
+		return err
+	}
+	m := &versionMeta{
+		objectMeta: objectMeta{
+			ContentType:        live.ContentType,
+			CacheControl:       live.CacheControl,
+			ContentDisposition: live.ContentDisposition,
+			Metadata:           live.Metadata,
+			StorageClass:       live.StorageClass,
+			Generation:         live.Generation,
+			MD5:                live.MD5,
+			CRC32C:             live.CRC32C,
+			Created:            live.Created,
+		},
+		Name:    o.name,
+		Size:    live.Size,
+		Updated: live.Updated,
+		Deleted: time.Now().UTC(),
+	}
+	buf, err := json.Marshal(m)
+	if err == nil {
+		err = o.bkt.b.writeFile(o.bkt.versionPath(o.name, live.Generation, ".json"), buf)
+	}
+	if err != nil {
+		os.Remove(data)
+		return err
+	}
+	return nil
+}
+
+// removeVersion deletes a noncurrent version for good
+func (o *objectHandle) removeVersion(gen int64) error {
+	if err := os.Remove(o.bkt.versionPath(o.name, gen, ".json")); err != nil {
+		if os.IsNotExist(err) {
+			return backend.ErrObjectNotExist
+		}
+		return err
+	}
+	if err := os.Remove(o.bkt.versionPath(o.name, gen, ".data")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// only succeeds once the last version is gone
+	os.Remove(o.bkt.versionDir(o.name))
+	return nil
+}
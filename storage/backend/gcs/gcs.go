@@ -0,0 +1,429 @@
+// Package gcs implements the storage backend on Google Cloud Storage
+package gcs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	gstorage "cloud.google.com/go/storage"
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// msgBucketOwned is returned by GCS when creating a bucket the project owns
+const msgBucketOwned = "You already own this bucket. Please select another name."
+
+// Backend wraps a Google Cloud Storage client
+type Backend struct {
+	client *gstorage.Client
+	signer *urlSigner
+}
+
+// New creates a GCS backend using application default credentials
+// URLs can only be signed when those are a service account key
+func New(ctx context.Context) (*Backend, error) {
+	client, err := gstorage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newURLSigner(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &Backend{client, signer}, nil
+}
+
+// Bucket returns a handle for the named bucket
+func (b *Backend) Bucket(name string) backend.BucketHandle {
+	return &bucketHandle{b.client.Bucket(name), name, b.signer, b.client}
+}
+
+// Buckets iterates over the buckets in a project
+func (b *Backend) Buckets(ctx context.Context, projectID string) backend.BucketIterator {
+	return &bucketIterator{b.client.Buckets(ctx, projectID)}
+}
+
+// Close the underlying client
+func (b *Backend) Close() error {
+	return b.client.Close()
+}
+
+type bucketHandle struct {
+	h      *gstorage.BucketHandle
+	name   string
+	signer *urlSigner
+	client *gstorage.Client
+}
+
+func (b *bucketHandle) Create(ctx context.Context, projectID string, attrs *backend.BucketAttrs) error {
+	var gattrs *gstorage.BucketAttrs
+	if attrs != nil {
+		gattrs = &gstorage.BucketAttrs{
+			StorageClass: attrs.StorageClass,
+			Location:     attrs.Location,
+			Labels:       attrs.Labels,
+		}
+	}
+	err := b.h.Create(ctx, projectID, gattrs)
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict {
+		if gerr.Message == msgBucketOwned {
+			return backend.ErrBucketOwned
+		}
+		return backend.ErrBucketExist
+	}
+	return translate(err)
+}
+
+func (b *bucketHandle) Delete(ctx context.Context) error {
+	err := b.h.Delete(ctx)
+	if gerr, ok := err.(*googleapi.Error); ok {
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return backend.ErrBucketNotExist
+		case http.StatusConflict:
+			// GCS only conflicts on a bucket delete when objects remain
+			return backend.ErrBucketNotEmpty
+		}
+	}
+	return translate(err)
+}
+
+// InProject looks for the bucket among those of the project, as GCS bucket
+// attributes only carry the project number
+func (b *bucketHandle) InProject(ctx context.Context, projectID string) (bool, error) {
+	it := b.client.Buckets(ctx, projectID)
+	it.Prefix = b.name
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return false, translate(err)
+		}
+		if attrs.Name == b.name {
+			return true, nil
+		}
+	}
+	// a missing bucket is an error rather than one of another project
+	if _, err := b.h.Attrs(ctx); err != nil {
+		return false, translate(err)
+	}
+	return false, nil
+}
+
+func (b *bucketHandle) Attrs(ctx context.Context) (*backend.BucketAttrs, error) {
+	attrs, err := b.h.Attrs(ctx)
+	if err != nil {
+		return nil, translate(err)
+	}
+	return bucketAttrs(attrs), nil
+}
+
+// Update patches the bucket; this version of the GCS API cannot match
+// lifecycle rules by prefix and has no default object metadata, so those
+// return backend.ErrNotSupported
+func (b *bucketHandle) Update(ctx context.Context, uattrs backend.BucketAttrsToUpdate) (*backend.BucketAttrs, error) {
+	if d := uattrs.ObjectDefaults; d != nil && (d.CacheControl != "" || d.ContentDisposition != "" || len(d.Metadata) != 0) {
+		return nil, backend.ErrNotSupported
+	}
+
+	var gattrs gstorage.BucketAttrsToUpdate
+	if uattrs.VersioningEnabled != nil {
+		gattrs.VersioningEnabled = *uattrs.VersioningEnabled
+	}
+	if uattrs.Lifecycle != nil {
+		gattrs.Lifecycle = &gstorage.Lifecycle{Rules: []gstorage.LifecycleRule{}}
+		for _, r := range uattrs.Lifecycle {
+			if r.Prefix != "" {
+				return nil, backend.ErrNotSupported
+			}
+			gattrs.Lifecycle.Rules = append(gattrs.Lifecycle.Rules, gstorage.LifecycleRule{
+				Action:    gstorage.LifecycleAction{Type: r.Action, StorageClass: r.StorageClass},
+				Condition: gstorage.LifecycleCondition{AgeInDays: r.AgeInDays},
+			})
+		}
+	}
+	if uattrs.CORS != nil {
+		gattrs.CORS = []gstorage.CORS{}
+		for _, c := range uattrs.CORS {
+			gattrs.CORS = append(gattrs.CORS, gstorage.CORS{
+				Origins:         c.Origins,
+				Methods:         c.Methods,
+				ResponseHeaders: c.ResponseHeaders,
+				MaxAge:          c.MaxAge,
+			})
+		}
+	}
+
+	attrs, err := b.h.Update(ctx, gattrs)
+	if err != nil {
+		return nil, translate(err)
+	}
+	return bucketAttrs(attrs), nil
+}
+
+func (b *bucketHandle) Object(name string) backend.ObjectHandle {
+	return &objectHandle{b.h.Object(name)}
+}
+
+// SignedURL returns a V4 signed URL, which the pinned client library
+// cannot create itself
+func (b *bucketHandle) SignedURL(name string, opts backend.SignedURLOptions) (string, error) {
+	if b.signer == nil {
+		return "", errNoSigningKey
+	}
+	now := time.Now()
+	return b.signer.sign(b.name, name, opts, now, opts.Expires.Sub(now))
+}
+
+func (b *bucketHandle) Objects(ctx context.Context, q *backend.Query) backend.ObjectIterator {
+	it := &objectIterator{it: b.h.Objects(ctx, objectQuery(q))}
+	if q != nil {
+		it.startAfter = q.StartAfter
+	}
+	return it
+}
+
+// ObjectsPage resumes the listing from a GCS page token, so each page costs
+// one request rather than a scan from the start of the bucket
+// q.StartAfter is ignored, the token says where the page starts
+func (b *bucketHandle) ObjectsPage(ctx context.Context, q *backend.Query, pageSize int, token string) ([]*backend.ObjectAttrs, string, error) {
+	var page []*gstorage.ObjectAttrs
+	next, err := iterator.NewPager(b.h.Objects(ctx, objectQuery(q)), pageSize, token).NextPage(&page)
+	if err != nil {
+		return nil, "", translate(err)
+	}
+	attrs := make([]*backend.ObjectAttrs, len(page))
+	for i, a := range page {
+		attrs[i] = objectAttrs(a)
+	}
+	return attrs, next, nil
+}
+
+func objectQuery(q *backend.Query) *gstorage.Query {
+	if q == nil {
+		return nil
+	}
+	return &gstorage.Query{Prefix: q.Prefix, Delimiter: q.Delimiter, Versions: q.Versions}
+}
+
+type objectHandle struct {
+	h *gstorage.ObjectHandle
+}
+
+func (o *objectHandle) Generation(gen int64) backend.ObjectHandle {
+	return &objectHandle{o.h.Generation(gen)}
+}
+
+// If leaves the handle unchanged for empty conditions, which GCS rejects
+func (o *objectHandle) If(conds backend.Conditions) backend.ObjectHandle {
+	if conds == (backend.Conditions{}) {
+		return o
+	}
+	return &objectHandle{o.h.If(gstorage.Conditions{
+		GenerationMatch: conds.GenerationMatch,
+		DoesNotExist:    conds.DoesNotExist,
+	})}
+}
+
+func (o *objectHandle) Attrs(ctx context.Context) (*backend.ObjectAttrs, error) {
+	attrs, err := o.h.Attrs(ctx)
+	if err != nil {
+		return nil, translate(err)
+	}
+	return objectAttrs(attrs), nil
+}
+
+func (o *objectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	r, err := o.h.NewReader(ctx)
+	if err != nil {
+		return nil, translate(err)
+	}
+	return r, nil
+}
+
+func (o *objectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, backend.ErrInvalidRange
+	}
+	r, err := o.h.NewRangeReader(ctx, offset, length)
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+		return nil, backend.ErrInvalidRange
+	}
+	if err != nil {
+		return nil, translate(err)
+	}
+	return r, nil
+}
+
+func (o *objectHandle) NewWriter(ctx context.Context, attrs *backend.ObjectAttrs) io.WriteCloser {
+	w := o.h.NewWriter(ctx)
+	if attrs != nil {
+		w.ContentType = attrs.ContentType
+		w.CacheControl = attrs.CacheControl
+		w.ContentDisposition = attrs.ContentDisposition
+		w.Metadata = attrs.Metadata
+	}
+	return &writer{w}
+}
+
+// writer translates the errors of committing an object on Close
+type writer struct {
+	*gstorage.Writer
+}
+
+func (w *writer) Close() error {
+	return translate(w.Writer.Close())
+}
+
+func (w *writer) Attrs() *backend.ObjectAttrs {
+	attrs := w.Writer.Attrs()
+	if attrs == nil {
+		return nil
+	}
+	return objectAttrs(attrs)
+}
+
+// CopyTo uses a GCS rewrite, which copies metadata from the source
+func (o *objectHandle) CopyTo(ctx context.Context, dst backend.ObjectHandle) (*backend.ObjectAttrs, error) {
+	attrs, err := dst.(*objectHandle).h.CopierFrom(o.h).Run(ctx)
+	if err != nil {
+		return nil, translate(err)
+	}
+	return objectAttrs(attrs), nil
+}
+
+func (o *objectHandle) Delete(ctx context.Context) error {
+	return translate(o.h.Delete(ctx))
+}
+
+type bucketIterator struct {
+	it *gstorage.BucketIterator
+}
+
+func (i *bucketIterator) Next() (*backend.BucketAttrs, error) {
+	attrs, err := i.it.Next()
+	if err != nil {
+		return nil, translate(err)
+	}
+	return bucketAttrs(attrs), nil
+}
+
+// objectIterator skips entries up to startAfter client side as this
+// version of the GCS API has no start offset for listings, reading every
+// entry before it; paged listings use ObjectsPage instead
+type objectIterator struct {
+	it         *gstorage.ObjectIterator
+	startAfter string
+}
+
+func (i *objectIterator) Next() (*backend.ObjectAttrs, error) {
+	for {
+		attrs, err := i.it.Next()
+		if err != nil {
+			return nil, translate(err)
+		}
+		a := objectAttrs(attrs)
+		if backend.SortKey(a) > i.startAfter {
+			return a, nil
+		}
+	}
+}
+
+func bucketAttrs(a *gstorage.BucketAttrs) *backend.BucketAttrs {
+	return &backend.BucketAttrs{
+		Name:         a.Name,
+		StorageClass: a.StorageClass,
+		Location:     a.Location,
+		Labels:       a.Labels,
+		Created:      a.Created,
+
+		VersioningEnabled: a.VersioningEnabled,
+		Lifecycle:         lifecycleRules(a.Lifecycle),
+		CORS:              corsRules(a.CORS),
+	}
+}
+
+func lifecycleRules(l gstorage.Lifecycle) []backend.LifecycleRule {
+	var rules []backend.LifecycleRule
+	for _, r := range l.Rules {
+		rules = append(rules, backend.LifecycleRule{
+			Action:       r.Action.Type,
+			StorageClass: r.Action.StorageClass,
+			AgeInDays:    r.Condition.AgeInDays,
+		})
+	}
+	return rules
+}
+
+func corsRules(cors []gstorage.CORS) []backend.CORS {
+	var rules []backend.CORS
+	for _, c := range cors {
+		rules = append(rules, backend.CORS{
+			Origins:         c.Origins,
+			Methods:         c.Methods,
+			ResponseHeaders: c.ResponseHeaders,
+			MaxAge:          c.MaxAge,
+		})
+	}
+	return rules
+}
+
+func objectAttrs(a *gstorage.ObjectAttrs) *backend.ObjectAttrs {
+	return &backend.ObjectAttrs{
+		Bucket:             a.Bucket,
+		Name:               a.Name,
+		ContentType:        a.ContentType,
+		CacheControl:       a.CacheControl,
+		ContentDisposition: a.ContentDisposition,
+		Metadata:           a.Metadata,
+		StorageClass:       a.StorageClass,
+		Generation:         a.Generation,
+		Size:               a.Size,
+		Created:            a.Created,
+		Updated:            a.Updated,
+		Deleted:            a.Deleted,
+		MD5:                a.MD5,
+		CRC32C:             a.CRC32C,
+		Prefix:             a.Prefix,
+	}
+}
+
+// translate maps GCS errors onto the backend sentinel errors
+func translate(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case iterator.Done:
+		return backend.Done
+	case gstorage.ErrBucketNotExist:
+		return backend.ErrBucketNotExist
+	case gstorage.ErrObjectNotExist:
+		return backend.ErrObjectNotExist
+	}
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return err
+	}
+	switch gerr.Code {
+	case http.StatusPreconditionFailed:
+		return backend.ErrPreconditionFailed
+	case http.StatusTooManyRequests:
+		return backend.ErrQuotaExceeded
+	case http.StatusForbidden:
+		// GCS reports some rate limits as 403s, told apart by their reason
+		for _, item := range gerr.Errors {
+			switch item.Reason {
+			case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "dailyLimitExceeded":
+				return backend.ErrQuotaExceeded
+			}
+		}
+		return backend.ErrPermissionDenied
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gstorage "cloud.google.com/go/storage"
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"google.golang.org/api/option"
+)
+
+// newFakeBackend points a backend at a fake of the GCS JSON API
+func newFakeBackend(t *testing.T, handler http.HandlerFunc) *Backend {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	client, err := gstorage.NewClient(context.Background(),
+		option.WithEndpoint(ts.URL+"/storage/v1/"),
+		option.WithHTTPClient(ts.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return &Backend{client: client}
+}
+
+func TestObjectsPage(t *testing.T) {
+	pages := map[string]struct {
+		items []string
+		next  string
+	}{
+		"":        {[]string{"a.mp3", "b.mp3"}, "token-2"},
+		"token-2": {[]string{"c.mp3"}, ""},
+	}
+	requests := 0
+	b := newFakeBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		page, ok := pages[r.URL.Query().Get("pageToken")]
+		if !ok {
+			http.Error(w, `{"error":{"code":400,"message":"bad token"}}`, http.StatusBadRequest)
+			return
+		}
+		res := map[string]interface{}{"nextPageToken": page.next}
+		var items []map[string]string
+		for _, name := range page.items {
+			items = append(items, map[string]string{"name": name, "bucket": "songs"})
+		}
+		res["items"] = items
+		json.NewEncoder(w).Encode(res)
+	})
+
+	p := b.Bucket("songs").(*bucketHandle)
+	var names []string
+	token := ""
+	for {
+		page, next, err := p.ObjectsPage(context.Background(), nil, 2, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range page {
+			names = append(names, a.Name)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if len(names) != 3 || names[0] != "a.mp3" || names[2] != "c.mp3" {
+		t.Errorf("Expected a.mp3, b.mp3 and c.mp3, got %v", names)
+	}
+	if requests != 2 {
+		t.Errorf("Expected one request per page, got %d", requests)
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	tests := map[string]struct {
+		code int
+		err  error
+	}{
+		"deleted":   {http.StatusNoContent, nil},
+		"missing":   {http.StatusNotFound, backend.ErrBucketNotExist},
+		"not empty": {http.StatusConflict, backend.ErrBucketNotEmpty},
+		"forbidden": {http.StatusForbidden, backend.ErrPermissionDenied},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := newFakeBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodDelete || r.URL.Path != "/storage/v1/b/songs" {
+					http.Error(w, `{"error":{"code":400,"message":"unexpected request"}}`, http.StatusBadRequest)
+					return
+				}
+				if test.code == http.StatusNoContent {
+					w.WriteHeader(test.code)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(test.code)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"error": map[string]interface{}{"code": test.code, "message": http.StatusText(test.code)},
+				})
+			})
+			if err := b.Bucket("songs").Delete(context.Background()); err != test.err {
+				t.Errorf("Delete() = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestInProject(t *testing.T) {
+	b := newFakeBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/storage/v1/b":
+			var items []map[string]string
+			if r.URL.Query().Get("project") == "eph-music" {
+				// the prefix matches more than the bucket itself
+				items = []map[string]string{{"name": "songs"}, {"name": "songs-archive"}}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+		case "/storage/v1/b/songs":
+			json.NewEncoder(w).Encode(map[string]string{"name": "songs"})
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"Not Found"}}`))
+		}
+	})
+
+	ctx := context.Background()
+	if ok, err := b.Bucket("songs").InProject(ctx, "eph-music"); !ok || err != nil {
+		t.Errorf("InProject() by owner = %v, %v, want true", ok, err)
+	}
+	if ok, err := b.Bucket("songs").InProject(ctx, "other"); ok || err != nil {
+		t.Errorf("InProject() by other project = %v, %v, want false", ok, err)
+	}
+	if _, err := b.Bucket("missing").InProject(ctx, "eph-music"); err != backend.ErrBucketNotExist {
+		t.Errorf("InProject() on missing bucket = %v, want %v", err, backend.ErrBucketNotExist)
+	}
+}
@@ -0,0 +1,71 @@
+package gcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+func TestSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &urlSigner{email: "eph@eph-music.iam.gserviceaccount.com", key: key}
+	at := time.Date(2019, 2, 1, 9, 0, 0, 0, time.UTC)
+	opts := backend.SignedURLOptions{Method: "PUT", ContentType: "audio/flac"}
+
+	signed, err := s.sign("test-eph-music", "artist/my song.flac", opts, at, 15*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != signHost || u.EscapedPath() != "/test-eph-music/artist/my%20song.flac" {
+		t.Errorf("Signed URL %s has the wrong host or path", signed)
+	}
+	q := u.Query()
+	want := map[string]string{
+		"X-Goog-Algorithm":     "GOOG4-RSA-SHA256",
+		"X-Goog-Credential":    "eph@eph-music.iam.gserviceaccount.com/20190201/auto/storage/goog4_request",
+		"X-Goog-Date":          "20190201T090000Z",
+		"X-Goog-Expires":       "900",
+		"X-Goog-SignedHeaders": "content-type;host",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+
+	// the signature must cover the query the URL carries
+	sig, err := hex.DecodeString(q.Get("X-Goog-Signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Del("X-Goog-Signature")
+	canonical := strings.Join([]string{
+		"PUT",
+		u.EscapedPath(),
+		canonicalQuery(q),
+		"content-type:audio/flac\nhost:" + signHost + "\n",
+		"content-type;host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "GOOG4-RSA-SHA256\n20190201T090000Z\n20190201/auto/storage/goog4_request\n" + hex.EncodeToString(hash[:])
+	digest := sha256.Sum256([]byte(toSign))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("Signature does not verify: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+)
+
+// NewBucketIterator returns an iterator over a fixed slice of bucket attributes
+func NewBucketIterator(attrs []*BucketAttrs) BucketIterator {
+	return &bucketSliceIterator{attrs: attrs}
+}
+
+// NewErrorBucketIterator returns an iterator that fails with err
+func NewErrorBucketIterator(err error) BucketIterator {
+	return &bucketSliceIterator{err: err}
+}
+
+type bucketSliceIterator struct {
+	attrs []*BucketAttrs
+	err   error
+}
+
+func (i *bucketSliceIterator) Next() (*BucketAttrs, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if len(i.attrs) == 0 {
+		return nil, Done
+	}
+	a := i.attrs[0]
+	i.attrs = i.attrs[1:]
+	return a, nil
+}
+
+// NewObjectIterator returns an iterator over a fixed slice of object attributes
+func NewObjectIterator(attrs []*ObjectAttrs) ObjectIterator {
+	return &objectSliceIterator{attrs: attrs}
+}
+
+// NewErrorObjectIterator returns an iterator that fails with err
+func NewErrorObjectIterator(err error) ObjectIterator {
+	return &objectSliceIterator{err: err}
+}
+
+type objectSliceIterator struct {
+	attrs []*ObjectAttrs
+	err   error
+}
+
+func (i *objectSliceIterator) Next() (*ObjectAttrs, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	if len(i.attrs) == 0 {
+		return nil, Done
+	}
+	a := i.attrs[0]
+	i.attrs = i.attrs[1:]
+	return a, nil
+}
+
+// FilterObjects applies a query to a full listing of a bucket the way GCS does
+// Results are sorted by name then generation; with a delimiter, names sharing
+// a prefix up to and including the delimiter are collapsed into a single entry
+// with only Prefix set
+func FilterObjects(all []*ObjectAttrs, q *Query) []*ObjectAttrs {
+	var (
+		prefix     string
+		delimiter  string
+		startAfter string
+		res        []*ObjectAttrs
+		seen       = map[string]bool{}
+	)
+	if q != nil {
+		prefix, delimiter, startAfter = q.Prefix, q.Delimiter, q.StartAfter
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		return all[i].Generation < all[j].Generation
+	})
+	for _, a := range all {
+		if !strings.HasPrefix(a.Name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			rest := a.Name[len(prefix):]
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				p := prefix + rest[:i+len(delimiter)]
+				if !seen[p] && p > startAfter {
+					seen[p] = true
+					res = append(res, &ObjectAttrs{Bucket: a.Bucket, Prefix: p})
+				}
+				continue
+			}
+		}
+		if a.Name > startAfter {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// SortKey returns the name a listing entry sorts by
+func SortKey(a *ObjectAttrs) string {
+	if a.Prefix != "" {
+		return a.Prefix
+	}
+	return a.Name
+}
@@ -0,0 +1,462 @@
+// Package memory implements a thread-safe in-memory storage backend
+// Contents are lost when the process exits; intended for tests and ephemeral servers
+package memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+// Backend holds all buckets and objects in memory
+type Backend struct {
+	mu      sync.RWMutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	attrs     backend.BucketAttrs
+	projectID string
+	objects   map[string]*object
+	// versions holds the noncurrent versions of each name, oldest first
+	versions map[string][]*object
+}
+
+type object struct {
+	attrs   backend.ObjectAttrs
+	content []byte
+}
+
+// New creates an empty in-memory backend
+func New() *Backend {
+	return &Backend{buckets: map[string]*bucket{}}
+}
+
+// Bucket returns a handle for the named bucket
+func (b *Backend) Bucket(name string) backend.BucketHandle {
+	return &bucketHandle{b, name}
+}
+
+// Buckets iterates over the buckets created by a project
+func (b *Backend) Buckets(ctx context.Context, projectID string) backend.BucketIterator {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var res []*backend.BucketAttrs
+	for _, bkt := range b.buckets {
+		if bkt.projectID == projectID {
+			res = append(res, copyBucketAttrs(bkt.attrs))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return backend.NewBucketIterator(res)
+}
+
+// Close is a no-op for the memory backend
+func (b *Backend) Close() error {
+	return nil
+}
+
+type bucketHandle struct {
+	b    *Backend
+	name string
+}
+
+func (h *bucketHandle) Create(ctx context.Context, projectID string, attrs *backend.BucketAttrs) error {
+	if err := backend.ValidateBucketName(h.name); err != nil {
+		return err
+	}
+	h.b.mu.Lock()
+	defer h.b.mu.Unlock()
+	if existing, ok := h.b.buckets[h.name]; ok {
+		if existing.projectID == projectID {
+			return backend.ErrBucketOwned
+		}
+		return backend.ErrBucketExist
+	}
+	bkt := &bucket{
+		attrs:     backend.BucketAttrs{Name: h.name, Created: time.Now().UTC()},
+		projectID: projectID,
+		objects:   map[string]*object{},
+		versions:  map[string][]*object{},
+	}
+	if attrs != nil {
+		bkt.attrs.StorageClass = attrs.StorageClass
+		bkt.attrs.Location = attrs.Location
+		bkt.attrs.Labels = copyMap(attrs.Labels)
+	}
+	h.b.buckets[h.name] = bkt
+	return nil
+}
+
+func (h *bucketHandle) Delete(ctx context.Context) error {
+	h.b.mu.Lock()
+	defer h.b.mu.Unlock()
+	bkt, ok := h.b.buckets[h.name]
+	if !ok {
+		return backend.ErrBucketNotExist
+	}
+	if len(bkt.objects) != 0 || len(bkt.versions) != 0 {
+		return backend.ErrBucketNotEmpty
+	}
+	delete(h.b.buckets, h.name)
+	return nil
+}
+
+func (h *bucketHandle) Attrs(ctx context.Context) (*backend.BucketAttrs, error) {
+	h.b.mu.RLock()
+	defer h.b.mu.RUnlock()
+	bkt, ok := h.b.buckets[h.name]
+	if !ok {
+		return nil, backend.ErrBucketNotExist
+	}
+	return copyBucketAttrs(bkt.attrs), nil
+}
+
+func (h *bucketHandle) InProject(ctx context.Context, projectID string) (bool, error) {
+	h.b.mu.RLock()
+	defer h.b.mu.RUnlock()
+	bkt, ok := h.b.buckets[h.name]
+	if !ok {
+		return false, backend.ErrBucketNotExist
+	}
+	return bkt.projectID == projectID, nil
+}
+
+// Update stores the settings; lifecycle rules are kept but not enforced
+func (h *bucketHandle) Update(ctx context.Context, uattrs backend.BucketAttrsToUpdate) (*backend.BucketAttrs, error) {
+	h.b.mu.Lock()
+	defer h.b.mu.Unlock()
+	bkt, ok := h.b.buckets[h.name]
+	if !ok {
+		return nil, backend.ErrBucketNotExist
+	}
+	backend.ApplyUpdate(&bkt.attrs, uattrs)
+	return copyBucketAttrs(bkt.attrs), nil
+}
+
+func (h *bucketHandle) Object(name string) backend.ObjectHandle {
+	return &objectHandle{bkt: h, name: name}
+}
+
+// SignedURL is not supported, the server signs URLs for its own HTTP
+// handler instead
+func (h *bucketHandle) SignedURL(name string, opts backend.SignedURLOptions) (string, error) {
+	return "", backend.ErrNotSupported
+}
+
+func (h *bucketHandle) Objects(ctx context.Context, q *backend.Query) backend.ObjectIterator {
+	h.b.mu.RLock()
+	defer h.b.mu.RUnlock()
+	bkt, ok := h.b.buckets[h.name]
+	if !ok {
+		return backend.NewErrorObjectIterator(backend.ErrBucketNotExist)
+	}
+	all := make([]*backend.ObjectAttrs, 0, len(bkt.objects))
+	for _, obj := range bkt.objects {
+		all = append(all, obj.copyAttrs())
+	}
+	if q != nil && q.Versions {
+		for _, versions := range bkt.versions {
+			for _, obj := range versions {
+				all = append(all, obj.copyAttrs())
+			}
+		}
+	}
+	return backend.NewObjectIterator(backend.FilterObjects(all, q))
+}
+
+// copyAttrs keeps callers from sharing the stored metadata map
+func (obj *object) copyAttrs() *backend.ObjectAttrs {
+	attrs := obj.attrs
+	attrs.Metadata = copyMap(attrs.Metadata)
+	return &attrs
+}
+
+// archive removes the live object, keeping it as a noncurrent version when
+// versioning is enabled; callers must hold the backend lock
+func (bkt *bucket) archive(name string) {
+	obj, ok := bkt.objects[name]
+	if !ok {
+		return
+	}
+	delete(bkt.objects, name)
+	if bkt.attrs.VersioningEnabled {
+		obj.attrs.Deleted = time.Now().UTC()
+		bkt.versions[name] = append(bkt.versions[name], obj)
+	}
+}
+
+// check tests the handle's conditions against the live object; callers
+// must hold the backend lock
+func (o *objectHandle) check(bkt *bucket) error {
+	var live *backend.ObjectAttrs
+	if obj, ok := bkt.objects[o.name]; ok {
+		live = &obj.attrs
+	}
+	return o.conds.Check(live)
+}
+
+type objectHandle struct {
+	bkt   *bucketHandle
+	name  string
+	gen   int64
+	conds backend.Conditions
+}
+
+func (o *objectHandle) Generation(gen int64) backend.ObjectHandle {
+	c := *o
+	c.gen = gen
+	return &c
+}
+
+func (o *objectHandle) If(conds backend.Conditions) backend.ObjectHandle {
+	c := *o
+	c.conds = conds
+	return &c
+}
+
+// get returns the stored object, or the version picked by Generation;
+// callers must hold the backend lock
+func (o *objectHandle) get() (*object, error) {
+	bkt, ok := o.bkt.b.buckets[o.bkt.name]
+	if !ok {
+		return nil, backend.ErrBucketNotExist
+	}
+	obj, ok := bkt.objects[o.name]
+	if ok && (o.gen == 0 || obj.attrs.Generation == o.gen) {
+		return obj, nil
+	}
+	if o.gen != 0 {
+		for _, v := range bkt.versions[o.name] {
+			if v.attrs.Generation == o.gen {
+				return v, nil
+			}
+		}
+	}
+	return nil, backend.ErrObjectNotExist
+}
+
+func (o *objectHandle) Attrs(ctx context.Context) (*backend.ObjectAttrs, error) {
+	o.bkt.b.mu.RLock()
+	defer o.bkt.b.mu.RUnlock()
+	obj, err := o.get()
+	if err != nil {
+		return nil, err
+	}
+	return obj.copyAttrs(), nil
+}
+
+func (o *objectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return o.NewRangeReader(ctx, 0, -1)
+}
+
+func (o *objectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	o.bkt.b.mu.RLock()
+	defer o.bkt.b.mu.RUnlock()
+	obj, err := o.get()
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(obj.content))
+	if err := backend.ValidateRange(offset, size); err != nil {
+		return nil, err
+	}
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	// content is never mutated in place, overwrites swap in a new slice
+	return ioutil.NopCloser(bytes.NewReader(obj.content[offset:end])), nil
+}
+
+func (o *objectHandle) NewWriter(ctx context.Context, attrs *backend.ObjectAttrs) io.WriteCloser {
+	w := &writer{ctx: ctx, obj: o}
+	if attrs != nil {
+		w.attrs = *attrs
+	}
+	return w
+}
+
+func (o *objectHandle) CopyTo(ctx context.Context, dsth backend.ObjectHandle) (*backend.ObjectAttrs, error) {
+	dh := dsth.(*objectHandle)
+	if err := backend.ValidateObjectName(dh.name); err != nil {
+		return nil, err
+	}
+	o.bkt.b.mu.Lock()
+	defer o.bkt.b.mu.Unlock()
+	src, err := o.get()
+	if err != nil {
+		return nil, err
+	}
+	dst, ok := o.bkt.b.buckets[dh.bkt.name]
+	if !ok {
+		return nil, backend.ErrBucketNotExist
+	}
+	if err := dh.check(dst); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	attrs := src.attrs
+	attrs.Bucket = dh.bkt.name
+	attrs.Name = dh.name
+	attrs.Metadata = copyMap(src.attrs.Metadata)
+	attrs.StorageClass = dst.attrs.StorageClass
+	attrs.Generation = backend.NewGeneration()
+	attrs.Created = now
+	attrs.Updated = now
+	attrs.Deleted = time.Time{}
+	// content is never mutated in place so the copy can share it
+	dst.archive(dh.name)
+	obj := &object{attrs: attrs, content: src.content}
+	dst.objects[dh.name] = obj
+	return obj.copyAttrs(), nil
+}
+
+// Delete with a generation removes that version, live or noncurrent, for good
+func (o *objectHandle) Delete(ctx context.Context) error {
+	o.bkt.b.mu.Lock()
+	defer o.bkt.b.mu.Unlock()
+	obj, err := o.get()
+	if err != nil {
+		return err
+	}
+	bkt := o.bkt.b.buckets[o.bkt.name]
+	if err := o.check(bkt); err != nil {
+		return err
+	}
+	if o.gen == 0 {
+		bkt.archive(o.name)
+		return nil
+	}
+	if bkt.objects[o.name] == obj {
+		delete(bkt.objects, o.name)
+		return nil
+	}
+	versions := bkt.versions[o.name]
+	for i, v := range versions {
+		if v == obj {
+			versions = append(versions[:i:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(bkt.versions, o.name)
+	} else {
+		bkt.versions[o.name] = versions
+	}
+	return nil
+}
+
+// writer buffers content and commits it on Close, replacing any existing object
+type writer struct {
+	ctx   context.Context
+	obj   *objectHandle
+	attrs backend.ObjectAttrs
+	buf   bytes.Buffer
+	done  bool
+	// committed is the object written by Close
+	committed *backend.ObjectAttrs
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write on closed writer")
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *writer) Close() error {
+	if w.done {
+		return errors.New("writer already closed")
+	}
+	w.done = true
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if err := backend.ValidateObjectName(w.obj.name); err != nil {
+		return err
+	}
+
+	b := w.obj.bkt.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bkt, ok := b.buckets[w.obj.bkt.name]
+	if !ok {
+		return backend.ErrBucketNotExist
+	}
+	if err := w.obj.check(bkt); err != nil {
+		return err
+	}
+	bkt.archive(w.obj.name)
+	d := backend.NewDigest()
+	d.Write(w.buf.Bytes())
+	now := time.Now().UTC()
+	attrs := w.attrs
+	if attrs.ContentType == "" {
+		attrs.ContentType = mime.TypeByExtension(path.Ext(w.obj.name))
+	}
+	backend.ApplyDefaults(&attrs, bkt.attrs.ObjectDefaults)
+	obj := &object{
+		attrs: backend.ObjectAttrs{
+			Bucket:             w.obj.bkt.name,
+			Name:               w.obj.name,
+			ContentType:        attrs.ContentType,
+			CacheControl:       attrs.CacheControl,
+			ContentDisposition: attrs.ContentDisposition,
+			Metadata:           copyMap(attrs.Metadata),
+			StorageClass:       bkt.attrs.StorageClass,
+			Generation:         backend.NewGeneration(),
+			Size:               int64(w.buf.Len()),
+			Created:            now,
+			Updated:            now,
+			MD5:                d.MD5(),
+			CRC32C:             d.CRC32C(),
+		},
+		content: w.buf.Bytes(),
+	}
+	bkt.objects[w.obj.name] = obj
+	w.committed = obj.copyAttrs()
+	return nil
+}
+
+func (w *writer) Attrs() *backend.ObjectAttrs {
+	return w.committed
+}
+
+// copyBucketAttrs keeps callers from sharing the stored labels, rules and
+// defaults of a bucket
+func copyBucketAttrs(attrs backend.BucketAttrs) *backend.BucketAttrs {
+	c := attrs
+	c.Labels = copyMap(attrs.Labels)
+	backend.ApplyUpdate(&c, backend.BucketAttrsToUpdate{
+		Lifecycle:      attrs.Lifecycle,
+		CORS:           attrs.CORS,
+		ObjectDefaults: &attrs.ObjectDefaults,
+	})
+	return &c
+}
+
+// copyMap keeps callers from sharing a stored metadata or labels map
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
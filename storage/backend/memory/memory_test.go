@@ -0,0 +1,71 @@
+package memory_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/backendtest"
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
+)
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, func(t *testing.T) backend.Backend {
+		return memory.New()
+	})
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	b := memory.New()
+	bkt := backendtest.CreateBucket(t, b, "songs")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("track-%02d.flac", i%10)
+			w := bkt.Object(name).NewWriter(context.Background(), nil)
+			w.Write([]byte(name))
+			if err := w.Close(); err != nil {
+				t.Error(err)
+			}
+			bkt.Objects(context.Background(), nil).Next()
+		}(i)
+	}
+	wg.Wait()
+
+	count := 0
+	it := bkt.Objects(context.Background(), nil)
+	for {
+		_, err := it.Next()
+		if err == backend.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 10 {
+		t.Errorf("found %d objects, want 10", count)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	b := memory.New()
+	bkt := backendtest.CreateBucket(t, b, "songs")
+	backendtest.WriteObject(t, bkt, "track.flac", []byte("flac"))
+
+	attrs, err := bkt.Object("track.flac").Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := backend.NewDigest()
+	d.Write([]byte("flac"))
+	if attrs.CRC32C != d.CRC32C() || string(attrs.MD5) != string(d.MD5()) {
+		t.Errorf("Attrs() checksums = %x %x, want %x %x", attrs.MD5, attrs.CRC32C, d.MD5(), d.CRC32C())
+	}
+}
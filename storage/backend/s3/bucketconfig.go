@@ -0,0 +1,187 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+// versioningConfig enables or suspends versioning; S3 versioning cannot be
+// turned off again once enabled
+type versioningConfig struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+type lifecycleConfig struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Rules   []lifecycleRule `xml:"Rule"`
+}
+
+type lifecycleRule struct {
+	ID         string               `xml:"ID"`
+	Prefix     string               `xml:"Filter>Prefix"`
+	Status     string               `xml:"Status"`
+	Expiration *lifecycleExpiration `xml:"Expiration,omitempty"`
+	Transition *lifecycleTransition `xml:"Transition,omitempty"`
+}
+
+type lifecycleExpiration struct {
+	Days int64 `xml:"Days"`
+}
+
+type lifecycleTransition struct {
+	Days         int64  `xml:"Days"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type corsConfig struct {
+	XMLName xml.Name   `xml:"CORSConfiguration"`
+	Rules   []corsRule `xml:"CORSRule"`
+}
+
+type corsRule struct {
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	ExposeHeaders  []string `xml:"ExposeHeader"`
+	MaxAgeSeconds  int64    `xml:"MaxAgeSeconds,omitempty"`
+}
+
+// Update applies each setting with its own S3 call, so a failure can leave
+// the earlier settings applied
+// S3 has no default object metadata, setting it returns backend.ErrNotSupported
+func (h *bucketHandle) Update(ctx context.Context, uattrs backend.BucketAttrsToUpdate) (*backend.BucketAttrs, error) {
+	if d := uattrs.ObjectDefaults; d != nil && (d.CacheControl != "" || d.ContentDisposition != "" || len(d.Metadata) != 0) {
+		return nil, backend.ErrNotSupported
+	}
+
+	if uattrs.VersioningEnabled != nil {
+		v := versioningConfig{Status: "Suspended"}
+		if *uattrs.VersioningEnabled {
+			v.Status = "Enabled"
+		}
+		if err := h.putConfig(ctx, "versioning", v); err != nil {
+			return nil, err
+		}
+	}
+	if uattrs.Lifecycle != nil {
+		if err := h.putLifecycle(ctx, uattrs.Lifecycle); err != nil {
+			return nil, err
+		}
+	}
+	if uattrs.CORS != nil {
+		if err := h.putCORS(ctx, uattrs.CORS); err != nil {
+			return nil, err
+		}
+	}
+	return h.Attrs(ctx)
+}
+
+func (h *bucketHandle) putLifecycle(ctx context.Context, rules []backend.LifecycleRule) error {
+	if len(rules) == 0 {
+		return h.deleteConfig(ctx, "lifecycle")
+	}
+	var lc lifecycleConfig
+	for i, r := range rules {
+		rule := lifecycleRule{ID: "rule-" + strconv.Itoa(i), Prefix: r.Prefix, Status: "Enabled"}
+		if r.Action == backend.LifecycleSetStorageClass {
+			class := r.StorageClass
+			if c, ok := storageClasses[class]; ok {
+				class = c
+			}
+			rule.Transition = &lifecycleTransition{Days: r.AgeInDays, StorageClass: class}
+		} else {
+			rule.Expiration = &lifecycleExpiration{Days: r.AgeInDays}
+		}
+		lc.Rules = append(lc.Rules, rule)
+	}
+	return h.putConfig(ctx, "lifecycle", lc)
+}
+
+func (h *bucketHandle) putCORS(ctx context.Context, rules []backend.CORS) error {
+	if len(rules) == 0 {
+		return h.deleteConfig(ctx, "cors")
+	}
+	var cc corsConfig
+	for _, r := range rules {
+		cc.Rules = append(cc.Rules, corsRule{
+			AllowedOrigins: r.Origins,
+			AllowedMethods: r.Methods,
+			ExposeHeaders:  r.ResponseHeaders,
+			MaxAgeSeconds:  int64(r.MaxAge / time.Second),
+		})
+	}
+	return h.putConfig(ctx, "cors", cc)
+}
+
+// putConfig replaces the bucket subresource named by query with v
+func (h *bucketHandle) putConfig(ctx context.Context, query string, v interface{}) error {
+	req := request{method: "PUT", bucket: h.name, query: url.Values{query: {""}}}
+	if err := xmlBody(&req, v); err != nil {
+		return err
+	}
+	return translate(h.b.c.doXML(ctx, req, nil))
+}
+
+func (h *bucketHandle) deleteConfig(ctx context.Context, query string) error {
+	req := request{method: "DELETE", bucket: h.name, query: url.Values{query: {""}}}
+	return translate(h.b.c.doXML(ctx, req, nil))
+}
+
+// getConfig decodes the bucket subresource named by query into v
+// missing is the error code S3 returns when the subresource was never set,
+// which leaves v empty
+func (h *bucketHandle) getConfig(ctx context.Context, query, missing string, v interface{}) error {
+	err := h.b.c.doXML(ctx, request{method: "GET", bucket: h.name, query: url.Values{query: {""}}}, v)
+	if serr, ok := err.(*s3Error); ok && serr.Code == missing {
+		return nil
+	}
+	return translate(err)
+}
+
+// config reads the versioning, lifecycle and CORS settings into attrs
+func (h *bucketHandle) config(ctx context.Context, attrs *backend.BucketAttrs) error {
+	var v versioningConfig
+	if err := h.getConfig(ctx, "versioning", "", &v); err != nil {
+		return err
+	}
+	attrs.VersioningEnabled = v.Status == "Enabled"
+
+	var lc lifecycleConfig
+	if err := h.getConfig(ctx, "lifecycle", "NoSuchLifecycleConfiguration", &lc); err != nil {
+		return err
+	}
+	for _, r := range lc.Rules {
+		rule := backend.LifecycleRule{Prefix: r.Prefix}
+		switch {
+		case r.Expiration != nil:
+			rule.Action = backend.LifecycleDelete
+			rule.AgeInDays = r.Expiration.Days
+		case r.Transition != nil:
+			rule.Action = backend.LifecycleSetStorageClass
+			rule.StorageClass = r.Transition.StorageClass
+			rule.AgeInDays = r.Transition.Days
+		default:
+			continue
+		}
+		attrs.Lifecycle = append(attrs.Lifecycle, rule)
+	}
+
+	var cc corsConfig
+	if err := h.getConfig(ctx, "cors", "NoSuchCORSConfiguration", &cc); err != nil {
+		return err
+	}
+	for _, r := range cc.Rules {
+		attrs.CORS = append(attrs.CORS, backend.CORS{
+			Origins:         r.AllowedOrigins,
+			Methods:         r.AllowedMethods,
+			ResponseHeaders: r.ExposeHeaders,
+			MaxAge:          time.Duration(r.MaxAgeSeconds) * time.Second,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client issues signed path-style requests against an S3-compatible endpoint
+type client struct {
+	endpoint *url.URL
+	creds    credentials
+	http     *http.Client
+}
+
+// request describes a single S3 API call
+type request struct {
+	method string
+	bucket string
+	key    string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// s3Error is the XML error document returned by S3
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// do sends the request and returns the response for 2xx statuses
+// The caller must close the response body
+func (c *client) do(ctx context.Context, r request) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	if r.bucket != "" {
+		u.Path += r.bucket
+		if r.key != "" {
+			u.Path += "/" + r.key
+		}
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(r.query)
+
+	req, err := http.NewRequest(r.method, u.String(), bytes.NewReader(r.body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(r.body))
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+
+	payloadHash := emptyPayloadHash
+	if len(r.body) > 0 {
+		sum := sha256.Sum256(r.body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	c.creds.sign(req, payloadHash, time.Now())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	serr := &s3Error{StatusCode: res.StatusCode}
+	data, _ := ioutil.ReadAll(res.Body)
+	if len(data) == 0 || xml.Unmarshal(data, serr) != nil {
+		// HEAD responses carry no error document
+		serr.Code = http.StatusText(res.StatusCode)
+	}
+	return nil, serr
+}
+
+// doXML sends the request and decodes an XML response body into v
+func (c *client) doXML(ctx context.Context, r request, v interface{}) error {
+	res, err := c.do(ctx, r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if v == nil {
+		_, err = io.Copy(ioutil.Discard, res.Body)
+		return err
+	}
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+// xmlBody marshals v and sets the headers S3 requires for XML request bodies
+func xmlBody(r *request, v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	if r.header == nil {
+		r.header = http.Header{}
+	}
+	r.header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	r.header.Set("Content-Type", "application/xml")
+	r.body = data
+	return nil
+}
@@ -0,0 +1,866 @@
+// Package s3 implements the storage backend on S3-compatible object storage
+// such as AWS S3 or MinIO, using path-style requests signed with SigV4
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+const (
+	// MinPartSize is the smallest part S3 accepts in a multipart upload
+	MinPartSize = 5 << 20
+	// DefaultPartSize is used when Config.PartSize is not set
+	DefaultPartSize = 8 << 20
+	// DefaultRegion is used when Config.Region is not set
+	DefaultRegion = "us-east-1"
+
+	// tags used to persist attributes S3 buckets have no native field for
+	tagProject      = "eph-project"
+	tagStorageClass = "eph-storage-class"
+	// tagLabelPrefix namespaces bucket labels away from the tags above
+	tagLabelPrefix = "eph-label-"
+)
+
+// storageClasses maps GCS storage classes onto their closest S3 equivalent
+// that is readable straight away, as GCS classes all are; ARCHIVE has none,
+// S3 only offers classes that need a restore before a GET
+// Any other class is passed through to S3 unchanged
+var storageClasses = map[string]string{
+	"STANDARD":       "STANDARD",
+	"MULTI_REGIONAL": "STANDARD",
+	"REGIONAL":       "STANDARD",
+	"NEARLINE":       "STANDARD_IA",
+	"COLDLINE":       "GLACIER_IR",
+	"ARCHIVE":        "",
+}
+
+// s3Class returns the S3 storage class for class
+func s3Class(class string) (string, error) {
+	s3class, ok := storageClasses[class]
+	if !ok {
+		return class, nil
+	}
+	if s3class == "" {
+		return "", backend.ErrStorageClassNotSupported
+	}
+	return s3class, nil
+}
+
+// Config for connecting to an S3-compatible endpoint
+type Config struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PartSize  int
+}
+
+// Backend stores buckets in S3
+type Backend struct {
+	c        *client
+	partSize int
+}
+
+// New creates an S3 backend for the configured endpoint
+func New(cfg Config) (*Backend, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("endpoint must be specified")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("access key and secret key must be specified")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("endpoint must be an absolute URL")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	partSize := cfg.PartSize
+	switch {
+	case partSize == 0:
+		partSize = DefaultPartSize
+	case partSize < MinPartSize:
+		return nil, errors.New("part size must be at least 5MB")
+	}
+
+	return &Backend{
+		c: &client{
+			endpoint: u,
+			creds:    credentials{cfg.AccessKey, cfg.SecretKey, region},
+			http:     &http.Client{},
+		},
+		partSize: partSize,
+	}, nil
+}
+
+// Bucket returns a handle for the named bucket
+func (b *Backend) Bucket(name string) backend.BucketHandle {
+	return &bucketHandle{b, name}
+}
+
+// Buckets iterates over the buckets tagged with a project
+// Versioning, lifecycle and CORS settings are only returned by Attrs, which
+// costs three more requests per bucket
+func (b *Backend) Buckets(ctx context.Context, projectID string) backend.BucketIterator {
+	var list struct {
+		Buckets []struct {
+			Name         string    `xml:"Name"`
+			CreationDate time.Time `xml:"CreationDate"`
+		} `xml:"Buckets>Bucket"`
+	}
+	if err := b.c.doXML(ctx, request{method: "GET"}, &list); err != nil {
+		return backend.NewErrorBucketIterator(translate(err))
+	}
+
+	var res []*backend.BucketAttrs
+	for _, bkt := range list.Buckets {
+		tags, err := b.bucketTags(ctx, bkt.Name)
+		if err != nil {
+			return backend.NewErrorBucketIterator(translate(err))
+		}
+		if tags[tagProject] != projectID {
+			continue
+		}
+		res = append(res, &backend.BucketAttrs{
+			Name:         bkt.Name,
+			StorageClass: tags[tagStorageClass],
+			Labels:       tagLabels(tags),
+			Created:      bkt.CreationDate,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return backend.NewBucketIterator(res)
+}
+
+// Close releases idle connections
+func (b *Backend) Close() error {
+	if t, ok := b.c.http.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
+type tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []tag    `xml:"TagSet>Tag"`
+}
+
+type tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// tagLabels picks the bucket labels out of its tags
+func tagLabels(tags map[string]string) map[string]string {
+	var labels map[string]string
+	for k, v := range tags {
+		if !strings.HasPrefix(k, tagLabelPrefix) {
+			continue
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[strings.TrimPrefix(k, tagLabelPrefix)] = v
+	}
+	return labels
+}
+
+func (b *Backend) bucketTags(ctx context.Context, name string) (map[string]string, error) {
+	var t tagging
+	err := b.c.doXML(ctx, request{method: "GET", bucket: name, query: url.Values{"tagging": {""}}}, &t)
+	if serr, ok := err.(*s3Error); ok && serr.Code == "NoSuchTagSet" {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, t := range t.Tags {
+		tags[t.Key] = t.Value
+	}
+	return tags, nil
+}
+
+type bucketHandle struct {
+	b    *Backend
+	name string
+}
+
+func (h *bucketHandle) Create(ctx context.Context, projectID string, attrs *backend.BucketAttrs) error {
+	if err := backend.ValidateBucketName(h.name); err != nil {
+		return err
+	}
+	if attrs == nil {
+		attrs = &backend.BucketAttrs{}
+	}
+	if _, err := s3Class(attrs.StorageClass); err != nil {
+		return err
+	}
+
+	req := request{method: "PUT", bucket: h.name}
+	if attrs.Location != "" && attrs.Location != DefaultRegion {
+		err := xmlBody(&req, struct {
+			XMLName            xml.Name `xml:"CreateBucketConfiguration"`
+			LocationConstraint string   `xml:"LocationConstraint"`
+		}{LocationConstraint: attrs.Location})
+		if err != nil {
+			return err
+		}
+	}
+	err := h.b.c.doXML(ctx, req, nil)
+	if serr, ok := err.(*s3Error); ok {
+		switch serr.Code {
+		case "BucketAlreadyOwnedByYou":
+			return h.owned(ctx, projectID)
+		case "BucketAlreadyExists":
+			return backend.ErrBucketExist
+		}
+	}
+	if err != nil {
+		return translate(err)
+	}
+
+	t := tagging{Tags: []tag{{tagProject, projectID}}}
+	if attrs.StorageClass != "" {
+		t.Tags = append(t.Tags, tag{tagStorageClass, attrs.StorageClass})
+	}
+	for k, v := range attrs.Labels {
+		t.Tags = append(t.Tags, tag{tagLabelPrefix + k, v})
+	}
+	req = request{method: "PUT", bucket: h.name, query: url.Values{"tagging": {""}}}
+	err = xmlBody(&req, t)
+	if err == nil {
+		err = translate(h.b.c.doXML(ctx, req, nil))
+	}
+	if err != nil {
+		// an untagged bucket belongs to no project and would make retries
+		// fail with ErrBucketExist, so it is removed again
+		if derr := h.Delete(ctx); derr != nil {
+			return fmt.Errorf("Failed to tag bucket %s: %v, and to remove it again: %v", h.name, err, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// owned resolves a bucket the credentials already own to ErrBucketOwned
+// when it belongs to the project, and ErrBucketExist otherwise
+func (h *bucketHandle) owned(ctx context.Context, projectID string) error {
+	tags, err := h.b.bucketTags(ctx, h.name)
+	if err != nil {
+		return translate(err)
+	}
+	if tags[tagProject] == projectID {
+		return backend.ErrBucketOwned
+	}
+	return backend.ErrBucketExist
+}
+
+// InProject compares the project tag set when the bucket was created
+func (h *bucketHandle) InProject(ctx context.Context, projectID string) (bool, error) {
+	tags, err := h.b.bucketTags(ctx, h.name)
+	if err != nil {
+		return false, translate(err)
+	}
+	return tags[tagProject] == projectID, nil
+}
+
+func (h *bucketHandle) Delete(ctx context.Context) error {
+	return translate(h.b.c.doXML(ctx, request{method: "DELETE", bucket: h.name}, nil))
+}
+
+func (h *bucketHandle) Attrs(ctx context.Context) (*backend.BucketAttrs, error) {
+	var loc struct {
+		Location string `xml:",chardata"`
+	}
+	err := h.b.c.doXML(ctx, request{method: "GET", bucket: h.name, query: url.Values{"location": {""}}}, &loc)
+	if err != nil {
+		return nil, translate(err)
+	}
+	tags, err := h.b.bucketTags(ctx, h.name)
+	if err != nil {
+		return nil, translate(err)
+	}
+	if loc.Location == "" {
+		loc.Location = DefaultRegion
+	}
+	attrs := &backend.BucketAttrs{
+		Name:         h.name,
+		StorageClass: tags[tagStorageClass],
+		Location:     loc.Location,
+		Labels:       tagLabels(tags),
+	}
+	if err := h.config(ctx, attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func (h *bucketHandle) Object(name string) backend.ObjectHandle {
+	return &objectHandle{bkt: h, name: name}
+}
+
+// SignedURL returns a presigned path-style URL
+func (h *bucketHandle) SignedURL(name string, opts backend.SignedURLOptions) (string, error) {
+	u := *h.b.c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + h.name + "/" + name
+	header := http.Header{}
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	now := time.Now()
+	return h.b.c.creds.presign(opts.Method, &u, header, now, opts.Expires.Sub(now))
+}
+
+func (h *bucketHandle) Objects(ctx context.Context, q *backend.Query) backend.ObjectIterator {
+	if q == nil {
+		q = &backend.Query{}
+	}
+	if q.Versions {
+		return backend.NewErrorObjectIterator(backend.ErrNotSupported)
+	}
+	return &objectIterator{ctx: ctx, bkt: h, query: *q}
+}
+
+// objectIterator pages through ListObjectsV2 results on demand
+type objectIterator struct {
+	ctx   context.Context
+	bkt   *bucketHandle
+	query backend.Query
+	token string
+	page  []*backend.ObjectAttrs
+	last  bool
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (i *objectIterator) Next() (*backend.ObjectAttrs, error) {
+	for len(i.page) == 0 {
+		if i.last {
+			return nil, backend.Done
+		}
+		if err := i.fetch(); err != nil {
+			i.last = true
+			return nil, err
+		}
+	}
+	a := i.page[0]
+	i.page = i.page[1:]
+	return a, nil
+}
+
+func (i *objectIterator) fetch() error {
+	q := url.Values{"list-type": {"2"}}
+	if i.query.Prefix != "" {
+		q.Set("prefix", i.query.Prefix)
+	}
+	if i.query.Delimiter != "" {
+		q.Set("delimiter", i.query.Delimiter)
+	}
+	if i.token != "" {
+		q.Set("continuation-token", i.token)
+	}
+	if i.query.StartAfter != "" {
+		q.Set("start-after", i.query.StartAfter)
+	}
+
+	var res listResult
+	if err := i.bkt.b.c.doXML(i.ctx, request{method: "GET", bucket: i.bkt.name, query: q}, &res); err != nil {
+		return translate(err)
+	}
+	for _, c := range res.Contents {
+		i.page = append(i.page, &backend.ObjectAttrs{
+			Bucket:      i.bkt.name,
+			Name:        c.Key,
+			ContentType: mime.TypeByExtension(path.Ext(c.Key)),
+			Size:        c.Size,
+			Created:     c.LastModified,
+			Updated:     c.LastModified,
+			MD5:         etagMD5(c.ETag),
+		})
+	}
+	for _, p := range res.CommonPrefixes {
+		// keys after start-after can still roll up into a prefix at or before it
+		if p.Prefix > i.query.StartAfter {
+			i.page = append(i.page, &backend.ObjectAttrs{Bucket: i.bkt.name, Prefix: p.Prefix})
+		}
+	}
+	sort.Slice(i.page, func(a, b int) bool { return backend.SortKey(i.page[a]) < backend.SortKey(i.page[b]) })
+
+	i.token = res.NextContinuationToken
+	i.last = !res.IsTruncated || i.token == ""
+	return nil
+}
+
+// objectHandle has no generations, S3 versions are identified by opaque
+// version ids, so handles for a generation or with conditions return
+// backend.ErrNotSupported
+type objectHandle struct {
+	bkt   *bucketHandle
+	name  string
+	gen   int64
+	conds backend.Conditions
+}
+
+func (o *objectHandle) Generation(gen int64) backend.ObjectHandle {
+	c := *o
+	c.gen = gen
+	return &c
+}
+
+func (o *objectHandle) If(conds backend.Conditions) backend.ObjectHandle {
+	c := *o
+	c.conds = conds
+	return &c
+}
+
+func (o *objectHandle) supported() error {
+	if o.gen != 0 || o.conds != (backend.Conditions{}) {
+		return backend.ErrNotSupported
+	}
+	return nil
+}
+
+func (o *objectHandle) request(method string) request {
+	return request{method: method, bucket: o.bkt.name, key: o.name}
+}
+
+func (o *objectHandle) Attrs(ctx context.Context) (*backend.ObjectAttrs, error) {
+	if err := o.supported(); err != nil {
+		return nil, err
+	}
+	if err := backend.ValidateObjectName(o.name); err != nil {
+		return nil, err
+	}
+	res, err := o.bkt.b.c.do(ctx, o.request("HEAD"))
+	if err != nil {
+		return nil, o.translate(ctx, err)
+	}
+	res.Body.Close()
+
+	updated, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	size, _ := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	// S3 only sends the storage class when it is not STANDARD
+	class := res.Header.Get("X-Amz-Storage-Class")
+	if class == "" {
+		class = "STANDARD"
+	}
+	return &backend.ObjectAttrs{
+		Bucket:             o.bkt.name,
+		Name:               o.name,
+		ContentType:        res.Header.Get("Content-Type"),
+		CacheControl:       res.Header.Get("Cache-Control"),
+		ContentDisposition: res.Header.Get("Content-Disposition"),
+		Metadata:           userMetadata(res.Header),
+		StorageClass:       class,
+		Size:               size,
+		Created:            updated,
+		Updated:            updated,
+		MD5:                etagMD5(res.Header.Get("ETag")),
+	}, nil
+}
+
+// metaPrefix marks user metadata headers, S3 stores their keys in lower case
+const metaPrefix = "X-Amz-Meta-"
+
+func userMetadata(h http.Header) map[string]string {
+	var m map[string]string
+	for k := range h {
+		if !strings.HasPrefix(k, metaPrefix) {
+			continue
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[strings.ToLower(k[len(metaPrefix):])] = h.Get(k)
+	}
+	return m
+}
+
+// etagMD5 decodes the ETag of a single part upload, which is the content MD5
+// Multipart ETags are not a digest of the content and are ignored
+func etagMD5(etag string) []byte {
+	sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(sum) != md5.Size {
+		return nil
+	}
+	return sum
+}
+
+func (o *objectHandle) NewReader(ctx context.Context) (io.ReadCloser, error) {
+	return o.NewRangeReader(ctx, 0, -1)
+}
+
+func (o *objectHandle) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if err := o.supported(); err != nil {
+		return nil, err
+	}
+	if err := backend.ValidateObjectName(o.name); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, backend.ErrInvalidRange
+	}
+	req := o.request("GET")
+	switch {
+	case length == 0:
+		// S3 has no empty range, check the offset against the object instead
+		attrs, err := o.Attrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := backend.ValidateRange(offset, attrs.Size); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	case length > 0:
+		req.header = http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)}}
+	case offset > 0:
+		req.header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	res, err := o.bkt.b.c.do(ctx, req)
+	if err != nil {
+		return nil, translate(err)
+	}
+	return res.Body, nil
+}
+
+func (o *objectHandle) NewWriter(ctx context.Context, attrs *backend.ObjectAttrs) io.WriteCloser {
+	w := &writer{ctx: ctx, obj: o, err: o.supported()}
+	if attrs != nil {
+		w.attrs = *attrs
+	}
+	return w
+}
+
+// maxCopySize is the largest object S3 copies in a single request
+const maxCopySize = 5 << 30
+
+// CopyTo copies server side, replacing the metadata with the source's so
+// the destination bucket's storage class applies and copies onto the same
+// key are allowed
+func (o *objectHandle) CopyTo(ctx context.Context, dsth backend.ObjectHandle) (*backend.ObjectAttrs, error) {
+	dst := dsth.(*objectHandle)
+	if err := dst.supported(); err != nil {
+		return nil, err
+	}
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if attrs.Size > maxCopySize {
+		return backend.CopyObject(ctx, o, dst)
+	}
+
+	w := &writer{ctx: ctx, obj: dst, attrs: *attrs}
+	h, err := w.headers()
+	if err != nil {
+		return nil, err
+	}
+	h.Set("X-Amz-Copy-Source", escapePath("/"+o.bkt.name+"/"+o.name))
+	h.Set("X-Amz-Metadata-Directive", "REPLACE")
+	req := dst.request("PUT")
+	req.header = h
+	// like multipart completion, a failed copy may be reported in a 200 body
+	var res struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := o.bkt.b.c.doXML(ctx, req, &res); err != nil {
+		return nil, translate(err)
+	}
+	if res.XMLName.Local == "Error" {
+		res.StatusCode = http.StatusOK
+		return nil, &res.s3Error
+	}
+	return dst.Attrs(ctx)
+}
+
+// Delete checks the object exists first since S3 deletes are idempotent
+func (o *objectHandle) Delete(ctx context.Context) error {
+	if _, err := o.Attrs(ctx); err != nil {
+		return err
+	}
+	return translate(o.bkt.b.c.doXML(ctx, o.request("DELETE"), nil))
+}
+
+// translate a HEAD 404, which has no error code, into a missing bucket or object
+func (o *objectHandle) translate(ctx context.Context, err error) error {
+	serr, ok := err.(*s3Error)
+	if !ok || serr.StatusCode != http.StatusNotFound {
+		return translate(err)
+	}
+	if _, err := o.bkt.Attrs(ctx); err == backend.ErrBucketNotExist {
+		return err
+	}
+	return backend.ErrObjectNotExist
+}
+
+// writer sends small objects with a single PUT and switches to a multipart
+// upload once more than one part of data has been written
+type writer struct {
+	ctx      context.Context
+	obj      *objectHandle
+	attrs    backend.ObjectAttrs
+	buf      bytes.Buffer
+	uploadID string
+	parts    []completedPart
+	class    string
+	err      error
+	done     bool
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write on closed writer")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		w.abort()
+		return 0, err
+	}
+	n, _ := w.buf.Write(p)
+	for w.buf.Len() >= w.obj.bkt.b.partSize {
+		if err := w.flushPart(w.buf.Next(w.obj.bkt.b.partSize)); err != nil {
+			w.abort()
+			w.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *writer) Close() error {
+	if w.done {
+		return w.err
+	}
+	if w.err != nil {
+		w.done = true
+		return w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		w.abort()
+		return err
+	}
+	w.done = true
+
+	if w.uploadID == "" {
+		w.err = w.put()
+		return w.err
+	}
+	if w.buf.Len() > 0 {
+		if err := w.flushPart(w.buf.Bytes()); err != nil {
+			w.abort()
+			w.err = err
+			return err
+		}
+	}
+	if w.err = w.complete(); w.err != nil {
+		w.abort()
+	}
+	return w.err
+}
+
+// headers for a new object, applying its metadata and the bucket's storage class
+func (w *writer) headers() (http.Header, error) {
+	if err := backend.ValidateObjectName(w.obj.name); err != nil {
+		return nil, err
+	}
+	if w.class == "" {
+		tags, err := w.obj.bkt.b.bucketTags(w.ctx, w.obj.bkt.name)
+		if err != nil {
+			return nil, translate(err)
+		}
+		w.class = tags[tagStorageClass]
+	}
+	h := http.Header{}
+	ct := w.attrs.ContentType
+	if ct == "" {
+		ct = mime.TypeByExtension(path.Ext(w.obj.name))
+	}
+	if ct != "" {
+		h.Set("Content-Type", ct)
+	}
+	if w.attrs.CacheControl != "" {
+		h.Set("Cache-Control", w.attrs.CacheControl)
+	}
+	if w.attrs.ContentDisposition != "" {
+		h.Set("Content-Disposition", w.attrs.ContentDisposition)
+	}
+	for k, v := range w.attrs.Metadata {
+		h.Set(metaPrefix+k, v)
+	}
+	if w.class != "" {
+		class, err := s3Class(w.class)
+		if err != nil {
+			return nil, err
+		}
+		h.Set("X-Amz-Storage-Class", class)
+	}
+	return h, nil
+}
+
+func (w *writer) put() error {
+	h, err := w.headers()
+	if err != nil {
+		return err
+	}
+	req := w.obj.request("PUT")
+	req.header = h
+	req.body = w.buf.Bytes()
+	return translate(w.obj.bkt.b.c.doXML(w.ctx, req, nil))
+}
+
+func (w *writer) flushPart(data []byte) error {
+	if w.uploadID == "" {
+		if err := w.initiate(); err != nil {
+			return err
+		}
+	}
+	num := len(w.parts) + 1
+	req := w.obj.request("PUT")
+	req.query = url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {w.uploadID}}
+	req.body = data
+	res, err := w.obj.bkt.b.c.do(w.ctx, req)
+	if err != nil {
+		return translate(err)
+	}
+	res.Body.Close()
+	w.parts = append(w.parts, completedPart{num, res.Header.Get("ETag")})
+	return nil
+}
+
+func (w *writer) initiate() error {
+	h, err := w.headers()
+	if err != nil {
+		return err
+	}
+	req := w.obj.request("POST")
+	req.query = url.Values{"uploads": {""}}
+	req.header = h
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := w.obj.bkt.b.c.doXML(w.ctx, req, &res); err != nil {
+		return translate(err)
+	}
+	w.uploadID = res.UploadID
+	return nil
+}
+
+func (w *writer) complete() error {
+	req := w.obj.request("POST")
+	req.query = url.Values{"uploadId": {w.uploadID}}
+	err := xmlBody(&req, struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	// S3 may report a failed completion in a 200 response body
+	var res struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := w.obj.bkt.b.c.doXML(w.ctx, req, &res); err != nil {
+		return translate(err)
+	}
+	if res.XMLName.Local == "Error" {
+		res.StatusCode = http.StatusOK
+		return &res.s3Error
+	}
+	return nil
+}
+
+// abort discards any parts already uploaded so nothing is committed
+func (w *writer) abort() {
+	w.done = true
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	if w.uploadID == "" {
+		return
+	}
+	req := w.obj.request("DELETE")
+	req.query = url.Values{"uploadId": {w.uploadID}}
+	// the writer's context may already be cancelled
+	w.obj.bkt.b.c.doXML(context.Background(), req, nil)
+	w.uploadID = ""
+}
+
+// translate maps S3 error codes onto the backend sentinel errors
+func translate(err error) error {
+	serr, ok := err.(*s3Error)
+	if !ok {
+		return err
+	}
+	switch serr.Code {
+	case "NoSuchBucket":
+		return backend.ErrBucketNotExist
+	case "NoSuchKey":
+		return backend.ErrObjectNotExist
+	case "BucketNotEmpty":
+		return backend.ErrBucketNotEmpty
+	case "BucketAlreadyExists":
+		return backend.ErrBucketExist
+	case "InvalidRange":
+		return backend.ErrInvalidRange
+	case "TooManyBuckets":
+		return backend.ErrQuotaExceeded
+	}
+	// HEAD responses only have their status to go on
+	switch serr.StatusCode {
+	case http.StatusPreconditionFailed:
+		return backend.ErrPreconditionFailed
+	case http.StatusForbidden:
+		return backend.ErrPermissionDenied
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// S3 asks clients to slow down with a 503
+		return backend.ErrQuotaExceeded
+	}
+	return err
+}
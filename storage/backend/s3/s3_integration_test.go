@@ -0,0 +1,97 @@
+// +build integration
+
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	helper "github.com/evanharmon/eph-music-micro/helper"
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/backendtest"
+	"github.com/evanharmon/eph-music-micro/storage/backend/s3"
+)
+
+// testConfig reads the endpoint of a local MinIO process, e.g.
+// minio server /tmp/minio with S3_ENDPOINT=http://localhost:9000
+func testConfig(t *testing.T) s3.Config {
+	t.Helper()
+	cfg := s3.Config{PartSize: s3.MinPartSize}
+	for env, val := range map[string]*string{
+		"S3_ENDPOINT":           &cfg.Endpoint,
+		"AWS_ACCESS_KEY_ID":     &cfg.AccessKey,
+		"AWS_SECRET_ACCESS_KEY": &cfg.SecretKey,
+	} {
+		v, err := helper.GetEnv(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*val = v
+	}
+	return cfg
+}
+
+// newBackend returns a backend with the buckets the suite uses removed
+func newBackend(t *testing.T) backend.Backend {
+	t.Helper()
+	b, err := s3.New(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"songs", "a-songs", "b-songs", "theirs", "archive"} {
+		bkt := b.Bucket(name)
+		it := bkt.Objects(ctx, nil)
+		for {
+			attrs, err := it.Next()
+			if err != nil {
+				break
+			}
+			bkt.Object(attrs.Name).Delete(ctx)
+		}
+		bkt.Delete(ctx)
+	}
+	return b
+}
+
+func TestBackend(t *testing.T) {
+	backendtest.Run(t, newBackend)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	b := newBackend(t)
+	bkt := backendtest.CreateBucket(t, b, "songs")
+	content := bytes.Repeat([]byte("multitrack"), (2*s3.MinPartSize)/10+123)
+
+	w := bkt.Object("session.wav").NewWriter(context.Background(), nil)
+	for r := bytes.NewReader(content); r.Len() > 0; {
+		chunk := make([]byte, 1<<12)
+		n, _ := r.Read(chunk)
+		if _, err := w.Write(chunk[:n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := backendtest.ReadObject(t, bkt, "session.wav"); !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	b := newBackend(t)
+	bkt := b.Bucket("songs")
+	err := bkt.Create(context.Background(), "test-project", &backend.BucketAttrs{StorageClass: "COLDLINE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bkt.Attrs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.StorageClass != "COLDLINE" {
+		t.Errorf("StorageClass = %q, want COLDLINE", attrs.StorageClass)
+	}
+}
@@ -0,0 +1,149 @@
+package s3_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/s3"
+)
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		cfg s3.Config
+		msg string
+	}{
+		"empty endpoint":      {s3.Config{AccessKey: "a", SecretKey: "b"}, "Empty endpoint should throw error"},
+		"relative endpoint":   {s3.Config{Endpoint: "localhost:9000", AccessKey: "a", SecretKey: "b"}, "Relative endpoint should throw error"},
+		"missing credentials": {s3.Config{Endpoint: "http://localhost:9000"}, "Missing credentials should throw error"},
+		"small part size":     {s3.Config{Endpoint: "http://localhost:9000", AccessKey: "a", SecretKey: "b", PartSize: 1024}, "Part size under 5MB should throw error"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s3.New(test.cfg); err == nil {
+				t.Error(test.msg)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		body   string
+		want   error
+	}{
+		"Missing key should be ErrObjectNotExist": {
+			http.StatusNotFound, "<Error><Code>NoSuchKey</Code></Error>", backend.ErrObjectNotExist,
+		},
+		"Access denied should be ErrPermissionDenied": {
+			http.StatusForbidden, "<Error><Code>AccessDenied</Code></Error>", backend.ErrPermissionDenied,
+		},
+		"Bare 403 should be ErrPermissionDenied": {
+			http.StatusForbidden, "", backend.ErrPermissionDenied,
+		},
+		"Slow down should be ErrQuotaExceeded": {
+			http.StatusServiceUnavailable, "<Error><Code>SlowDown</Code></Error>", backend.ErrQuotaExceeded,
+		},
+		"Failed precondition should be ErrPreconditionFailed": {
+			http.StatusPreconditionFailed, "<Error><Code>PreconditionFailed</Code></Error>", backend.ErrPreconditionFailed,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				io.WriteString(w, tc.body)
+			}))
+			defer ts.Close()
+			b, err := s3.New(s3.Config{Endpoint: ts.URL, AccessKey: "a", SecretKey: "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.Bucket("bucket").Object("file").NewRangeReader(context.Background(), 0, -1)
+			if err != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestCreateRemovesUntaggedBucket(t *testing.T) {
+	var deleted bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && !r.URL.Query().Has("tagging"):
+			w.WriteHeader(http.StatusOK)
+		case r.Method == "PUT":
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "<Error><Code>AccessDenied</Code></Error>")
+		case r.Method == "DELETE":
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer ts.Close()
+	b, err := s3.New(s3.Config{Endpoint: ts.URL, AccessKey: "a", SecretKey: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Bucket("bucket").Create(context.Background(), "project", nil)
+	if err != backend.ErrPermissionDenied {
+		t.Errorf("Expected %v, got %v", backend.ErrPermissionDenied, err)
+	}
+	if !deleted {
+		t.Errorf("Bucket should be removed when tagging fails")
+	}
+}
+
+func TestStorageClasses(t *testing.T) {
+	tests := map[string]struct {
+		class string
+		err   error
+	}{
+		"NEARLINE":    {"STANDARD_IA", nil},
+		"COLDLINE":    {"GLACIER_IR", nil},
+		"ARCHIVE":     {"", backend.ErrStorageClassNotSupported},
+		"INTELLIGENT": {"INTELLIGENT", nil},
+	}
+	for gcsClass, tc := range tests {
+		t.Run(gcsClass, func(t *testing.T) {
+			var sent string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == "GET" && r.URL.Query().Has("tagging"):
+					io.WriteString(w, "<Tagging><TagSet><Tag><Key>eph-storage-class</Key><Value>"+gcsClass+"</Value></Tag></TagSet></Tagging>")
+				case r.Method == "PUT":
+					sent = r.Header.Get("X-Amz-Storage-Class")
+					w.WriteHeader(http.StatusOK)
+				default:
+					w.WriteHeader(http.StatusNotImplemented)
+				}
+			}))
+			defer ts.Close()
+			b, err := s3.New(s3.Config{Endpoint: ts.URL, AccessKey: "a", SecretKey: "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := b.Bucket("bucket").Object("file").NewWriter(context.Background(), nil)
+			w.Write([]byte("data"))
+			if err := w.Close(); err != tc.err {
+				t.Fatalf("Expected %v, got %v", tc.err, err)
+			}
+			if sent != tc.class {
+				t.Errorf("Expected storage class %q, got %q", tc.class, sent)
+			}
+			if tc.err != nil {
+				err := b.Bucket("other").Create(context.Background(), "project", &backend.BucketAttrs{StorageClass: gcsClass})
+				if err != tc.err {
+					t.Errorf("Create should fail with %v, got %v", tc.err, err)
+				}
+			}
+		})
+	}
+}
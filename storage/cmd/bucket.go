@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/jsonpb"
+	"google.golang.org/genproto/protobuf/field_mask"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var CreateBucket = cli.Command{
+	Name:   "createbucket",
+	Usage:  "create a storage bucket",
+	Action: createBucketAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "class",
+			Usage: "storage class, e.g. STANDARD or COLDLINE, defaults to the backend's",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "location",
+			Usage: "bucket location, e.g. US-EAST1, defaults to the backend's",
+			Value: "",
+		},
+		&cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "label as key=value, may be repeated",
+		},
+	}, clientFlags...),
+}
+
+func createBucketAction(c *cli.Context) error {
+	var (
+		err error
+
+		address = c.String("address")
+		client  = core.ClientGRPC{}
+		bucket  = c.String("bucket")
+	)
+
+	if address == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if bucket == "" {
+		err = errors.New("bucket must be set")
+		return cli.Exit(err, 1)
+	}
+	labels, err := parseKeyValues(c.StringSlice("label"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: address,
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	_, err = client.Create(context.Background(), &pb.CreateRequest{
+		Project: &pb.Project{Id: c.String("project")},
+		Bucket: &pb.Bucket{
+			Name:     bucket,
+			Class:    c.String("class"),
+			Location: c.String("location"),
+			Labels:   labels,
+		},
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
+
+var GetBucket = cli.Command{
+	Name:   "getbucket",
+	Usage:  "show the attributes of a storage bucket",
+	Action: getBucketAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+	}, clientFlags...),
+}
+
+func getBucketAction(c *cli.Context) error {
+	var (
+		err error
+
+		address = c.String("address")
+		client  = core.ClientGRPC{}
+	)
+
+	if address == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: address,
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.GetBucket(context.Background(), &pb.GetBucketRequest{
+		Project: &pb.Project{Id: c.String("project")},
+		Bucket:  &pb.Bucket{Name: c.String("bucket")},
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	b := res.Bucket
+	fmt.Printf("Name:                        %s\n", b.Name)
+	fmt.Printf("Storage class:               %s\n", b.Class)
+	fmt.Printf("Location:                    %s\n", b.Location)
+	fmt.Printf("Created:                     %s\n", formatTimestamp(b.Created))
+	fmt.Printf("Versioning:                  %t\n", b.Versioning)
+	for _, k := range sortedKeys(b.Labels) {
+		fmt.Printf("Label:                       %s=%s\n", k, b.Labels[k])
+	}
+	for _, r := range b.Lifecycle {
+		fmt.Printf("Lifecycle:                   %s %s after %d days, prefix %q\n", r.Action, r.StorageClass, r.AgeDays, r.Prefix)
+	}
+	for _, r := range b.Cors {
+		fmt.Printf("CORS:                        origins %v, methods %v, headers %v, max age %ds\n", r.Origins, r.Methods, r.ResponseHeaders, r.MaxAgeSeconds)
+	}
+	if d := b.DefaultObjectMetadata; d != nil {
+		fmt.Printf("Default Cache-Control:       %s\n", d.CacheControl)
+		fmt.Printf("Default Content-Disposition: %s\n", d.ContentDisposition)
+		for _, k := range sortedKeys(d.Metadata) {
+			fmt.Printf("Default metadata:            %s=%s\n", k, d.Metadata[k])
+		}
+	}
+
+	return nil
+}
+
+var UpdateBucket = cli.Command{
+	Name:   "updatebucket",
+	Usage:  "apply versioning, lifecycle, cors and default object metadata from a JSON file",
+	Action: updateBucketAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "JSON bucket settings, only the settings present are changed",
+			Value: "",
+		},
+	}, clientFlags...),
+}
+
+// updateFields maps the JSON names of the updatable bucket fields onto
+// their update mask paths
+var updateFields = map[string]string{
+	"versioning":              "versioning",
+	"lifecycle":               "lifecycle",
+	"cors":                    "cors",
+	"default_object_metadata": "default_object_metadata",
+	"defaultObjectMetadata":   "default_object_metadata",
+}
+
+func updateBucketAction(c *cli.Context) error {
+	var (
+		err error
+
+		address = c.String("address")
+		client  = core.ClientGRPC{}
+		config  = c.String("config")
+	)
+
+	if address == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if config == "" {
+		err = errors.New("config must be set")
+		return cli.Exit(err, 1)
+	}
+	bucket, mask, err := readBucketConfig(config)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	bucket.Name = c.String("bucket")
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: address,
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	_, err = client.UpdateBucket(context.Background(), &pb.UpdateBucketRequest{
+		Project:    &pb.Project{Id: c.String("project")},
+		Bucket:     bucket,
+		UpdateMask: mask,
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
+
+// readBucketConfig parses a JSON bucket and masks the fields it sets, so
+// an empty list in the file clears those rules
+func readBucketConfig(path string) (*pb.Bucket, *field_mask.FieldMask, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, err
+	}
+	mask := &field_mask.FieldMask{}
+	for name := range fields {
+		path, ok := updateFields[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("Bucket field %s cannot be updated", name)
+		}
+		mask.Paths = append(mask.Paths, path)
+	}
+	sort.Strings(mask.Paths)
+
+	bucket := &pb.Bucket{}
+	if err := jsonpb.Unmarshal(bytes.NewReader(data), bucket); err != nil {
+		return nil, nil, err
+	}
+	return bucket, mask, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// clientFlags are shared by every command that connects to the server
+var clientFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "token",
+		Usage: "API key or JWT to authenticate with (defaults to $" + core.TokenEnv + ")",
+		Value: "",
+	},
+	&cli.BoolFlag{
+		Name:  "tls",
+		Usage: "connect over TLS, verifying the server against the system roots",
+	},
+	&cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "CA bundle to verify the server certificate with (implies --tls)",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "client certificate for servers that verify clients (implies --tls)",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "key of the client certificate",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "tls-server-name",
+		Usage: "name expected in the server certificate, if not the host of --address",
+		Value: "",
+	},
+}
+
+// clientTLS returns the TLS config set by clientFlags, nil for plaintext
+func clientTLS(c *cli.Context) *core.TLSConfig {
+	cfg := &core.TLSConfig{
+		CertFile:   c.String("tls-cert"),
+		KeyFile:    c.String("tls-key"),
+		CAFile:     c.String("tls-ca"),
+		ServerName: c.String("tls-server-name"),
+	}
+	if !c.Bool("tls") && cfg.CertFile == "" && cfg.CAFile == "" {
+		return nil
+	}
+	return cfg
+}
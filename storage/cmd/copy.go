@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+// copyFlags are shared by the copy and move commands
+var copyFlags = append([]cli.Flag{
+	&cli.StringFlag{
+		Name:  "source",
+		Usage: "file name to copy from",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "destination",
+		Usage: "file name to copy to",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "source-bucket",
+		Usage: "bucket to copy from",
+		Value: "test-eph-music",
+	},
+	&cli.StringFlag{
+		Name:  "destination-bucket",
+		Usage: "bucket to copy to (defaults to the source bucket)",
+		Value: "",
+	},
+	&cli.StringFlag{
+		Name:  "address",
+		Usage: "address of the server to connect to",
+		Value: "localhost:10013",
+	},
+	&cli.StringFlag{
+		Name:  "project",
+		Usage: "project id",
+		Value: "eph-music",
+	},
+}, clientFlags...)
+
+var Copy = cli.Command{
+	Name:   "copy",
+	Usage:  "copy a file server side, within or across buckets",
+	Action: copyAction,
+	Flags:  copyFlags,
+}
+
+var Move = cli.Command{
+	Name:   "move",
+	Usage:  "move a file server side, within or across buckets",
+	Action: moveAction,
+	Flags:  copyFlags,
+}
+
+func copyAction(c *cli.Context) error {
+	client, err := newCopyClient(c)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.CopyFile(context.Background(), &pb.CopyFileRequest{
+		Project:           &pb.Project{Id: c.String("project")},
+		SourceBucket:      &pb.Bucket{Name: c.String("source-bucket")},
+		SourceFile:        &pb.File{Name: c.String("source")},
+		DestinationBucket: &pb.Bucket{Name: c.String("destination-bucket")},
+		DestinationFile:   &pb.File{Name: c.String("destination")},
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Printf("Copied to %s (%d bytes)\n", res.File.Name, res.File.Size)
+
+	return nil
+}
+
+func moveAction(c *cli.Context) error {
+	client, err := newCopyClient(c)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.MoveFile(context.Background(), &pb.MoveFileRequest{
+		Project:           &pb.Project{Id: c.String("project")},
+		SourceBucket:      &pb.Bucket{Name: c.String("source-bucket")},
+		SourceFile:        &pb.File{Name: c.String("source")},
+		DestinationBucket: &pb.Bucket{Name: c.String("destination-bucket")},
+		DestinationFile:   &pb.File{Name: c.String("destination")},
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Printf("Moved to %s (%d bytes)\n", res.File.Name, res.File.Size)
+
+	return nil
+}
+
+// newCopyClient checks the flags shared by copy and move and connects
+func newCopyClient(c *cli.Context) (core.ClientGRPC, error) {
+	if c.String("address") == "" {
+		return core.ClientGRPC{}, errors.New("Address is required")
+	}
+	if c.String("source") == "" || c.String("destination") == "" {
+		return core.ClientGRPC{}, errors.New("source and destination must be set")
+	}
+	return core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: c.String("address"),
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var DeleteFiles = cli.Command{
+	Name:   "deletefiles",
+	Usage:  "delete files from a bucket by name or prefix",
+	Action: deleteFilesAction,
+	Flags: append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "file",
+			Usage: "file name to delete, may be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "prefix",
+			Usage: "delete every file starting with prefix, e.g. releases/test/",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+	}, clientFlags...),
+}
+
+func deleteFilesAction(c *cli.Context) error {
+	var (
+		err    error
+		client = core.ClientGRPC{}
+	)
+
+	if c.String("address") == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: c.String("address"),
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.DeleteFiles(context.Background(), &pb.DeleteFilesRequest{
+		Project: &pb.Project{Id: c.String("project")},
+		Bucket:  &pb.Bucket{Name: c.String("bucket")},
+		Names:   c.StringSlice("file"),
+		Prefix:  c.String("prefix"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	for _, r := range res.Results {
+		if !r.Deleted {
+			fmt.Printf("Failed to delete %s: %s\n", r.Name, r.Error)
+		}
+	}
+	fmt.Printf("Deleted %d files, %d failed\n", res.Deleted, res.Failed)
+	if res.Failed > 0 {
+		return cli.Exit("", 1)
+	}
+
+	return nil
+}
+
+var DeleteBucket = cli.Command{
+	Name:   "deletebucket",
+	Usage:  "delete a bucket",
+	Action: deleteBucketAction,
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "delete every file in the bucket first",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+	}, clientFlags...),
+}
+
+func deleteBucketAction(c *cli.Context) error {
+	var (
+		err    error
+		client = core.ClientGRPC{}
+	)
+
+	if c.String("address") == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if c.String("bucket") == "" {
+		err = errors.New("bucket must be set")
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: c.String("address"),
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	_, err = client.Delete(context.Background(), &pb.DeleteRequest{
+		Project: &pb.Project{Id: c.String("project")},
+		Bucket:  &pb.Bucket{Name: c.String("bucket")},
+		Force:   c.Bool("force"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var Download = cli.Command{
+	Name:   "download",
+	Usage:  "download a file from a storage bucket",
+	Action: downloadAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "file name in the bucket",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "local path to write to (defaults to the file name)",
+			Value: "",
+		},
+		&cli.Int64Flag{
+			Name:  "generation",
+			Usage: "generation of the file, e.g. a noncurrent version (0 for the live file)",
+			Value: 0,
+		},
+		&cli.Int64Flag{
+			Name:  "offset",
+			Usage: "byte offset to start downloading from",
+			Value: 0,
+		},
+		&cli.Int64Flag{
+			Name:  "length",
+			Usage: "number of bytes to download (0 for the rest of the file)",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.IntFlag{
+			Name:  "chunk-size",
+			Usage: "size of the chunk messages (grpc only)",
+			Value: (1 << 12),
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+	}, clientFlags...),
+}
+
+func downloadAction(c *cli.Context) error {
+	var (
+		err   error
+		fpath string
+
+		address   = c.String("address")
+		chunkSize = c.Int("chunk-size")
+		client    = core.ClientGRPC{}
+		file      = c.String("file")
+		output    = c.String("output")
+		project   = c.String("project")
+		bucket    = c.String("bucket")
+	)
+
+	if address == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+
+	if file == "" {
+		err = errors.New("file must be set")
+		return cli.Exit(err, 1)
+	}
+	if output == "" {
+		output = filepath.Base(file)
+	}
+	fpath, err = filepath.Abs(output)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("Invalid output path: %s", output), 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address:   address,
+		TLS:       clientTLS(c),
+		Token:     c.String("token"),
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	err = client.DownloadFile(context.Background(), &pb.DownloadFileRequest{
+		Project: &pb.Project{Id: project},
+		Bucket:  &pb.Bucket{Name: bucket},
+		File:    &pb.File{Name: file, Path: fpath, Generation: c.Int64("generation")},
+		Offset:  c.Int64("offset"),
+		Length:  c.Int64("length"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
@@ -4,6 +4,8 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/evanharmon/eph-music-micro/storage/core"
 	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
@@ -14,7 +16,7 @@ var ListBuckets = cli.Command{
 	Name:   "listbuckets",
 	Usage:  "list buckets",
 	Action: listAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "project",
 			Usage: "project id",
@@ -25,7 +27,7 @@ var ListBuckets = cli.Command{
 			Usage: "address",
 			Value: "localhost:10013",
 		},
-	},
+	}, clientFlags...),
 }
 
 func listAction(c *cli.Context) error {
@@ -49,18 +51,111 @@ func listAction(c *cli.Context) error {
 
 	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
 		Address: address,
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
 	})
 	if err != nil {
 		return cli.Exit(err, 1)
 	}
 	defer client.Close()
 
-	_, err = client.ListBuckets(context.Background(), &pb.ListBucketsRequest{
+	res, err := client.ListBuckets(context.Background(), &pb.ListBucketsRequest{
 		Project: &pb.Project{Id: project},
 	})
 	if err != nil {
 		return cli.Exit(err, 1)
 	}
+	for _, b := range res.Buckets {
+		fmt.Printf("%-10s  %-12s  %s\n", b.Class, b.Location, b.Name)
+	}
 
 	return nil
 }
+
+var ListFiles = cli.Command{
+	Name:   "listfiles",
+	Usage:  "list files in a bucket",
+	Action: listFilesAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "prefix",
+			Usage: "only list files starting with prefix, e.g. artist/album/",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "delimiter",
+			Usage: "group files into folders on delimiter",
+			Value: "/",
+		},
+		&cli.IntFlag{
+			Name:  "page-size",
+			Usage: "files fetched per request",
+			Value: 100,
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address",
+			Value: "localhost:10013",
+		},
+	}, clientFlags...),
+}
+
+func listFilesAction(c *cli.Context) error {
+	var (
+		err error
+		res *pb.ListFilesResponse
+
+		address = c.String("address")
+		client  = core.ClientGRPC{}
+		req     = &pb.ListFilesRequest{
+			Project:   &pb.Project{Id: c.String("project")},
+			Bucket:    &pb.Bucket{Name: c.String("bucket")},
+			Prefix:    c.String("prefix"),
+			Delimiter: c.String("delimiter"),
+			PageSize:  int32(c.Int("page-size")),
+		}
+	)
+
+	if address == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: address,
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	for {
+		res, err = client.ListFiles(context.Background(), req)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		for _, p := range res.Prefixes {
+			fmt.Printf("%12s  %20s  %s\n", "", "", p)
+		}
+		for _, f := range res.Files {
+			updated := time.Unix(f.GetUpdated().GetSeconds(), 0).UTC()
+			fmt.Printf("%12d  %20s  %s\n", f.Size, updated.Format(time.RFC3339), f.Name)
+		}
+		if res.NextPageToken == "" {
+			return nil
+		}
+		req.PageToken = res.NextPageToken
+	}
+}
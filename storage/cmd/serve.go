@@ -1,6 +1,24 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	helper "github.com/evanharmon/eph-music-micro/helper"
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/fs"
+	"github.com/evanharmon/eph-music-micro/storage/backend/gcs"
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
+	"github.com/evanharmon/eph-music-micro/storage/backend/s3"
 	"github.com/evanharmon/eph-music-micro/storage/core"
 	"github.com/pkg/errors"
 	cli "gopkg.in/urfave/cli.v2"
@@ -16,24 +34,312 @@ var Serve = cli.Command{
 			Usage: "port to bind to",
 			Value: 10013,
 		},
+		&cli.StringFlag{
+			Name:  "backend",
+			Usage: "storage backend to serve from (gcs, fs, memory, s3)",
+			Value: "gcs",
+		},
+		&cli.StringFlag{
+			Name:  "root",
+			Usage: "root directory for the fs backend",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "s3-endpoint",
+			Usage: "endpoint URL for the s3 backend",
+			Value: "http://localhost:9000",
+		},
+		&cli.StringFlag{
+			Name:  "s3-region",
+			Usage: "region for the s3 backend",
+			Value: s3.DefaultRegion,
+		},
+		&cli.StringFlag{
+			Name:  "upload-dir",
+			Usage: "directory to stage resumable uploads in (defaults under --root for the fs backend, else the temp dir)",
+			Value: "",
+		},
+		&cli.DurationFlag{
+			Name:  "upload-ttl",
+			Usage: "how long a resumable upload may go without a chunk before its session is removed",
+			Value: core.DefaultUploadTTL,
+		},
+		&cli.IntFlag{
+			Name:  "http-port",
+			Usage: "port to serve signed URLs on for the fs and memory backends (0 disables)",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "http-url",
+			Usage: "public base URL of the HTTP server, if not http://localhost:<http-port>",
+			Value: "",
+		},
+		&cli.IntFlag{
+			Name:  "gateway-port",
+			Usage: "port to serve the REST/JSON gateway on (0 disables)",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "signing-key-file",
+			Usage: "file holding the key signed URLs are signed with (defaults to a random key per process)",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "certificate to serve gRPC, HTTP and the gateway over TLS with, reloaded when it changes",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "key of the TLS certificate",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "tls-client-ca",
+			Usage: "CA bundle gRPC client certificates must chain to, turning on mutual TLS",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA bundle the gateway verifies the gRPC server with, if not the system roots",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "tls-server-name",
+			Usage: "name the gateway expects in the gRPC server certificate, if not localhost",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "api-keys-file",
+			Usage: "file of \"<principal> <key>\" lines; setting any auth flag requires callers to authenticate",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "jwt-secret-file",
+			Usage: "file holding the secret HS256 tokens are verified with",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "jwt-public-key",
+			Usage: "PEM RSA public key or certificate RS256 tokens are verified with",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "jwt-issuer",
+			Usage: "issuer tokens must carry in their iss claim",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "jwt-audience",
+			Usage: "audience tokens must carry in their aud claim",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "policy-file",
+			Usage: "YAML or JSON policy of what each principal may do, reloaded when it changes (needs an auth flag)",
+			Value: "",
+		},
+		&cli.DurationFlag{
+			Name:  "drain-timeout",
+			Usage: "how long RPCs in flight may run on SIGINT or SIGTERM before they are cancelled",
+			Value: 25 * time.Second,
+		},
 	},
 }
 
 func serveAction(c *cli.Context) error {
+	b, err := newBackend(c)
+	if err != nil {
+		return cli.Exit(errors.Wrap(err, "Error creating backend"), 1)
+	}
+
+	var key []byte
+	if f := c.String("signing-key-file"); f != "" {
+		if key, err = ioutil.ReadFile(f); err != nil {
+			b.Close()
+			return cli.Exit(errors.Wrap(err, "Error reading signing key"), 1)
+		}
+	}
+
+	auth, err := serverAuth(c)
+	if err != nil {
+		b.Close()
+		return cli.Exit(errors.Wrap(err, "Error reading auth config"), 1)
+	}
+
 	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
-		Port: c.Int("port"),
+		Port:       c.Int("port"),
+		Backend:    b,
+		UploadDir:  uploadDir(c),
+		UploadTTL:  c.Duration("upload-ttl"),
+		HTTPPort:   c.Int("http-port"),
+		HTTPURL:    c.String("http-url"),
+		SigningKey: key,
+		TLS:        serverTLS(c),
+		Auth:       auth,
+		PolicyFile: c.String("policy-file"),
 	})
 	if err != nil {
-		errors.Wrapf(err, "Error creating server:")
-		return cli.Exit(err, 1)
+		b.Close()
+		return cli.Exit(errors.Wrap(err, "Error creating server"), 1)
 	}
 
-	if err := s.Listen(); err != nil {
-		errors.Wrapf(err, "Error on server listen:")
-		return cli.Exit(err, 1)
+	var g *core.Gateway
+	if port := c.Int("gateway-port"); port != 0 {
+		g, err = core.NewGateway(core.GatewayConfig{
+			Port:        port,
+			Address:     "localhost:" + strconv.Itoa(c.Int("port")),
+			TLS:         serverTLS(c),
+			UpstreamTLS: gatewayTLS(c),
+		})
+		if err != nil {
+			s.Close()
+			return cli.Exit(errors.Wrap(err, "Error creating gateway"), 1)
+		}
+		defer g.Close()
+		go func() {
+			if err := g.Listen(); err != nil {
+				log.Printf("Gateway stopped: %v", err)
+			}
+		}()
 	}
 
-	defer s.Close()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	served := make(chan error, 1)
+	go func() { served <- s.Listen() }()
 
-	return nil
+	select {
+	case err := <-served:
+		if err != nil {
+			return cli.Exit(errors.Wrap(err, "Error on server listen"), 1)
+		}
+		s.Close()
+		return nil
+	case sig := <-sigs:
+		log.Printf("Received %v, draining for up to %v", sig, c.Duration("drain-timeout"))
+	}
+
+	// a second signal cancels whatever is still running
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("drain-timeout"))
+	defer cancel()
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// the gateway forwards to the gRPC server, so it drains first
+	if g != nil {
+		if err := g.Shutdown(ctx); err != nil {
+			log.Printf("Gateway did not drain: %v", err)
+		}
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		return cli.Exit(errors.Wrap(err, "Server did not drain"), 1)
+	}
+	return <-served
+}
+
+// serverTLS returns the TLS config of the servers, nil for plaintext
+func serverTLS(c *cli.Context) *core.TLSConfig {
+	if c.String("tls-cert") == "" && c.String("tls-key") == "" {
+		return nil
+	}
+	return &core.TLSConfig{
+		CertFile: c.String("tls-cert"),
+		KeyFile:  c.String("tls-key"),
+		CAFile:   c.String("tls-client-ca"),
+	}
+}
+
+// gatewayTLS returns how the gateway dials the gRPC server, presenting the
+// server certificate when the server verifies clients
+func gatewayTLS(c *cli.Context) *core.TLSConfig {
+	if serverTLS(c) == nil {
+		return nil
+	}
+	cfg := &core.TLSConfig{
+		CAFile:     c.String("tls-ca"),
+		ServerName: c.String("tls-server-name"),
+	}
+	if c.String("tls-client-ca") != "" {
+		cfg.CertFile, cfg.KeyFile = c.String("tls-cert"), c.String("tls-key")
+	}
+	return cfg
+}
+
+// serverAuth returns the auth config of the server, nil when callers are
+// not authenticated
+func serverAuth(c *cli.Context) (*core.AuthConfig, error) {
+	cfg := &core.AuthConfig{
+		APIKeysFile:      c.String("api-keys-file"),
+		JWTPublicKeyFile: c.String("jwt-public-key"),
+		Issuer:           c.String("jwt-issuer"),
+		Audience:         c.String("jwt-audience"),
+	}
+	if f := c.String("jwt-secret-file"); f != "" {
+		secret, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cfg.JWTSecret = bytes.TrimSpace(secret)
+	}
+	if cfg.APIKeysFile == "" && cfg.JWTPublicKeyFile == "" && len(cfg.JWTSecret) == 0 {
+		if cfg.Issuer != "" || cfg.Audience != "" {
+			return nil, fmt.Errorf("--jwt-issuer and --jwt-audience need --jwt-secret-file or --jwt-public-key")
+		}
+		return nil, nil
+	}
+	return cfg, nil
+}
+
+// newBackend creates the storage backend selected by the --backend flag
+func newBackend(c *cli.Context) (backend.Backend, error) {
+	switch name := c.String("backend"); name {
+	case "gcs":
+		return gcs.New(context.Background())
+	case "fs":
+		return fs.New(c.String("root"))
+	case "memory":
+		return memory.New(), nil
+	case "s3":
+		return newS3Backend(c)
+	default:
+		return nil, fmt.Errorf("Unknown backend: %s", name)
+	}
+}
+
+// uploadDir picks where resumable upload sessions are staged
+// The fs backend keeps them beside its metadata so they survive a restart
+func uploadDir(c *cli.Context) string {
+	if dir := c.String("upload-dir"); dir != "" {
+		return dir
+	}
+	if c.String("backend") == "fs" {
+		return filepath.Join(c.String("root"), ".eph", "uploads")
+	}
+	return filepath.Join(os.TempDir(), "eph-uploads")
+}
+
+// newS3Backend reads credentials from the standard AWS environment variables
+func newS3Backend(c *cli.Context) (*s3.Backend, error) {
+	accessKey, err := helper.GetEnv("AWS_ACCESS_KEY_ID")
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := helper.GetEnv("AWS_SECRET_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(s3.Config{
+		Endpoint:  c.String("s3-endpoint"),
+		Region:    c.String("s3-region"),
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	})
 }
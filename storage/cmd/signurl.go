@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var SignURL = cli.Command{
+	Name:   "signurl",
+	Usage:  "create a time-limited URL to download or upload a file directly",
+	Action: signURLAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "file name in the bucket",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "method",
+			Usage: "GET to download or PUT to upload",
+			Value: "GET",
+		},
+		&cli.DurationFlag{
+			Name:  "expires",
+			Usage: "how long the URL stays valid, at most 168h",
+			Value: 15 * time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "content-type",
+			Usage: "content type a PUT must send",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+	}, clientFlags...),
+}
+
+func signURLAction(c *cli.Context) error {
+	var (
+		err    error
+		client = core.ClientGRPC{}
+		file   = c.String("file")
+	)
+
+	if c.String("address") == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if file == "" {
+		err = errors.New("file must be set")
+		return cli.Exit(err, 1)
+	}
+	method, ok := pb.SignedMethod_value[strings.ToUpper(c.String("method"))]
+	if !ok || method == int32(pb.SignedMethod_UnknownMethod) {
+		return cli.Exit(fmt.Errorf("Unknown method: %s", c.String("method")), 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: c.String("address"),
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.SignURL(context.Background(), &pb.SignURLRequest{
+		Project:        &pb.Project{Id: c.String("project")},
+		Bucket:         &pb.Bucket{Name: c.String("bucket")},
+		File:           &pb.File{Name: file, ContentType: c.String("content-type")},
+		Method:         pb.SignedMethod(method),
+		ExpiresSeconds: int64(c.Duration("expires") / time.Second),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Println(res.Url)
+
+	return nil
+}
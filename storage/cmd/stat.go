@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var Stat = cli.Command{
+	Name:   "stat",
+	Usage:  "show the metadata of a file in a storage bucket",
+	Action: statAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "file name in the bucket",
+			Value: "",
+		},
+		&cli.Int64Flag{
+			Name:  "generation",
+			Usage: "generation of the file, e.g. a noncurrent version (0 for the live file)",
+			Value: 0,
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+	}, clientFlags...),
+}
+
+func statAction(c *cli.Context) error {
+	var (
+		err error
+
+		address = c.String("address")
+		client  = core.ClientGRPC{}
+		file    = c.String("file")
+	)
+
+	if address == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if file == "" {
+		err = errors.New("file must be set")
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: address,
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.StatFile(context.Background(), &pb.StatFileRequest{
+		Project: &pb.Project{Id: c.String("project")},
+		Bucket:  &pb.Bucket{Name: c.String("bucket")},
+		File:    &pb.File{Name: file, Generation: c.Int64("generation")},
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	f := res.File
+	fmt.Printf("Name:                %s\n", f.Name)
+	fmt.Printf("Size:                %d\n", f.Size)
+	fmt.Printf("Content-Type:        %s\n", f.ContentType)
+	fmt.Printf("Cache-Control:       %s\n", f.CacheControl)
+	fmt.Printf("Content-Disposition: %s\n", f.ContentDisposition)
+	fmt.Printf("Storage class:       %s\n", f.StorageClass)
+	fmt.Printf("Generation:          %d\n", f.Generation)
+	fmt.Printf("Created:             %s\n", formatTimestamp(f.Created))
+	fmt.Printf("Updated:             %s\n", formatTimestamp(f.Updated))
+	if f.Deleted != nil {
+		fmt.Printf("Deleted:             %s\n", formatTimestamp(f.Deleted))
+	}
+	fmt.Printf("CRC32C:              %08x\n", f.Crc32C)
+	fmt.Printf("MD5:                 %x\n", f.Md5Hash)
+
+	keys := make([]string, 0, len(f.Metadata))
+	for k := range f.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("Metadata:            %s=%s\n", k, f.Metadata[k])
+	}
+
+	return nil
+}
+
+func formatTimestamp(ts *timestamp.Timestamp) string {
+	if ts == nil {
+		return ""
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339)
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/evanharmon/eph-music-micro/storage/core"
 	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	cli "gopkg.in/urfave/cli.v2"
 )
 
@@ -15,7 +17,7 @@ var Upload = cli.Command{
 	Name:   "upload",
 	Usage:  "upload a file to a storage bucket",
 	Action: uploadAction,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "file",
 			Usage: "file name",
@@ -41,7 +43,35 @@ var Upload = cli.Command{
 			Usage: "bucket name",
 			Value: "test-eph-music",
 		},
-	},
+		&cli.IntFlag{
+			Name:  "retries",
+			Usage: "times to resume an interrupted upload, 0 uploads in one stream",
+			Value: 3,
+		},
+		&cli.StringFlag{
+			Name:  "content-type",
+			Usage: "content type of the file, detected from its name or content when empty",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "cache-control",
+			Usage: "Cache-Control to serve the file with",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "content-disposition",
+			Usage: "Content-Disposition to serve the file with",
+			Value: "",
+		},
+		&cli.StringSliceFlag{
+			Name:  "metadata",
+			Usage: "custom metadata as key=value, may be repeated",
+		},
+		&cli.Int64Flag{
+			Name:  "if-generation-match",
+			Usage: "only upload if the live file has this generation, 0 if it must not exist",
+		},
+	}, clientFlags...),
 }
 
 func uploadAction(c *cli.Context) error {
@@ -59,12 +89,12 @@ func uploadAction(c *cli.Context) error {
 	)
 
 	if address == "" {
-		errors.New("Address is required")
+		err = errors.New("Address is required")
 		return cli.Exit(err, 1)
 	}
 
 	if file == "" {
-		errors.New("file must be set")
+		err = errors.New("file must be set")
 		return cli.Exit(err, 1)
 	}
 	fpath, err = filepath.Abs(file)
@@ -73,9 +103,23 @@ func uploadAction(c *cli.Context) error {
 	}
 	fname = filepath.Base(file)
 
+	metadata, err := parseKeyValues(c.StringSlice("metadata"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	// 0 is a condition of its own, so the flag only applies when given
+	var ifGeneration *wrappers.Int64Value
+	if c.IsSet("if-generation-match") {
+		ifGeneration = &wrappers.Int64Value{Value: c.Int64("if-generation-match")}
+	}
+
 	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
 		Address:   address,
+		TLS:       clientTLS(c),
+		Token:     c.String("token"),
 		ChunkSize: chunkSize,
+		Retries:   c.Int("retries"),
 	})
 	if err != nil {
 		return cli.Exit(err, 1)
@@ -85,8 +129,16 @@ func uploadAction(c *cli.Context) error {
 	_, err = client.UploadFile(context.Background(), &pb.UploadFileRequest{
 		Project: &pb.Project{Id: project},
 		Bucket:  &pb.Bucket{Name: bucket},
-		File:    &pb.File{Name: fname, Path: fpath},
-		Chunk:   &pb.Chunk{Content: []byte{}},
+		File: &pb.File{
+			Name:               fname,
+			Path:               fpath,
+			ContentType:        c.String("content-type"),
+			CacheControl:       c.String("cache-control"),
+			ContentDisposition: c.String("content-disposition"),
+			Metadata:           metadata,
+		},
+		Chunk:             &pb.Chunk{Content: []byte{}},
+		IfGenerationMatch: ifGeneration,
 	})
 	if err != nil {
 		return cli.Exit(err, 1)
@@ -94,3 +146,19 @@ func uploadAction(c *cli.Context) error {
 
 	return nil
 }
+
+// parseKeyValues splits key=value pairs into a map
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Expected key=value, got: %s", pair)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	cli "gopkg.in/urfave/cli.v2"
+)
+
+var Versions = cli.Command{
+	Name:   "versions",
+	Usage:  "list every generation of a file, newest first",
+	Action: versionsAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "file name in the bucket",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+	}, clientFlags...),
+}
+
+func versionsAction(c *cli.Context) error {
+	var (
+		err    error
+		client = core.ClientGRPC{}
+		file   = c.String("file")
+	)
+
+	if c.String("address") == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if file == "" {
+		err = errors.New("file must be set")
+		return cli.Exit(err, 1)
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: c.String("address"),
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.ListFileVersions(context.Background(), &pb.ListFileVersionsRequest{
+		Project: &pb.Project{Id: c.String("project")},
+		Bucket:  &pb.Bucket{Name: c.String("bucket")},
+		File:    &pb.File{Name: file},
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	for _, f := range res.Versions {
+		state := "live"
+		if f.Deleted != nil {
+			state = "noncurrent since " + formatTimestamp(f.Deleted)
+		}
+		fmt.Printf("%d\t%d\t%s\t%s\n", f.Generation, f.Size, formatTimestamp(f.Updated), state)
+	}
+
+	return nil
+}
+
+var Restore = cli.Command{
+	Name:   "restore",
+	Usage:  "make a previous generation of a file live again",
+	Action: restoreAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "file name in the bucket",
+			Value: "",
+		},
+		&cli.Int64Flag{
+			Name:  "generation",
+			Usage: "generation to restore, see versions",
+			Value: 0,
+		},
+		&cli.Int64Flag{
+			Name:  "if-generation-match",
+			Usage: "only restore if the live file has this generation, 0 if it must not exist",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "address of the server to connect to",
+			Value: "localhost:10013",
+		},
+		&cli.StringFlag{
+			Name:  "project",
+			Usage: "project id",
+			Value: "eph-music",
+		},
+		&cli.StringFlag{
+			Name:  "bucket",
+			Usage: "bucket name",
+			Value: "test-eph-music",
+		},
+	}, clientFlags...),
+}
+
+func restoreAction(c *cli.Context) error {
+	var (
+		err    error
+		client = core.ClientGRPC{}
+		file   = c.String("file")
+	)
+
+	if c.String("address") == "" {
+		err = errors.New("Address is required")
+		return cli.Exit(err, 1)
+	}
+	if file == "" || c.Int64("generation") == 0 {
+		err = errors.New("file and generation must be set")
+		return cli.Exit(err, 1)
+	}
+
+	var ifGeneration *wrappers.Int64Value
+	if c.IsSet("if-generation-match") {
+		ifGeneration = &wrappers.Int64Value{Value: c.Int64("if-generation-match")}
+	}
+
+	client, err = core.NewClientGRPC(core.ClientGRPCConfig{
+		Address: c.String("address"),
+		TLS:     clientTLS(c),
+		Token:   c.String("token"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer client.Close()
+
+	res, err := client.RestoreFile(context.Background(), &pb.RestoreFileRequest{
+		Project:           &pb.Project{Id: c.String("project")},
+		Bucket:            &pb.Bucket{Name: c.String("bucket")},
+		File:              &pb.File{Name: file, Generation: c.Int64("generation")},
+		IfGenerationMatch: ifGeneration,
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	fmt.Printf("Restored %s as generation %d\n", res.File.Name, res.File.Generation)
+
+	return nil
+}
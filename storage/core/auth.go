@@ -0,0 +1,341 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// jwtLeeway absorbs clock skew between the token issuer and the server
+const jwtLeeway = time.Minute
+
+// AuthConfig selects how callers authenticate, at least one way is required
+// APIKeysFile holds one "<principal> <key>" pair per line, blank lines and
+// lines starting with # are skipped
+// JWTSecret verifies HS256 tokens and JWTPublicKeyFile, a PEM RSA public key
+// or certificate, verifies RS256 tokens; the token subject is the principal
+// and tokens without an exp claim are rejected
+// Issuer and Audience, when set, must match the iss and aud claims
+type AuthConfig struct {
+	APIKeysFile      string
+	JWTSecret        []byte
+	JWTPublicKeyFile string
+	Issuer           string
+	Audience         string
+}
+
+// Principal is an authenticated caller
+// Method is how it authenticated, "api-key" or "jwt"
+type Principal struct {
+	Name   string
+	Method string
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the caller an RPC was authenticated as
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// authenticator checks the bearer token of every RPC
+type authenticator struct {
+	// apiKeys maps the SHA-256 of each key to its principal, so lookups do
+	// not leak key prefixes through timing
+	apiKeys   map[[sha256.Size]byte]string
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+}
+
+func newAuthenticator(cfg *AuthConfig) (*authenticator, error) {
+	a := &authenticator{
+		secret:   cfg.JWTSecret,
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+	}
+	if cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		a.apiKeys = keys
+	}
+	if cfg.JWTPublicKeyFile != "" {
+		key, err := loadRSAPublicKey(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.publicKey = key
+	}
+	if a.apiKeys == nil && len(a.secret) == 0 && a.publicKey == nil {
+		return nil, errors.New("Auth needs API keys, a JWT secret or a JWT public key")
+	}
+	return a, nil
+}
+
+func loadAPIKeys(file string) (map[[sha256.Size]byte]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read API keys: %v", err)
+	}
+	defer f.Close()
+
+	keys := map[[sha256.Size]byte]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<principal> <key>\"", file, n)
+		}
+		sum := sha256.Sum256([]byte(fields[1]))
+		if _, ok := keys[sum]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key", file, n)
+		}
+		keys[sum] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read API keys: %v", err)
+	}
+	return keys, nil
+}
+
+func loadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read JWT public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", file)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse JWT public key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("JWT public key in %s is not an RSA key", file)
+	}
+	return rsaKey, nil
+}
+
+// authenticate returns the principal behind the credentials in ctx
+func (a *authenticator) authenticate(ctx context.Context) (*Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "Missing credentials")
+	}
+	const prefix = "bearer "
+	token := values[0]
+	if len(token) <= len(prefix) || !strings.EqualFold(token[:len(prefix)], prefix) {
+		return nil, status.Errorf(codes.Unauthenticated, "Credentials must be a bearer token")
+	}
+	token = strings.TrimSpace(token[len(prefix):])
+
+	if name, ok := a.apiKeys[sha256.Sum256([]byte(token))]; ok {
+		return &Principal{Name: name, Method: "api-key"}, nil
+	}
+	if strings.Count(token, ".") == 2 && (len(a.secret) > 0 || a.publicKey != nil) {
+		name, err := a.verifyJWT(token, time.Now())
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "Invalid token: %v", err)
+		}
+		return &Principal{Name: name, Method: "jwt"}, nil
+	}
+	return nil, status.Errorf(codes.Unauthenticated, "Invalid credentials")
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   float64     `json:"exp"`
+	NotBefore float64     `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, a string or an array of them
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a jwtAudience) has(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWT checks the signature and claims of a compact JWT and returns
+// its subject
+// The algorithm must match a configured key, so an HS256 token signed with
+// the RSA public key is never accepted
+func (a *authenticator) verifyJWT(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch {
+	case header.Alg == "HS256" && len(a.secret) > 0:
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", errors.New("bad signature")
+		}
+	case header.Alg == "RS256" && a.publicKey != nil:
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, sum[:], sig); err != nil {
+			return "", errors.New("bad signature")
+		}
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("missing subject")
+	}
+	if claims.Expires == 0 {
+		return "", errors.New("missing expiry")
+	}
+	if now.Add(-jwtLeeway).After(unixTime(claims.Expires)) {
+		return "", errors.New("token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Before(unixTime(claims.NotBefore)) {
+		return "", errors.New("token is not valid yet")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return "", errors.New("wrong issuer")
+	}
+	if a.audience != "" && !claims.Audience.has(a.audience) {
+		return "", errors.New("wrong audience")
+	}
+	return claims.Subject, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// unary authenticates unary RPCs
+func (a *authenticator) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	p, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(withPrincipal(ctx, p), req)
+}
+
+// stream authenticates streaming RPCs
+func (a *authenticator) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	p, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: withPrincipal(ss.Context(), p)})
+}
+
+// contextStream replaces the context of a server stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// tokenCredentials sends a bearer token with every RPC
+// Transport security is not required, so tokens also reach plaintext
+// servers on localhost
+type tokenCredentials struct {
+	token string
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,255 @@
+package core_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// signTestJWT signs claims as a compact JWT, key is an HS256 secret, an
+// RSA private key or nil for an empty signature
+func signTestJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestAuth(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys")
+	keys := "# principal key\nalice key-alice\n\nbob key-bob\n"
+	if err := ioutil.WriteFile(keysFile, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(dir, "jwt.pem")
+	writeTestPEM(t, pubFile, "PUBLIC KEY", pubDER)
+	secret := []byte("s3cret")
+
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+		Port:    testPort,
+		Backend: memory.New(),
+		Auth: &core.AuthConfig{
+			APIKeysFile:      keysFile,
+			JWTSecret:        secret,
+			JWTPublicKeyFile: pubFile,
+			Issuer:           "eph-test",
+			Audience:         "storage",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestBucket(t, s, testBucket)
+	addr := serveTestProvider(t, s)
+
+	claims := func(edit func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "eph-test",
+			"aud": "storage",
+			"sub": "carol",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+
+	tests := map[string]struct {
+		token string
+		ok    bool
+	}{
+		"Missing credentials should be rejected": {
+			token: "",
+		},
+		"Unknown API key should be rejected": {
+			token: "key-mallory",
+		},
+		"API key should be accepted": {
+			token: "key-bob",
+			ok:    true,
+		},
+		"HS256 token should be accepted": {
+			token: signTestJWT(t, "HS256", secret, claims(nil)),
+			ok:    true,
+		},
+		"RS256 token should be accepted": {
+			token: signTestJWT(t, "RS256", rsaKey, claims(nil)),
+			ok:    true,
+		},
+		"Audience list containing the audience should be accepted": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"other", "storage"}
+			})),
+			ok: true,
+		},
+		"HS256 token with the wrong secret should be rejected": {
+			token: signTestJWT(t, "HS256", []byte("guess"), claims(nil)),
+		},
+		"RS256 token signed by another key should be rejected": {
+			token: signTestJWT(t, "RS256", otherKey, claims(nil)),
+		},
+		"HS256 token keyed with the public key should be rejected": {
+			token: signTestJWT(t, "HS256", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), claims(nil)),
+		},
+		"Unsigned token should be rejected": {
+			token: signTestJWT(t, "none", nil, claims(nil)),
+		},
+		"Expired token should be rejected": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+			})),
+		},
+		"Token without expiry should be rejected": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				delete(c, "exp")
+			})),
+		},
+		"Token not valid yet should be rejected": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				c["nbf"] = time.Now().Add(time.Hour).Unix()
+			})),
+		},
+		"Token from another issuer should be rejected": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				c["iss"] = "someone-else"
+			})),
+		},
+		"Token for another audience should be rejected": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				c["aud"] = "billing"
+			})),
+		},
+		"Token without a subject should be rejected": {
+			token: signTestJWT(t, "HS256", secret, claims(func(c map[string]interface{}) {
+				delete(c, "sub")
+			})),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := core.NewClientGRPC(core.ClientGRPCConfig{Address: addr, Token: tc.token})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			_, err = c.GetBucket(context.Background(), &pb.GetBucketRequest{
+				Project: &pb.Project{Id: testProject},
+				Bucket:  &pb.Bucket{Name: testBucket},
+			})
+			if tc.ok && err != nil {
+				t.Errorf("Expected the call to succeed, got %v", err)
+			}
+			if !tc.ok && status.Code(err) != codes.Unauthenticated {
+				t.Errorf("Expected Unauthenticated, got %v", err)
+			}
+		})
+	}
+
+	t.Run("Token should be read from the environment", func(t *testing.T) {
+		t.Setenv(core.TokenEnv, "key-alice")
+		c, err := core.NewClientGRPC(core.ClientGRPCConfig{Address: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, err := c.GetBucket(context.Background(), &pb.GetBucketRequest{
+			Project: &pb.Project{Id: testProject},
+			Bucket:  &pb.Bucket{Name: testBucket},
+		}); err != nil {
+			t.Errorf("Expected the call to succeed, got %v", err)
+		}
+	})
+
+	t.Run("Streaming RPCs should be authenticated", func(t *testing.T) {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := pb.NewStorageClient(conn)
+
+		for _, token := range []string{"", "key-alice"} {
+			ctx := context.Background()
+			if token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+			}
+			stream, err := client.UploadFile(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := newUploadStream(testBucket, "auth.txt", "hello").reqs[0]
+			stream.Send(req)
+			_, err = stream.CloseAndRecv()
+			if token == "" && status.Code(err) != codes.Unauthenticated {
+				t.Errorf("Expected Unauthenticated without a token, got %v", err)
+			}
+			if token != "" && err != nil {
+				t.Errorf("Expected the upload to succeed, got %v", err)
+			}
+		}
+	})
+
+	t.Run("Auth without any way to authenticate should fail", func(t *testing.T) {
+		_, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+			Port:    testPort,
+			Backend: memory.New(),
+			Auth:    &core.AuthConfig{Issuer: "eph-test"},
+		})
+		if err == nil {
+			t.Errorf("Expected an error for an empty auth config")
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+)
+
+// lifecycleActions maps lifecycle actions onto the backend's action names
+var lifecycleActions = map[pb.LifecycleAction]string{
+	pb.LifecycleAction_Delete:          backend.LifecycleDelete,
+	pb.LifecycleAction_SetStorageClass: backend.LifecycleSetStorageClass,
+}
+
+// lifecycleRules validates rules and converts them for the backend
+// The result is never nil so an empty list clears the bucket's rules
+func lifecycleRules(rules []*pb.LifecycleRule) ([]backend.LifecycleRule, error) {
+	res := make([]backend.LifecycleRule, 0, len(rules))
+	for i, r := range rules {
+		action, ok := lifecycleActions[r.Action]
+		if !ok {
+			return nil, fmt.Errorf("Lifecycle rule %d has no action", i)
+		}
+		if r.Action == pb.LifecycleAction_SetStorageClass && r.StorageClass == "" {
+			return nil, fmt.Errorf("Lifecycle rule %d needs a storage class", i)
+		}
+		if r.AgeDays < 0 {
+			return nil, fmt.Errorf("Lifecycle rule %d has a negative age", i)
+		}
+		res = append(res, backend.LifecycleRule{
+			Action:       action,
+			StorageClass: r.StorageClass,
+			AgeInDays:    r.AgeDays,
+			Prefix:       r.Prefix,
+		})
+	}
+	return res, nil
+}
+
+// corsRules validates rules and converts them for the backend
+// The result is never nil so an empty list clears the bucket's rules
+func corsRules(rules []*pb.CorsRule) ([]backend.CORS, error) {
+	res := make([]backend.CORS, 0, len(rules))
+	for i, r := range rules {
+		if len(r.Origins) == 0 || len(r.Methods) == 0 {
+			return nil, fmt.Errorf("CORS rule %d needs origins and methods", i)
+		}
+		if r.MaxAgeSeconds < 0 {
+			return nil, fmt.Errorf("CORS rule %d has a negative max age", i)
+		}
+		res = append(res, backend.CORS{
+			Origins:         r.Origins,
+			Methods:         r.Methods,
+			ResponseHeaders: r.ResponseHeaders,
+			MaxAge:          time.Duration(r.MaxAgeSeconds) * time.Second,
+		})
+	}
+	return res, nil
+}
+
+func objectDefaults(d *pb.ObjectDefaults) *backend.ObjectDefaults {
+	return &backend.ObjectDefaults{
+		CacheControl:       d.GetCacheControl(),
+		ContentDisposition: d.GetContentDisposition(),
+		Metadata:           d.GetMetadata(),
+	}
+}
+
+func newLifecycleRules(rules []backend.LifecycleRule) []*pb.LifecycleRule {
+	var res []*pb.LifecycleRule
+	for _, r := range rules {
+		rule := &pb.LifecycleRule{
+			StorageClass: r.StorageClass,
+			AgeDays:      r.AgeInDays,
+			Prefix:       r.Prefix,
+		}
+		for action, name := range lifecycleActions {
+			if name == r.Action {
+				rule.Action = action
+			}
+		}
+		res = append(res, rule)
+	}
+	return res
+}
+
+func newCorsRules(rules []backend.CORS) []*pb.CorsRule {
+	var res []*pb.CorsRule
+	for _, r := range rules {
+		res = append(res, &pb.CorsRule{
+			Origins:         r.Origins,
+			Methods:         r.Methods,
+			ResponseHeaders: r.ResponseHeaders,
+			MaxAgeSeconds:   int64(r.MaxAge / time.Second),
+		})
+	}
+	return res
+}
+
+// newObjectDefaults returns nil when the bucket has no defaults
+func newObjectDefaults(d backend.ObjectDefaults) *pb.ObjectDefaults {
+	if d.CacheControl == "" && d.ContentDisposition == "" && len(d.Metadata) == 0 {
+		return nil
+	}
+	return &pb.ObjectDefaults{
+		CacheControl:       d.CacheControl,
+		ContentDisposition: d.ContentDisposition,
+		Metadata:           d.Metadata,
+	}
+}
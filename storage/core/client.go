@@ -6,12 +6,19 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/evanharmon/eph-music-micro/storage/backend"
 	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcstatus "google.golang.org/grpc/status"
 )
 
 type ClientService interface {
@@ -22,19 +29,45 @@ type ClientService interface {
 	Delete(context.Context, *pb.DeleteRequest) (*pb.DeleteResponse, error)
 	UploadFile(context.Context, *pb.UploadFileRequest) (*pb.UploadFileResponse, error)
 	DeleteFile(context.Context, *pb.DeleteFileRequest) (*pb.DeleteFileResponse, error)
+	DownloadFile(context.Context, *pb.DownloadFileRequest) error
+	ListFiles(context.Context, *pb.ListFilesRequest) (*pb.ListFilesResponse, error)
+	StartUpload(context.Context, *pb.StartUploadRequest) (*pb.StartUploadResponse, error)
+	QueryUpload(context.Context, *pb.QueryUploadRequest) (*pb.QueryUploadResponse, error)
+	StatFile(context.Context, *pb.StatFileRequest) (*pb.StatFileResponse, error)
+	DeleteFiles(context.Context, *pb.DeleteFilesRequest) (*pb.DeleteFilesResponse, error)
+	CopyFile(context.Context, *pb.CopyFileRequest) (*pb.CopyFileResponse, error)
+	MoveFile(context.Context, *pb.MoveFileRequest) (*pb.MoveFileResponse, error)
+	GetBucket(context.Context, *pb.GetBucketRequest) (*pb.GetBucketResponse, error)
+	UpdateBucket(context.Context, *pb.UpdateBucketRequest) (*pb.UpdateBucketResponse, error)
+	ListFileVersions(context.Context, *pb.ListFileVersionsRequest) (*pb.ListFileVersionsResponse, error)
+	RestoreFile(context.Context, *pb.RestoreFileRequest) (*pb.RestoreFileResponse, error)
+	SignURL(context.Context, *pb.SignURLRequest) (*pb.SignURLResponse, error)
 }
 
 type ClientGRPC struct {
 	conn      *grpc.ClientConn
 	client    pb.StorageClient
 	chunkSize int
+	retries   int
 }
 
+// ClientGRPCConfig for the client
+// Retries above 0 makes UploadFile resumable, reconnecting up to that many
+// times and continuing from the offset the server has committed
+// TLS dials the server over TLS instead of plaintext
+// Token, an API key or JWT, is sent with every RPC, by default the value of
+// the TokenEnv environment variable
 type ClientGRPCConfig struct {
 	Address   string
 	ChunkSize int
+	Retries   int
+	TLS       *TLSConfig
+	Token     string
 }
 
+// TokenEnv names the environment variable clients read their token from
+const TokenEnv = "EPH_STORAGE_TOKEN"
+
 func NewClientGRPC(cfg ClientGRPCConfig) (ClientGRPC, error) {
 	var (
 		err error
@@ -43,13 +76,27 @@ func NewClientGRPC(cfg ClientGRPCConfig) (ClientGRPC, error) {
 		grpcOpts  = []grpc.DialOption{}
 		chunkSize = cfg.ChunkSize
 	)
-	// Certs Not Implemented
-	grpcOpts = append(grpcOpts, grpc.WithInsecure())
-
 	if cfg.Address == "" {
 		return c, errors.Errorf("address must be specified")
 	}
 
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.clientConfig()
+		if err != nil {
+			return c, err
+		}
+		grpcOpts = append(grpcOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+	} else {
+		grpcOpts = append(grpcOpts, grpc.WithInsecure())
+	}
+	token := cfg.Token
+	if token == "" {
+		token = os.Getenv(TokenEnv)
+	}
+	if token != "" {
+		grpcOpts = append(grpcOpts, grpc.WithPerRPCCredentials(tokenCredentials{token: token}))
+	}
+
 	if cfg.ChunkSize == 0 {
 		chunkSize = 1024
 	}
@@ -61,6 +108,11 @@ func NewClientGRPC(cfg ClientGRPCConfig) (ClientGRPC, error) {
 		c.chunkSize = chunkSize
 	}
 
+	if cfg.Retries < 0 {
+		return c, errors.Errorf("Retries cannot be negative")
+	}
+	c.retries = cfg.Retries
+
 	c.conn, err = grpc.Dial(cfg.Address, grpcOpts...)
 	if err != nil {
 		return c, errors.Wrapf(err, "Failed to start grpc connection with address: %s", cfg.Address)
@@ -84,20 +136,40 @@ func (c *ClientGRPC) Close() {
 func (c *ClientGRPC) ListBuckets(ctx context.Context, req *pb.ListBucketsRequest) (*pb.ListBucketsResponse, error) {
 	res, err := c.client.ListBuckets(ctx, req)
 	if err != nil {
-		return nil, errors.Errorf("%v.GetBuckets(_) = _, %v", c.client, err)
+		return nil, rpcError(err)
 	}
 	log.Printf("Response from ListBuckets: %v", res.Buckets)
 
 	return res, nil
 }
 
+// GetBucket returns the class, location, labels and creation time of a bucket
+func (c *ClientGRPC) GetBucket(ctx context.Context, req *pb.GetBucketRequest) (*pb.GetBucketResponse, error) {
+	res, err := c.client.GetBucket(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// UpdateBucket changes the bucket settings named in the request's update mask
+func (c *ClientGRPC) UpdateBucket(ctx context.Context, req *pb.UpdateBucketRequest) (*pb.UpdateBucketResponse, error) {
+	res, err := c.client.UpdateBucket(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
 // Create attempts to create a new bucket for a project id
 // this custom create function is idempotent and will not return the 409 error
 // if bucket is owned and already exists
 func (c *ClientGRPC) Create(ctx context.Context, req *pb.CreateRequest) (*pb.CreateResponse, error) {
 	res, err := c.client.Create(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, rpcError(err)
 	}
 	log.Println(res)
 
@@ -108,7 +180,7 @@ func (c *ClientGRPC) Create(ctx context.Context, req *pb.CreateRequest) (*pb.Cre
 func (c *ClientGRPC) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
 	res, err := c.client.Delete(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, rpcError(err)
 	}
 	log.Println(res)
 
@@ -116,7 +188,17 @@ func (c *ClientGRPC) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.Del
 }
 
 // UploadFile to storage bucket
+// Uploads are resumable when the client is configured with retries and the
+// server supports upload sessions
 func (c *ClientGRPC) UploadFile(ctx context.Context, req *pb.UploadFileRequest) (*pb.UploadFileResponse, error) {
+	if c.retries > 0 {
+		res, err := c.resumableUpload(ctx, req)
+		if grpcstatus.Code(err) != codes.Unimplemented {
+			return res, rpcError(err)
+		}
+		log.Println("Server does not support resumable uploads, uploading in one stream")
+	}
+
 	var (
 		buf     []byte
 		err     error
@@ -137,7 +219,7 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, req *pb.UploadFileRequest)
 
 	stream, err := c.client.UploadFile(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Error uploading file via stream: %v\n", stream)
+		return nil, rpcError(err)
 	}
 	defer func(s pb.Storage_UploadFileClient) {
 		if err = s.CloseSend(); err != nil {
@@ -146,6 +228,7 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, req *pb.UploadFileRequest)
 	}(stream)
 
 	buf = make([]byte, c.chunkSize)
+	digest := backend.NewDigest()
 	for writing {
 		n, err = file.Read(buf)
 		if err != nil {
@@ -157,16 +240,29 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, req *pb.UploadFileRequest)
 			return nil, fmt.Errorf("Error copying from file to buf: %v\n", err)
 		}
 
-		req.Chunk.Content = buf[:n]
+		digest.Write(buf[:n])
+		req.Chunk = &pb.Chunk{Content: buf[:n]}
 		err = stream.Send(req)
+		if err == io.EOF {
+			// the stream was closed by the server, the cause is in its status
+			_, err = stream.CloseAndRecv()
+			return nil, rpcError(err)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Error on stream.Send() %v\n", err)
 		}
 	}
 
+	// the final message carries the checksums of everything sent
+	req.Chunk = &pb.Chunk{}
+	req.Checksums = &pb.Checksums{Crc32C: digest.CRC32C(), Md5Hash: digest.MD5()}
+	if err = stream.Send(req); err != nil {
+		return nil, fmt.Errorf("Error on stream.Send() %v\n", err)
+	}
+
 	status, err = stream.CloseAndRecv()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to receive upstream status response: %v\n", err)
+		return nil, rpcError(err)
 	}
 
 	if status.Code != pb.UploadStatusCode_Ok {
@@ -176,11 +272,280 @@ func (c *ClientGRPC) UploadFile(ctx context.Context, req *pb.UploadFileRequest)
 	return status, nil
 }
 
+// DeleteFiles removes the listed files, or every file under a prefix
+func (c *ClientGRPC) DeleteFiles(ctx context.Context, req *pb.DeleteFilesRequest) (*pb.DeleteFilesResponse, error) {
+	res, err := c.client.DeleteFiles(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// StatFile returns the metadata of a file in a storage bucket
+func (c *ClientGRPC) StatFile(ctx context.Context, req *pb.StatFileRequest) (*pb.StatFileResponse, error) {
+	res, err := c.client.StatFile(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// CopyFile copies a file server side, within or across buckets
+func (c *ClientGRPC) CopyFile(ctx context.Context, req *pb.CopyFileRequest) (*pb.CopyFileResponse, error) {
+	res, err := c.client.CopyFile(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// MoveFile moves a file server side, within or across buckets
+func (c *ClientGRPC) MoveFile(ctx context.Context, req *pb.MoveFileRequest) (*pb.MoveFileResponse, error) {
+	res, err := c.client.MoveFile(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// ListFileVersions returns every generation of a file, newest first
+func (c *ClientGRPC) ListFileVersions(ctx context.Context, req *pb.ListFileVersionsRequest) (*pb.ListFileVersionsResponse, error) {
+	res, err := c.client.ListFileVersions(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// RestoreFile makes a previous generation of a file live again
+func (c *ClientGRPC) RestoreFile(ctx context.Context, req *pb.RestoreFileRequest) (*pb.RestoreFileResponse, error) {
+	res, err := c.client.RestoreFile(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// SignURL returns a time-limited URL to download or upload a file directly
+func (c *ClientGRPC) SignURL(ctx context.Context, req *pb.SignURLRequest) (*pb.SignURLResponse, error) {
+	res, err := c.client.SignURL(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// StartUpload creates a session for a resumable upload
+func (c *ClientGRPC) StartUpload(ctx context.Context, req *pb.StartUploadRequest) (*pb.StartUploadResponse, error) {
+	res, err := c.client.StartUpload(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// QueryUpload returns the offset the server has committed for a session
+func (c *ClientGRPC) QueryUpload(ctx context.Context, req *pb.QueryUploadRequest) (*pb.QueryUploadResponse, error) {
+	res, err := c.client.QueryUpload(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// resumableUpload sends the file through an upload session
+// After a transient failure it waits, asks the server how much it has and
+// sends the rest
+func (c *ClientGRPC) resumableUpload(ctx context.Context, req *pb.UploadFileRequest) (*pb.UploadFileResponse, error) {
+	sess, err := c.client.StartUpload(ctx, &pb.StartUploadRequest{
+		Project:           req.Project,
+		Bucket:            req.Bucket,
+		File:              req.File,
+		IfGenerationMatch: req.IfGenerationMatch,
+	}, grpc.FailFast(false))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(req.File.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file: %v", err)
+	}
+	defer file.Close()
+
+	// checksums cover the whole file, so they are computed before any
+	// attempt rather than from whatever part of it one attempt sends
+	digest := backend.NewDigest()
+	if _, err := io.Copy(digest, file); err != nil {
+		return nil, fmt.Errorf("Error reading file: %v", err)
+	}
+	sums := &pb.Checksums{Crc32C: digest.CRC32C(), Md5Hash: digest.MD5()}
+
+	for attempt := 0; ; attempt++ {
+		res, err := c.sendSession(ctx, file, sess.SessionId, sums)
+		if err == nil || attempt >= c.retries || !retryable(err) {
+			return res, err
+		}
+		log.Printf("Upload interrupted, resuming: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// sendSession streams the file from the committed offset of the session
+// and finishes with its checksums
+func (c *ClientGRPC) sendSession(ctx context.Context, file *os.File, id string, sums *pb.Checksums) (*pb.UploadFileResponse, error) {
+	// FailFast(false) waits for the connection to come back instead of
+	// failing straight away while it reconnects
+	q, err := c.client.QueryUpload(ctx, &pb.QueryUploadRequest{SessionId: id}, grpc.FailFast(false))
+	if err != nil {
+		return nil, err
+	}
+	offset := q.CommittedOffset
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("Error seeking file to offset %d: %v", offset, err)
+	}
+
+	stream, err := c.client.UploadFile(ctx, grpc.FailFast(false))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, c.chunkSize)
+	for done := false; !done; {
+		n, err := file.Read(buf)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("Error copying from file to buf: %v", err)
+		}
+		req := &pb.UploadFileRequest{
+			SessionId: id,
+			Offset:    offset,
+			Chunk:     &pb.Chunk{Content: buf[:n]},
+		}
+		if done = err == io.EOF; done {
+			req.Checksums = sums
+		}
+
+		err = stream.Send(req)
+		if err == io.EOF {
+			// the stream was closed by the server, the cause is in its status
+			_, err = stream.CloseAndRecv()
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+	}
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+	if res.Code != pb.UploadStatusCode_Ok {
+		return nil, fmt.Errorf("upload failed - msg: %s", res.Message)
+	}
+
+	return res, nil
+}
+
+// retryable reports whether an upload can be resumed after err
+func retryable(err error) bool {
+	switch grpcstatus.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// backoff doubles the wait after each failed attempt, up to 30 seconds
+func backoff(attempt int) time.Duration {
+	d := time.Second << uint(attempt)
+	if d <= 0 || d > 30*time.Second {
+		return 30 * time.Second
+	}
+	return d
+}
+
 // DeleteFile from storage bucket
 func (c *ClientGRPC) DeleteFile(ctx context.Context, req *pb.DeleteFileRequest) (*pb.DeleteFileResponse, error) {
 	res, err := c.client.DeleteFile(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, rpcError(err)
+	}
+
+	return res, nil
+}
+
+// DownloadFile from storage bucket to the local path in the request
+// A partially written file is removed if the download fails
+func (c *ClientGRPC) DownloadFile(ctx context.Context, req *pb.DownloadFileRequest) (err error) {
+	if req.File.Path == "" {
+		return fmt.Errorf("File path to download to cannot be an empty string")
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = int32(c.chunkSize)
+	}
+
+	stream, err := c.client.DownloadFile(ctx, req)
+	if err != nil {
+		return rpcError(err)
+	}
+
+	// the data is staged next to the destination and renamed over it once
+	// the whole file arrived, so a failed download leaves any existing file
+	file, err := ioutil.TempFile(filepath.Dir(req.File.Path), "."+filepath.Base(req.File.Path)+".")
+	if err != nil {
+		return fmt.Errorf("Error creating file: %v", err)
+	}
+	defer func(f *os.File) {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), req.File.Path)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}(file)
+	if err := file.Chmod(0644); err != nil {
+		return fmt.Errorf("Error creating file: %v", err)
+	}
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return rpcError(err)
+		}
+		if _, err := file.Write(chunk.Content); err != nil {
+			return fmt.Errorf("Error writing chunk to file: %v", err)
+		}
+	}
+}
+
+// ListFiles returns one page of files in a storage bucket
+// Pass NextPageToken back as PageToken to fetch the following page
+func (c *ClientGRPC) ListFiles(ctx context.Context, req *pb.ListFilesRequest) (*pb.ListFilesResponse, error) {
+	res, err := c.client.ListFiles(ctx, req)
+	if err != nil {
+		return nil, rpcError(err)
 	}
 
 	return res, nil
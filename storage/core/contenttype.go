@@ -0,0 +1,51 @@
+package core
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen is how much content http.DetectContentType looks at
+const sniffLen = 512
+
+// audioTypes are checked before the system MIME tables, which often lack
+// audio formats or disagree on them
+var audioTypes = map[string]string{
+	".aac":  "audio/aac",
+	".aif":  "audio/aiff",
+	".aiff": "audio/aiff",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/opus",
+	".wav":  "audio/wav",
+	".weba": "audio/webm",
+}
+
+// detectContentType picks a content type from the file extension, falling
+// back to the leading bytes of the content
+func detectContentType(name string, head []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ct, ok := audioTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	if len(head) == 0 {
+		return "application/octet-stream"
+	}
+	// http.DetectContentType knows mp3, wav, aiff and ogg but not flac
+	if bytes.HasPrefix(head, []byte("fLaC")) {
+		return "audio/flac"
+	}
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	return http.DetectContentType(head)
+}
@@ -0,0 +1,249 @@
+package core
+
+import (
+	"context"
+	"errors"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Precondition violation types sent in PreconditionFailure details
+const (
+	ViolationBucketNotEmpty = "BUCKET_NOT_EMPTY"
+	ViolationGeneration     = "GENERATION_MISMATCH"
+)
+
+// Resource types sent in ResourceInfo details
+const (
+	ResourceBucket = "bucket"
+	ResourceFile   = "file"
+)
+
+// statusError translates a backend error into a status, describing the
+// bucket or file it concerns in the details
+// Errors that already carry a status are returned unchanged
+func statusError(err error, bucket, name string) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	file := bucket + "/" + name
+	var nerr *backend.NameError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, backend.ErrBucketNotExist):
+		return withDetails(status.Newf(codes.NotFound, "Bucket %s does not exist", bucket),
+			resourceInfo(ResourceBucket, bucket))
+	case errors.Is(err, backend.ErrObjectNotExist):
+		return withDetails(status.Newf(codes.NotFound, "File %s does not exist", name),
+			resourceInfo(ResourceFile, file))
+	case errors.Is(err, backend.ErrBucketExist), errors.Is(err, backend.ErrBucketOwned):
+		return withDetails(status.Newf(codes.AlreadyExists, "Bucket %s already exists", bucket),
+			resourceInfo(ResourceBucket, bucket))
+	case errors.Is(err, backend.ErrBucketNotEmpty):
+		return withDetails(status.Newf(codes.FailedPrecondition, "Bucket %s is not empty", bucket),
+			preconditionFailure(ViolationBucketNotEmpty, bucket, "Delete the files first or force the delete"))
+	case errors.Is(err, backend.ErrPreconditionFailed):
+		return withDetails(status.Newf(codes.FailedPrecondition, "File %s does not match if_generation_match", name),
+			preconditionFailure(ViolationGeneration, file, "The live generation differs from the one required"))
+	case errors.Is(err, backend.ErrPermissionDenied):
+		subject, info := bucket, resourceInfo(ResourceBucket, bucket)
+		if name != "" {
+			subject, info = file, resourceInfo(ResourceFile, file)
+		}
+		return withDetails(status.Newf(codes.PermissionDenied, "Backend denied access to %s", subject), info)
+	case errors.Is(err, backend.ErrQuotaExceeded):
+		return withDetails(status.Newf(codes.ResourceExhausted, "Backend quota exceeded for bucket %s", bucket),
+			&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+				Subject:     bucket,
+				Description: err.Error(),
+			}}})
+	case errors.Is(err, backend.ErrInvalidRange):
+		return status.Errorf(codes.OutOfRange, "Range is beyond the end of %s", name)
+	case errors.Is(err, backend.ErrNotSupported):
+		return status.Errorf(codes.Unimplemented, "Operation is %v", err)
+	case errors.As(err, &nerr):
+		return status.Errorf(codes.InvalidArgument, "Name %q is not a valid %s name", nerr.Name, nerr.Kind)
+	case errors.Is(err, backend.ErrStorageClassNotSupported):
+		return status.Errorf(codes.InvalidArgument, "Storage class of bucket %s is %v", bucket, err)
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+func resourceInfo(typ, name string) *errdetails.ResourceInfo {
+	return &errdetails.ResourceInfo{ResourceType: typ, ResourceName: name}
+}
+
+func preconditionFailure(typ, subject, description string) *errdetails.PreconditionFailure {
+	return &errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{{
+		Type:        typ,
+		Subject:     subject,
+		Description: description,
+	}}}
+}
+
+// withDetails attaches details to st, falling back to st alone when they
+// cannot be marshalled
+func withDetails(st *status.Status, details ...proto.Message) error {
+	if ds, err := st.WithDetails(details...); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+// resourceNames returns the bucket and file a request concerns, for
+// errors its handler returned without a status
+func resourceNames(req interface{}) (bucket, name string) {
+	if r, ok := req.(interface{ GetBucket() *pb.Bucket }); ok {
+		bucket = r.GetBucket().GetName()
+	}
+	if r, ok := req.(interface{ GetFile() *pb.File }); ok {
+		name = r.GetFile().GetName()
+	}
+	if r, ok := req.(interface{ GetSourceBucket() *pb.Bucket }); ok {
+		bucket = r.GetSourceBucket().GetName()
+	}
+	if r, ok := req.(interface{ GetSourceFile() *pb.File }); ok {
+		name = r.GetSourceFile().GetName()
+	}
+	return bucket, name
+}
+
+// statusUnary translates the errors unary handlers return
+func statusUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	res, err := handler(ctx, req)
+	if err != nil {
+		bucket, name := resourceNames(req)
+		return nil, statusError(err, bucket, name)
+	}
+	return res, nil
+}
+
+// statusStream translates the errors streaming handlers return, naming the
+// bucket and file of the first message
+func statusStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	rs := &recordingStream{ServerStream: ss}
+	if err := handler(srv, rs); err != nil {
+		bucket, name := resourceNames(rs.first)
+		return statusError(err, bucket, name)
+	}
+	return nil
+}
+
+// recordingStream keeps the first message received on a stream
+type recordingStream struct {
+	grpc.ServerStream
+	first interface{}
+}
+
+func (s *recordingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.first == nil {
+		s.first = m
+	}
+	return err
+}
+
+// Errors returned by ClientGRPC match these with errors.Is
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrAlreadyExists      = errors.New("already exists")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrBucketNotEmpty     = errors.New("bucket is not empty")
+	ErrPermissionDenied   = errors.New("permission denied")
+	ErrUnauthenticated    = errors.New("unauthenticated")
+	ErrQuotaExceeded      = errors.New("quota exceeded")
+	ErrInvalidArgument    = errors.New("invalid argument")
+	ErrUnimplemented      = errors.New("not implemented")
+	ErrUnavailable        = errors.New("unavailable")
+)
+
+// Error is an RPC the server failed
+// Resource is the bucket or file the server said the error concerns, and
+// Violation the type of a failed precondition
+type Error struct {
+	Code      codes.Code
+	Message   string
+	Resource  string
+	Violation string
+
+	kind   error
+	status *status.Status
+}
+
+func (e *Error) Error() string {
+	return e.Code.String() + ": " + e.Message
+}
+
+// Unwrap returns the Err value matching the error, if any
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// GRPCStatus keeps status.Code and status.FromError working on the error
+func (e *Error) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// rpcError turns the status of a failed RPC into an Error, other errors
+// are returned unchanged
+func rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	e := &Error{Code: st.Code(), Message: st.Message(), status: st}
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.ResourceInfo:
+			e.Resource = d.ResourceName
+		case *errdetails.PreconditionFailure:
+			if len(d.Violations) > 0 {
+				e.Violation, e.Resource = d.Violations[0].Type, d.Violations[0].Subject
+			}
+		case *errdetails.QuotaFailure:
+			if len(d.Violations) > 0 {
+				e.Resource = d.Violations[0].Subject
+			}
+		}
+	}
+
+	switch e.Code {
+	case codes.NotFound:
+		e.kind = ErrNotFound
+	case codes.AlreadyExists:
+		e.kind = ErrAlreadyExists
+	case codes.FailedPrecondition:
+		e.kind = ErrPreconditionFailed
+		if e.Violation == ViolationBucketNotEmpty {
+			e.kind = ErrBucketNotEmpty
+		}
+	case codes.PermissionDenied:
+		e.kind = ErrPermissionDenied
+	case codes.Unauthenticated:
+		e.kind = ErrUnauthenticated
+	case codes.ResourceExhausted:
+		e.kind = ErrQuotaExceeded
+	case codes.InvalidArgument, codes.OutOfRange:
+		e.kind = ErrInvalidArgument
+	case codes.Unimplemented:
+		e.kind = ErrUnimplemented
+	case codes.Unavailable:
+		e.kind = ErrUnavailable
+	}
+	return e
+}
@@ -0,0 +1,487 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// gatewayChunkSize is the size of the chunks an HTTP upload is streamed in
+	gatewayChunkSize = 1 << 18
+	// maxJSONBody bounds the JSON request bodies the gateway reads
+	maxJSONBody = 1 << 20
+)
+
+// Gateway serves a REST/JSON API by calling the Storage service over gRPC,
+// so every request passes through the same server as gRPC clients
+//
+//	GET    /v1/projects/{project}/buckets
+//	POST   /v1/projects/{project}/buckets                  Bucket as JSON
+//	DELETE /v1/projects/{project}/buckets/{bucket}?force=true
+//	POST   /v1/projects/{project}/buckets/{bucket}/files   multipart/form-data
+//	DELETE /v1/projects/{project}/buckets/{bucket}/files/{file}
+type Gateway struct {
+	conn   *grpc.ClientConn
+	client pb.StorageClient
+	server *http.Server
+	port   int
+	routes []gatewayRoute
+}
+
+// GatewayConfig for the gateway
+// Address is the gRPC server requests are forwarded to
+// TLS serves the gateway over HTTPS, UpstreamTLS dials Address over TLS
+type GatewayConfig struct {
+	Port        int
+	Address     string
+	TLS         *TLSConfig
+	UpstreamTLS *TLSConfig
+}
+
+// NewGateway creates a gateway forwarding to the gRPC server at cfg.Address
+func NewGateway(cfg GatewayConfig) (*Gateway, error) {
+	if cfg.Port == 0 {
+		return nil, errors.New("Port must be specified")
+	}
+	if cfg.Address == "" {
+		return nil, errors.New("Address must be specified")
+	}
+	dialOpt := grpc.WithInsecure()
+	if cfg.UpstreamTLS != nil {
+		tlsCfg, err := cfg.UpstreamTLS.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg))
+	}
+	var serverTLS *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		if serverTLS, err = cfg.TLS.serverConfig(false); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := grpc.Dial(cfg.Address, dialOpt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to start grpc connection with address: %s", cfg.Address)
+	}
+	g := newGateway(pb.NewStorageClient(conn))
+	g.conn = conn
+	g.port = cfg.Port
+	g.server.TLSConfig = serverTLS
+	return g, nil
+}
+
+func newGateway(client pb.StorageClient) *Gateway {
+	g := &Gateway{client: client}
+	g.routes = []gatewayRoute{
+		{http.MethodGet, "/v1/projects/{project}/buckets", g.listBuckets},
+		{http.MethodPost, "/v1/projects/{project}/buckets", g.createBucket},
+		{http.MethodDelete, "/v1/projects/{project}/buckets/{bucket}", g.deleteBucket},
+		{http.MethodPost, "/v1/projects/{project}/buckets/{bucket}/files", g.uploadFile},
+		{http.MethodDelete, "/v1/projects/{project}/buckets/{bucket}/files/{file...}", g.deleteFile},
+	}
+	g.server = &http.Server{Handler: g}
+	return g
+}
+
+// gatewayRoute sends requests whose method and path match to handler
+// In pattern "{name}" matches one path segment and "{name...}" the rest of
+// the path, the handler gets their values by name
+type gatewayRoute struct {
+	method  string
+	pattern string
+	handler gatewayHandler
+}
+
+// gatewayHandler serves a request with the path values of its route
+type gatewayHandler func(w http.ResponseWriter, r *http.Request, vars map[string]string)
+
+// match returns the wildcard values of path, if it matches the pattern
+func (rt gatewayRoute) match(path string) (map[string]string, bool) {
+	want := strings.Split(strings.TrimPrefix(rt.pattern, "/"), "/")
+	got := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	values := map[string]string{}
+	for i, seg := range want {
+		if strings.HasSuffix(seg, "...}") {
+			if i > len(got) {
+				return nil, false
+			}
+			values[strings.TrimSuffix(seg[1:], "...}")] = strings.Join(got[i:], "/")
+			return values, true
+		}
+		if i >= len(got) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, "{") {
+			if got[i] == "" {
+				return nil, false
+			}
+			values[strings.TrimSuffix(seg[1:], "}")] = got[i]
+		} else if seg != got[i] {
+			return nil, false
+		}
+	}
+	return values, len(got) == len(want)
+}
+
+// ServeHTTP routes a request to the matching RPC
+// A path served for other methods only is answered with 405 and Allow
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var allow []string
+	for _, rt := range g.routes {
+		values, ok := rt.match(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method {
+			allow = append(allow, rt.method)
+			continue
+		}
+		rt.handler(w, r, values)
+		return
+	}
+	if len(allow) > 0 {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Listen serves the gateway until Close is called
+func (g *Gateway) Listen() error {
+	lis, err := net.Listen("tcp", ":"+strconv.Itoa(g.port))
+	if err != nil {
+		return fmt.Errorf("Failed to listen: %v", err)
+	}
+	fmt.Printf("Gateway listening on port: %v\n", g.port)
+	if g.server.TLSConfig != nil {
+		lis = tls.NewListener(lis, g.server.TLSConfig)
+	}
+	if err := g.server.Serve(lis); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("Failed to serve: %v", err)
+	}
+	return nil
+}
+
+// Close stops the gateway and its connection to the gRPC server
+func (g *Gateway) Close() {
+	g.server.Close()
+	if g.conn != nil {
+		g.conn.Close()
+	}
+}
+
+// Shutdown stops accepting requests and waits for those in flight to finish
+// before closing the connection to the gRPC server, or until ctx is done
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	err := g.server.Shutdown(ctx)
+	if err != nil {
+		g.server.Close()
+	}
+	if g.conn != nil {
+		g.conn.Close()
+	}
+	return err
+}
+
+func (g *Gateway) listBuckets(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	res, err := g.client.ListBuckets(outgoingContext(r), &pb.ListBucketsRequest{
+		Project: &pb.Project{Id: vars["project"]},
+	})
+	writeResponse(w, http.StatusOK, res, err)
+}
+
+func (g *Gateway) createBucket(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	bucket := &pb.Bucket{}
+	if err := jsonpb.Unmarshal(io.LimitReader(r.Body, maxJSONBody), bucket); err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "Invalid bucket: %v", err))
+		return
+	}
+	res, err := g.client.Create(outgoingContext(r), &pb.CreateRequest{
+		Project: &pb.Project{Id: vars["project"]},
+		Bucket:  bucket,
+	})
+	writeResponse(w, http.StatusCreated, res, err)
+}
+
+func (g *Gateway) deleteBucket(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	force, err := queryBool(r, "force")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := g.client.Delete(outgoingContext(r), &pb.DeleteRequest{
+		Project: &pb.Project{Id: vars["project"]},
+		Bucket:  &pb.Bucket{Name: vars["bucket"]},
+		Force:   force,
+	})
+	writeResponse(w, http.StatusOK, res, err)
+}
+
+func (g *Gateway) deleteFile(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	gen, err := queryInt(r, "generation")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ifGeneration, err := queryInt64Value(r, "if_generation_match")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := g.client.DeleteFile(outgoingContext(r), &pb.DeleteFileRequest{
+		Project:           &pb.Project{Id: vars["project"]},
+		Bucket:            &pb.Bucket{Name: vars["bucket"]},
+		File:              &pb.File{Name: vars["file"], Generation: gen},
+		IfGenerationMatch: ifGeneration,
+	})
+	writeResponse(w, http.StatusOK, res, err)
+}
+
+// uploadFile streams the file part of a multipart form onto UploadFile
+// The form fields name, content_type, cache_control, content_disposition,
+// metadata (key=value, repeatable) and if_generation_match describe the
+// file and must come before it; name defaults to the file name of the part
+func (g *Gateway) uploadFile(w http.ResponseWriter, r *http.Request, vars map[string]string) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "Expected a multipart form: %v", err))
+		return
+	}
+	req := &pb.UploadFileRequest{
+		Project: &pb.Project{Id: vars["project"]},
+		Bucket:  &pb.Bucket{Name: vars["bucket"]},
+		File:    &pb.File{},
+	}
+	var part *multipart.Part
+	for {
+		if part, err = mr.NextPart(); err == io.EOF {
+			writeError(w, status.Errorf(codes.InvalidArgument, "Form has no file part"))
+			return
+		} else if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "Invalid multipart form: %v", err))
+			return
+		}
+		if part.FileName() != "" {
+			break
+		}
+		if err := setUploadField(req, part); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if req.File.Name == "" {
+		req.File.Name = part.FileName()
+	}
+	if req.File.ContentType == "" {
+		req.File.ContentType = part.Header.Get("Content-Type")
+	}
+	if req.File.ContentType == "application/octet-stream" {
+		// browsers send this for types they do not know, let the server detect it
+		req.File.ContentType = ""
+	}
+
+	res, err := g.streamUpload(outgoingContext(r), req, part)
+	if err == nil && res.Code != pb.UploadStatusCode_Ok {
+		err = status.Errorf(codes.Internal, "%s", res.Message)
+	}
+	writeResponse(w, http.StatusCreated, res, err)
+}
+
+// setUploadField copies a form field into the upload request
+func setUploadField(req *pb.UploadFileRequest, part *multipart.Part) error {
+	data, err := ioutil.ReadAll(io.LimitReader(part, maxJSONBody))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid multipart form: %v", err)
+	}
+	value := string(data)
+	switch part.FormName() {
+	case "name":
+		req.File.Name = value
+	case "content_type":
+		req.File.ContentType = value
+	case "cache_control":
+		req.File.CacheControl = value
+	case "content_disposition":
+		req.File.ContentDisposition = value
+	case "metadata":
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return status.Errorf(codes.InvalidArgument, "Expected key=value, got: %s", value)
+		}
+		if req.File.Metadata == nil {
+			req.File.Metadata = map[string]string{}
+		}
+		req.File.Metadata[kv[0]] = kv[1]
+	case "if_generation_match":
+		gen, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid if_generation_match: %s", value)
+		}
+		req.IfGenerationMatch = &wrappers.Int64Value{Value: gen}
+	default:
+		return status.Errorf(codes.InvalidArgument, "Unknown form field: %s", part.FormName())
+	}
+	return nil
+}
+
+// streamUpload sends the request with the content of r in chunks, then the
+// checksums of everything sent
+func (g *Gateway) streamUpload(ctx context.Context, req *pb.UploadFileRequest, r io.Reader) (*pb.UploadFileResponse, error) {
+	stream, err := g.client.UploadFile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	digest := backend.NewDigest()
+	buf := make([]byte, gatewayChunkSize)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			stream.CloseSend()
+			return nil, status.Errorf(codes.Aborted, "Failed reading upload: %v", err)
+		}
+		if n == 0 && !first {
+			break
+		}
+		digest.Write(buf[:n])
+		req.Chunk = &pb.Chunk{Content: buf[:n]}
+		if serr := stream.Send(req); serr != nil {
+			// the server ended the stream, its status is returned by CloseAndRecv
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	req.Chunk = &pb.Chunk{}
+	req.Checksums = &pb.Checksums{Crc32C: digest.CRC32C(), Md5Hash: digest.MD5()}
+	stream.Send(req)
+	return stream.CloseAndRecv()
+}
+
+// outgoingContext forwards the credentials of the HTTP request to the RPC
+func outgoingContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+	}
+	return ctx
+}
+
+func queryBool(r *http.Request, key string) (bool, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "Invalid %s: %s", key, v)
+	}
+	return b, nil
+}
+
+func queryInt(r *http.Request, key string) (int64, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "Invalid %s: %s", key, v)
+	}
+	return n, nil
+}
+
+// queryInt64Value is nil when the parameter is absent, as 0 is a value
+func queryInt64Value(r *http.Request, key string) (*wrappers.Int64Value, error) {
+	if _, ok := r.URL.Query()[key]; !ok {
+		return nil, nil
+	}
+	n, err := queryInt(r, key)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappers.Int64Value{Value: n}, nil
+}
+
+// writeResponse writes res as JSON, or err as an error response
+func writeResponse(w http.ResponseWriter, code int, res proto.Message, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	m := jsonpb.Marshaler{OrigName: true}
+	if err := m.Marshal(&buf, res); err != nil {
+		writeError(w, status.Errorf(codes.Internal, "Failed to encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	buf.WriteTo(w)
+}
+
+// writeError writes the status of a failed RPC as a JSON error
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	json.NewEncoder(w).Encode(struct {
+		Code    int32  `json:"code"`
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}{int32(st.Code()), st.Code().String(), st.Message()})
+}
+
+// httpStatusFromCode maps gRPC codes to HTTP statuses as grpc-gateway does
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,119 @@
+package core_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/evanharmon/eph-music-micro/storage/core"
+)
+
+// newTestGateway serves the provider over gRPC on a local port and returns
+// a test server for a gateway forwarding to it
+func newTestGateway(t *testing.T, s *core.ProviderGRPC) *httptest.Server {
+	t.Helper()
+	g, err := core.NewGateway(core.GatewayConfig{Port: testPort, Address: serveTestProvider(t, s)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	ts := httptest.NewServer(g)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestGateway(t *testing.T) {
+	s := newTestProvider(t)
+	ts := newTestGateway(t, s)
+	buckets := ts.URL + "/v1/projects/" + testProject + "/buckets"
+
+	t.Run("POST should create a bucket", func(t *testing.T) {
+		res := httpTestDo(t, http.MethodPost, buckets, `{"name": "`+testBucket+`", "class": "NEARLINE"}`, nil)
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("POST = %d %s", res.StatusCode, res.body)
+		}
+	})
+	t.Run("GET should list buckets", func(t *testing.T) {
+		res := httpTestGet(t, buckets, nil)
+		var list struct {
+			Buckets []struct {
+				Name  string `json:"name"`
+				Class string `json:"class"`
+			} `json:"buckets"`
+		}
+		if err := json.Unmarshal([]byte(res.body), &list); err != nil {
+			t.Fatalf("GET returned %s: %v", res.body, err)
+		}
+		if len(list.Buckets) != 1 || list.Buckets[0].Name != testBucket || list.Buckets[0].Class != "NEARLINE" {
+			t.Errorf("GET returned %s", res.body)
+		}
+	})
+	t.Run("Multipart upload should stream the file", func(t *testing.T) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("name", "artist/demo.flac")
+		mw.WriteField("metadata", "artist=eph")
+		fw, err := mw.CreateFormFile("file", "demo.flac")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := strings.Repeat("fLaC", 100000)
+		fw.Write([]byte(content))
+		mw.Close()
+
+		res := httpTestDo(t, http.MethodPost, buckets+"/"+testBucket+"/files", body.String(),
+			map[string]string{"Content-Type": mw.FormDataContentType()})
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("POST = %d %s", res.StatusCode, res.body)
+		}
+		f := statTestFile(t, s, testBucket, "artist/demo.flac")
+		if f.Size != int64(len(content)) || f.ContentType != "audio/flac" || f.Metadata["artist"] != "eph" {
+			t.Errorf("Uploaded file = %v", f)
+		}
+	})
+
+	// run in order, as each depends on the files left by the last
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		{"Delete of a non-empty bucket", http.MethodDelete, "/" + testBucket, http.StatusBadRequest},
+		{"Delete of a missing file", http.MethodDelete, "/" + testBucket + "/files/missing.flac", http.StatusNotFound},
+		{"Delete with a stale generation", http.MethodDelete, "/" + testBucket + "/files/artist/demo.flac?if_generation_match=1", http.StatusBadRequest},
+		{"Delete of a file", http.MethodDelete, "/" + testBucket + "/files/artist/demo.flac", http.StatusOK},
+		{"Unknown route", http.MethodGet, "/" + testBucket + "/files", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name+" should return "+strconv.Itoa(tc.code), func(t *testing.T) {
+			if res := httpTestDo(t, tc.method, buckets+tc.path, "", nil); res.StatusCode != tc.code {
+				t.Errorf("%s %s = %d %s, want %d", tc.method, tc.path, res.StatusCode, res.body, tc.code)
+			}
+		})
+	}
+
+	t.Run("DELETE should delete the bucket", func(t *testing.T) {
+		if res := httpTestDo(t, http.MethodDelete, buckets+"/"+testBucket+"?force=true", "", nil); res.StatusCode != http.StatusOK {
+			t.Errorf("DELETE = %d %s", res.StatusCode, res.body)
+		}
+	})
+}
+
+// serveTestProvider serves s on an ephemeral port until the test ends
+func serveTestProvider(t *testing.T, s *core.ProviderGRPC) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(s.Close)
+	return lis.Addr().String()
+}
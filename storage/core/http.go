@@ -0,0 +1,195 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+)
+
+// ServeHTTP serves objects at /<bucket>/<object> to holders of a URL from
+// SignURL: GET and HEAD download the object and PUT uploads it
+// Downloads support ranges and conditional requests so browsers can seek
+// and cache; the CORS rules of the bucket apply to every request
+func (s *ProviderGRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, name, ok := splitObjectPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodOptions {
+		s.preflight(w, r, bucket)
+		return
+	}
+
+	method := r.Method
+	switch method {
+	case http.MethodGet, http.MethodPut:
+	case http.MethodHead:
+		// a URL signed for GET may also be used for HEAD
+		method = http.MethodGet
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, OPTIONS")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.allowOrigin(w, r, bucket, method)
+	if s.signer == nil {
+		http.Error(w, "Signed URLs are not enabled", http.StatusNotFound)
+		return
+	}
+	if err := s.signer.verify(r, method, bucket, name); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if method == http.MethodPut {
+		s.putObject(w, r, bucket, name)
+		return
+	}
+	s.getObject(w, r, bucket, name)
+}
+
+func (s *ProviderGRPC) getObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	obj := s.backend.Bucket(bucket).Object(name)
+	attrs, err := obj.Attrs(r.Context())
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	h := w.Header()
+	setValidators(h, attrs)
+	h.Set("Accept-Ranges", "bytes")
+	if code := checkPreconditions(r, attrs); code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+
+	offset, length := int64(0), attrs.Size
+	code := http.StatusOK
+	if rng, ok := requestRange(r, attrs); ok {
+		var err error
+		if offset, length, err = parseRange(rng, attrs.Size); err == errRangeNotSatisfiable {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", attrs.Size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		} else if err == nil {
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, attrs.Size))
+			code = http.StatusPartialContent
+		} else {
+			// a range this handler does not understand is ignored
+			offset, length = 0, attrs.Size
+		}
+	}
+
+	// read the generation just looked up, not one written since
+	if attrs.Generation != 0 {
+		obj = obj.Generation(attrs.Generation)
+	}
+	var rc io.ReadCloser
+	if length > 0 {
+		if rc, err = obj.NewRangeReader(r.Context(), offset, length); err != nil {
+			httpError(w, err)
+			return
+		}
+		defer rc.Close()
+	}
+
+	h.Set("Content-Type", attrs.ContentType)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if attrs.CacheControl != "" {
+		h.Set("Cache-Control", attrs.CacheControl)
+	}
+	if attrs.ContentDisposition != "" {
+		h.Set("Content-Disposition", attrs.ContentDisposition)
+	}
+	w.WriteHeader(code)
+	if r.Method == http.MethodHead || rc == nil {
+		return
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Printf("Failed to send %s/%s: %v", bucket, name, err)
+	}
+}
+
+func (s *ProviderGRPC) putObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	if err := backend.ValidateObjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	obj := s.backend.Bucket(bucket).Object(name)
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" ||
+		r.Header.Get("If-Unmodified-Since") != "" {
+		live, err := obj.Attrs(r.Context())
+		if err == backend.ErrObjectNotExist {
+			live = nil
+		} else if err != nil {
+			httpError(w, err)
+			return
+		}
+		if code := checkPreconditions(r, live); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		// the write only goes ahead if the object is still the one checked
+		obj = obj.If(liveConditions(live))
+	}
+
+	// the head of the body is only needed to detect a missing content type
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	head = head[:n]
+	attrs := writerAttrs(&pb.File{
+		Name:               name,
+		ContentType:        r.Header.Get("Content-Type"),
+		CacheControl:       r.Header.Get("Cache-Control"),
+		ContentDisposition: r.Header.Get("Content-Disposition"),
+	}, head)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	wc := obj.NewWriter(ctx, attrs)
+	if _, err := io.Copy(wc, io.MultiReader(bytes.NewReader(head), r.Body)); err != nil {
+		// cancelling before Close aborts the object so it is never committed
+		cancel()
+		wc.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := wc.Close(); err != nil {
+		httpError(w, err)
+		return
+	}
+	if stored, err := s.backend.Bucket(bucket).Object(name).Attrs(r.Context()); err == nil {
+		setValidators(w.Header(), stored)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// httpError writes the status matching a backend error
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err {
+	case backend.ErrBucketNotExist, backend.ErrObjectNotExist:
+		code = http.StatusNotFound
+	case backend.ErrInvalidRange:
+		code = http.StatusRequestedRangeNotSatisfiable
+	case backend.ErrPreconditionFailed:
+		code = http.StatusPreconditionFailed
+	case backend.ErrNotSupported:
+		code = http.StatusNotImplemented
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+)
+
+var (
+	// errRangeNotSatisfiable is returned for a range outside the object
+	errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+	// errRangeUnsupported is returned for ranges that are served as a whole,
+	// such as multiple ranges or invalid syntax
+	errRangeUnsupported = errors.New("unsupported range")
+)
+
+// etag is the MD5 of the content, as GCS and S3 report it for simple
+// uploads, or the generation when the backend has no MD5
+func etag(attrs *backend.ObjectAttrs) string {
+	switch {
+	case len(attrs.MD5) > 0:
+		return `"` + hex.EncodeToString(attrs.MD5) + `"`
+	case attrs.Generation != 0:
+		return `"` + strconv.FormatInt(attrs.Generation, 10) + `"`
+	}
+	return ""
+}
+
+// lastModified is the update time at the resolution of HTTP dates
+func lastModified(attrs *backend.ObjectAttrs) time.Time {
+	return attrs.Updated.UTC().Truncate(time.Second)
+}
+
+// setValidators sets the ETag and Last-Modified headers of an object
+func setValidators(h http.Header, attrs *backend.ObjectAttrs) {
+	if tag := etag(attrs); tag != "" {
+		h.Set("ETag", tag)
+	}
+	if !attrs.Updated.IsZero() {
+		h.Set("Last-Modified", lastModified(attrs).Format(http.TimeFormat))
+	}
+}
+
+// checkPreconditions evaluates the conditional headers of r in the order
+// RFC 7232 gives, for the object attrs or nil when it does not exist
+// It returns the status to respond with instead, or 0 to go ahead
+func checkPreconditions(r *http.Request, attrs *backend.ObjectAttrs) int {
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	var tag string
+	if attrs != nil {
+		tag = etag(attrs)
+	}
+
+	if im := r.Header.Get("If-Match"); im != "" {
+		if attrs == nil || !matchETag(im, tag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && attrs != nil {
+		if lastModified(attrs).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if attrs != nil && matchETag(inm, tag, true) {
+			if read {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && read && attrs != nil {
+		if !lastModified(attrs).After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// matchETag reports whether a list of entity tags in a header matches the
+// tag of an existing object
+// Weak comparison ignores the W/ prefix, strong comparison never matches it
+func matchETag(header, tag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if tag != "" && candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRange returns the Range header of r, unless an If-Range header
+// shows the client holds a different version of the object
+func requestRange(r *http.Request, attrs *backend.ObjectAttrs) (string, bool) {
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		return "", false
+	}
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return rng, true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return rng, ir == etag(attrs)
+	}
+	t, err := http.ParseTime(ir)
+	return rng, err == nil && lastModified(attrs).Equal(t)
+}
+
+// parseRange parses a single byte range against an object of size bytes
+func parseRange(rng string, size int64) (offset, length int64, err error) {
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return 0, 0, errRangeUnsupported
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(rng, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, errRangeUnsupported
+	}
+	first, last := spec[:i], spec[i+1:]
+
+	if first == "" {
+		// a suffix range asks for the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errRangeUnsupported
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errRangeUnsupported
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, errRangeUnsupported
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, nil
+}
+
+// liveConditions make a write depend on the object still being live, or
+// still missing when live is nil
+func liveConditions(live *backend.ObjectAttrs) backend.Conditions {
+	switch {
+	case live == nil:
+		return backend.Conditions{DoesNotExist: true}
+	case live.Generation != 0:
+		return backend.Conditions{GenerationMatch: live.Generation}
+	}
+	return backend.Conditions{}
+}
+
+// allowOrigin sets the CORS headers when a rule of the bucket allows the
+// origin of r to use method, and returns that rule
+func (s *ProviderGRPC) allowOrigin(w http.ResponseWriter, r *http.Request, bucket, method string) *backend.CORS {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	attrs, err := s.backend.Bucket(bucket).Attrs(r.Context())
+	if err != nil {
+		return nil
+	}
+	rule := matchCORS(attrs.CORS, origin, method)
+	if rule == nil {
+		return nil
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if len(rule.ResponseHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(rule.ResponseHeaders, ", "))
+	}
+	return rule
+}
+
+// preflight answers the OPTIONS request a browser sends before a
+// cross-origin request, which carries no signature
+func (s *ProviderGRPC) preflight(w http.ResponseWriter, r *http.Request, bucket string) {
+	rule := s.allowOrigin(w, r, bucket, r.Header.Get("Access-Control-Request-Method"))
+	if rule == nil {
+		http.Error(w, "CORS request not allowed", http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Methods", strings.Join(rule.Methods, ", "))
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	if rule.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.FormatInt(int64(rule.MaxAge/time.Second), 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// matchCORS returns the first rule allowing method from origin
+func matchCORS(rules []backend.CORS, origin, method string) *backend.CORS {
+	for i, rule := range rules {
+		if listed(rule.Origins, origin) && listed(rule.Methods, method) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// listed reports whether values holds s, or the wildcard *
+func listed(values []string, s string) bool {
+	for _, v := range values {
+		if v == "*" || strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
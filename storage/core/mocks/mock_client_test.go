@@ -9,8 +9,8 @@ import (
 
 	"github.com/evanharmon/eph-music-micro/storage/core/mocks"
 	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
-	"github.com/gogo/protobuf/proto"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
 )
 
 const (
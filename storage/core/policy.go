@@ -0,0 +1,410 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Actions a policy rule can allow
+// list also covers reading: bucket settings, file metadata, downloads and
+// signed GET URLs; create also covers changing bucket settings
+const (
+	actionList       = "list"
+	actionCreate     = "create"
+	actionDelete     = "delete"
+	actionUpload     = "upload"
+	actionDeleteFile = "delete-file"
+)
+
+var policyActions = []string{actionList, actionCreate, actionDelete, actionUpload, actionDeleteFile}
+
+// policy lists what principals may do, a request is allowed when any rule
+// allows it and denied otherwise
+//
+//	rules:
+//	  - principals: [label-admin]
+//	    projects: [eph-music]
+//	    actions: [list, create, delete, upload, delete-file]
+//	  - principals: ["*"]
+//	    projects: [eph-music]
+//	    buckets: [masters]
+//	    prefixes: ["artist/{principal}/"]
+//	    actions: [list, upload, delete-file]
+type policy struct {
+	Rules []policyRule `yaml:"rules" json:"rules"`
+}
+
+// policyRule allows its principals the actions on its projects
+// "*" matches any principal or project; Buckets, when set, limits the rule
+// to those buckets and Prefixes to the files under them, with {principal}
+// replaced by the caller's name
+// A rule limited to buckets never allows project wide requests like
+// ListBuckets, and one limited to prefixes never allows bucket wide ones
+// The authorizer checks that buckets belong to the project a request names,
+// so a rule for a project never reaches the buckets of another
+type policyRule struct {
+	Principals []string `yaml:"principals" json:"principals"`
+	Projects   []string `yaml:"projects" json:"projects"`
+	Buckets    []string `yaml:"buckets" json:"buckets"`
+	Prefixes   []string `yaml:"prefixes" json:"prefixes"`
+	Actions    []string `yaml:"actions" json:"actions"`
+}
+
+// loadPolicy reads a policy file, YAML or JSON
+func loadPolicy(file string) (*policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy: %v", err)
+	}
+	var p policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("Failed to parse policy %s: %v", file, err)
+	}
+	for i, r := range p.Rules {
+		if len(r.Principals) == 0 || len(r.Projects) == 0 || len(r.Actions) == 0 {
+			return nil, fmt.Errorf("Policy rule %d needs principals, projects and actions", i+1)
+		}
+		for _, a := range r.Actions {
+			if !hasString(policyActions, a) {
+				return nil, fmt.Errorf("Policy rule %d has unknown action %q", i+1, a)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// permission is one action a request needs
+// An empty bucket makes it project wide and an empty name bucket wide
+type permission struct {
+	action  string
+	project string
+	bucket  string
+	name    string
+}
+
+func (p permission) String() string {
+	switch {
+	case p.bucket == "":
+		return fmt.Sprintf("%s in project %s", p.action, p.project)
+	case p.name == "":
+		return fmt.Sprintf("%s on bucket %s", p.action, p.bucket)
+	}
+	return fmt.Sprintf("%s on %s/%s", p.action, p.bucket, p.name)
+}
+
+func (p *policy) allows(principal string, perm permission) bool {
+	for _, r := range p.Rules {
+		if r.allows(principal, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) allows(principal string, perm permission) bool {
+	if !hasString(r.Actions, perm.action) ||
+		!(hasString(r.Principals, "*") || hasString(r.Principals, principal)) ||
+		!(hasString(r.Projects, "*") || hasString(r.Projects, perm.project)) {
+		return false
+	}
+	if len(r.Buckets) > 0 && !hasString(r.Buckets, perm.bucket) {
+		return false
+	}
+	if len(r.Prefixes) == 0 {
+		return true
+	}
+	// backends that keep files on disk resolve dot segments, which would
+	// step out of the prefix
+	if perm.bucket == "" || hasDotSegment(perm.name) {
+		return false
+	}
+	for _, prefix := range r.Prefixes {
+		prefix = strings.Replace(prefix, "{principal}", principal, -1)
+		if prefix != "" && strings.HasPrefix(perm.name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDotSegment(name string) bool {
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// policyReloader loads the policy file again once it has a new
+// modification time
+type policyReloader struct {
+	file string
+
+	mu     sync.Mutex
+	policy *policy
+	mod    time.Time
+}
+
+func newPolicyReloader(file string) (*policyReloader, error) {
+	r := &policyReloader{file: file}
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// get returns the current policy
+// A policy that fails to load leaves the last good one in force
+func (r *policyReloader) get() (*policy, error) {
+	info, err := os.Stat(r.file)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		if r.policy != nil && info.ModTime().Equal(r.mod) {
+			return r.policy, nil
+		}
+		var p *policy
+		if p, err = loadPolicy(r.file); err == nil {
+			r.policy, r.mod = p, info.ModTime()
+			return r.policy, nil
+		}
+	}
+	if r.policy != nil {
+		log.Printf("Keeping the current policy, failed to reload %s: %v", r.file, err)
+		return r.policy, nil
+	}
+	return nil, err
+}
+
+// authorizer checks every request against the policy before its handler
+// runs, it relies on the authenticator having set the principal
+type authorizer struct {
+	policy   *policyReloader
+	sessions *sessionStore
+	backend  backend.Backend
+}
+
+// authorize returns PermissionDenied unless the policy allows every
+// permission req needs
+func (a *authorizer) authorize(ctx context.Context, req interface{}) error {
+	p, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return status.Errorf(codes.Unauthenticated, "Missing credentials")
+	}
+	perms, err := a.permissions(ctx, req)
+	if err != nil {
+		return err
+	}
+	pol, err := a.policy.get()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Policy is unavailable")
+	}
+	for _, perm := range perms {
+		if !pol.allows(p.Name, perm) {
+			return status.Errorf(codes.PermissionDenied, "%s may not %s", p.Name, perm)
+		}
+	}
+	// the project is whatever the caller sent, so it only counts once the
+	// backend confirms the bucket belongs to it
+	checked := map[string]bool{}
+	for _, perm := range perms {
+		if perm.bucket == "" || checked[perm.bucket] {
+			continue
+		}
+		checked[perm.bucket] = true
+		if err := a.inProject(ctx, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inProject fails unless the bucket of perm belongs to its project
+// Missing buckets are left to the handler, which creates or reports them
+func (a *authorizer) inProject(ctx context.Context, perm permission) error {
+	ok, err := a.backend.Bucket(perm.bucket).InProject(ctx, perm.project)
+	if err == backend.ErrBucketNotExist {
+		return nil
+	}
+	if err != nil {
+		return statusError(err, perm.bucket, "")
+	}
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "Bucket %s is not in project %s", perm.bucket, perm.project)
+	}
+	return nil
+}
+
+// permissions lists what a request needs, requests without a case are
+// denied
+func (a *authorizer) permissions(ctx context.Context, req interface{}) ([]permission, error) {
+	switch r := req.(type) {
+	case *pb.ListBucketsRequest:
+		return []permission{{actionList, r.GetProject().GetId(), "", ""}}, nil
+	case *pb.CreateRequest:
+		return []permission{{actionCreate, r.GetProject().GetId(), r.GetBucket().GetName(), ""}}, nil
+	case *pb.GetBucketRequest:
+		return []permission{{actionList, r.GetProject().GetId(), r.GetBucket().GetName(), ""}}, nil
+	case *pb.UpdateBucketRequest:
+		return []permission{{actionCreate, r.GetProject().GetId(), r.GetBucket().GetName(), ""}}, nil
+	case *pb.DeleteRequest:
+		return []permission{{actionDelete, r.GetProject().GetId(), r.GetBucket().GetName(), ""}}, nil
+	case *pb.ListFilesRequest:
+		return []permission{{actionList, r.GetProject().GetId(), r.GetBucket().GetName(), r.Prefix}}, nil
+	case *pb.StatFileRequest:
+		return []permission{{actionList, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.DownloadFileRequest:
+		return []permission{{actionList, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.ListFileVersionsRequest:
+		return []permission{{actionList, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.UploadFileRequest:
+		if r.SessionId != "" {
+			return a.sessionPermissions(ctx, r.SessionId)
+		}
+		return []permission{{actionUpload, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.StartUploadRequest:
+		return []permission{{actionUpload, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.QueryUploadRequest:
+		return a.sessionPermissions(ctx, r.SessionId)
+	case *pb.RestoreFileRequest:
+		return []permission{{actionUpload, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.DeleteFileRequest:
+		return []permission{{actionDeleteFile, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	case *pb.DeleteFilesRequest:
+		if len(r.Names) == 0 {
+			return []permission{{actionDeleteFile, r.GetProject().GetId(), r.GetBucket().GetName(), r.Prefix}}, nil
+		}
+		perms := make([]permission, len(r.Names))
+		for i, name := range r.Names {
+			perms[i] = permission{actionDeleteFile, r.GetProject().GetId(), r.GetBucket().GetName(), name}
+		}
+		return perms, nil
+	case *pb.CopyFileRequest:
+		src, dst, err := copyRefs(r.SourceBucket, r.SourceFile, r.DestinationBucket, r.DestinationFile)
+		if err != nil {
+			return nil, err
+		}
+		project := r.GetProject().GetId()
+		return []permission{
+			{actionList, project, src.bucket, src.name},
+			{actionUpload, project, dst.bucket, dst.name},
+		}, nil
+	case *pb.MoveFileRequest:
+		src, dst, err := copyRefs(r.SourceBucket, r.SourceFile, r.DestinationBucket, r.DestinationFile)
+		if err != nil {
+			return nil, err
+		}
+		project := r.GetProject().GetId()
+		return []permission{
+			{actionList, project, src.bucket, src.name},
+			{actionDeleteFile, project, src.bucket, src.name},
+			{actionUpload, project, dst.bucket, dst.name},
+		}, nil
+	case *pb.SignURLRequest:
+		action := actionList
+		if r.Method == pb.SignedMethod_PUT {
+			action = actionUpload
+		}
+		return []permission{{action, r.GetProject().GetId(), r.GetBucket().GetName(), r.GetFile().GetName()}}, nil
+	}
+	return nil, status.Errorf(codes.PermissionDenied, "No policy covers %T", req)
+}
+
+// sessionPermissions authorizes a resumable upload against the file its
+// session was started for
+func (a *authorizer) sessionPermissions(ctx context.Context, id string) ([]permission, error) {
+	if a.sessions == nil {
+		return nil, status.Errorf(codes.Unimplemented, "Resumable uploads are not enabled")
+	}
+	sess, err := getSession(ctx, a.sessions, id)
+	if err != nil {
+		return nil, err
+	}
+	return []permission{{actionUpload, sess.Project, sess.Bucket, sess.Name}}, nil
+}
+
+// unary authorizes unary RPCs
+func (a *authorizer) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := a.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// stream authorizes streaming RPCs on their first message, which names
+// the project, bucket and file for both uploads and downloads
+func (a *authorizer) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &authorizedStream{ServerStream: ss, authz: a})
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	authz *authorizer
+	done  bool
+}
+
+func (s *authorizedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.done {
+		return nil
+	}
+	if err := s.authz.authorize(s.Context(), m); err != nil {
+		return err
+	}
+	s.done = true
+	return nil
+}
+
+// chainUnary runs interceptors in order before the handler
+func chainUnary(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// chainStream runs interceptors in order before the handler
+func chainStream(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, inner)
+			}
+		}
+		return next(srv, ss)
+	}
+}
@@ -0,0 +1,263 @@
+package core_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testPolicy = `
+rules:
+  - principals: [admin]
+    projects: [eph-music]
+    actions: [list, create, delete, upload, delete-file]
+  - principals: ["*"]
+    projects: [eph-music]
+    buckets: [test-eph-music]
+    prefixes: ["artist/{principal}/"]
+    actions: [list, upload, delete-file]
+`
+
+// newPolicyProvider serves a provider whose callers authenticate with the
+// API keys key-<principal> and are bound by policy
+func newPolicyProvider(t *testing.T, policy string) (pb.StorageClient, string) {
+	t.Helper()
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keysFile, []byte("admin key-admin\njane key-jane\nbob key-bob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+		Port:       testPort,
+		Backend:    memory.New(),
+		UploadDir:  filepath.Join(dir, "uploads"),
+		Auth:       &core.AuthConfig{APIKeysFile: keysFile},
+		PolicyFile: policyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(serveTestProvider(t, s), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewStorageClient(conn), policyFile
+}
+
+func asPrincipal(name string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer key-"+name)
+}
+
+func uploadAs(name, file string, c pb.StorageClient) error {
+	stream, err := c.UploadFile(asPrincipal(name))
+	if err != nil {
+		return err
+	}
+	stream.Send(newUploadStream(testBucket, file, "hello").reqs[0])
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func TestPolicy(t *testing.T) {
+	c, policyFile := newPolicyProvider(t, testPolicy)
+	project := &pb.Project{Id: testProject}
+	bucket := &pb.Bucket{Name: testBucket}
+	file := func(name string) *pb.File { return &pb.File{Name: name} }
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"Admin should create a bucket", func() error {
+			_, err := c.Create(asPrincipal("admin"), &pb.CreateRequest{Project: project, Bucket: bucket})
+			return err
+		}, codes.OK},
+		{"Artist should not create a bucket", func() error {
+			_, err := c.Create(asPrincipal("jane"), &pb.CreateRequest{Project: project, Bucket: &pb.Bucket{Name: "jane-bucket"}})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should not list buckets", func() error {
+			_, err := c.ListBuckets(asPrincipal("jane"), &pb.ListBucketsRequest{Project: project})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should upload under their prefix", func() error {
+			return uploadAs("jane", "artist/jane/song.mp3", c)
+		}, codes.OK},
+		{"Artist should not upload under another artist's prefix", func() error {
+			return uploadAs("jane", "artist/bob/song.mp3", c)
+		}, codes.PermissionDenied},
+		{"Artist should not climb out of their prefix", func() error {
+			return uploadAs("jane", "artist/jane/../bob/song.mp3", c)
+		}, codes.PermissionDenied},
+		{"Artist should start a resumable upload under their prefix", func() error {
+			_, err := c.StartUpload(asPrincipal("jane"), &pb.StartUploadRequest{Project: project, Bucket: bucket, File: file("artist/jane/big.wav")})
+			return err
+		}, codes.OK},
+		{"Artist should list their prefix", func() error {
+			_, err := c.ListFiles(asPrincipal("jane"), &pb.ListFilesRequest{Project: project, Bucket: bucket, Prefix: "artist/jane/"})
+			return err
+		}, codes.OK},
+		{"Artist should not list the whole bucket", func() error {
+			_, err := c.ListFiles(asPrincipal("jane"), &pb.ListFilesRequest{Project: project, Bucket: bucket})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should not read another artist's file", func() error {
+			_, err := c.StatFile(asPrincipal("bob"), &pb.StatFileRequest{Project: project, Bucket: bucket, File: file("artist/jane/song.mp3")})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should not download another artist's file", func() error {
+			stream, err := c.DownloadFile(asPrincipal("bob"), &pb.DownloadFileRequest{Project: project, Bucket: bucket, File: file("artist/jane/song.mp3")})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should not copy out of their prefix", func() error {
+			_, err := c.CopyFile(asPrincipal("jane"), &pb.CopyFileRequest{Project: project, SourceBucket: bucket, SourceFile: file("artist/jane/song.mp3"), DestinationFile: file("public/song.mp3")})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should copy within their prefix", func() error {
+			_, err := c.CopyFile(asPrincipal("jane"), &pb.CopyFileRequest{Project: project, SourceBucket: bucket, SourceFile: file("artist/jane/song.mp3"), DestinationFile: file("artist/jane/copy.mp3")})
+			return err
+		}, codes.OK},
+		{"Artist should delete their own file", func() error {
+			_, err := c.DeleteFile(asPrincipal("jane"), &pb.DeleteFileRequest{Project: project, Bucket: bucket, File: file("artist/jane/copy.mp3")})
+			return err
+		}, codes.OK},
+		{"Artist should not delete files by names outside their prefix", func() error {
+			_, err := c.DeleteFiles(asPrincipal("jane"), &pb.DeleteFilesRequest{Project: project, Bucket: bucket, Names: []string{"artist/jane/song.mp3", "artist/bob/song.mp3"}})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should not delete the bucket", func() error {
+			_, err := c.Delete(asPrincipal("jane"), &pb.DeleteRequest{Project: project, Bucket: bucket, Force: true})
+			return err
+		}, codes.PermissionDenied},
+		{"Artist should not act in another project", func() error {
+			_, err := c.StatFile(asPrincipal("jane"), &pb.StatFileRequest{Project: &pb.Project{Id: "other"}, Bucket: bucket, File: file("artist/jane/song.mp3")})
+			return err
+		}, codes.PermissionDenied},
+		{"Admin should list the whole bucket", func() error {
+			_, err := c.ListFiles(asPrincipal("admin"), &pb.ListFilesRequest{Project: project, Bucket: bucket})
+			return err
+		}, codes.OK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.call(); status.Code(err) != tc.want {
+				t.Errorf("Expected %v, got %v", tc.want, err)
+			}
+		})
+	}
+
+	t.Run("Changed policy should be reloaded", func(t *testing.T) {
+		policy := testPolicy + `
+  - principals: [jane]
+    projects: [eph-music]
+    actions: [list]
+`
+		if err := ioutil.WriteFile(policyFile, []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mod := time.Now().Add(time.Minute)
+		if err := os.Chtimes(policyFile, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.ListBuckets(asPrincipal("jane"), &pb.ListBucketsRequest{Project: project}); err != nil {
+			t.Errorf("Expected the reloaded policy to allow listing, got %v", err)
+		}
+	})
+
+	t.Run("Invalid policy should keep the last good one", func(t *testing.T) {
+		if err := ioutil.WriteFile(policyFile, []byte("rules: [{principals: [jane], projects: [x], actions: [own]}]"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mod := time.Now().Add(2 * time.Minute)
+		if err := os.Chtimes(policyFile, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.ListBuckets(asPrincipal("jane"), &pb.ListBucketsRequest{Project: project}); err != nil {
+			t.Errorf("Expected the last good policy to allow listing, got %v", err)
+		}
+	})
+
+	t.Run("Policy should be rejected without auth", func(t *testing.T) {
+		_, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+			Port:       testPort,
+			Backend:    memory.New(),
+			PolicyFile: policyFile,
+		})
+		if err == nil {
+			t.Errorf("Expected an error for a policy without auth")
+		}
+	})
+}
+
+func TestPolicyBucketProject(t *testing.T) {
+	c, _ := newPolicyProvider(t, testPolicy+`
+  - principals: [bob]
+    projects: [rival-music]
+    actions: [list, create]
+`)
+	rival := &pb.Bucket{Name: "rival-masters"}
+	_, err := c.Create(asPrincipal("bob"), &pb.CreateRequest{Project: &pb.Project{Id: "rival-music"}, Bucket: rival})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// admin may do anything in eph-music, which the request claims to be in
+	_, err = c.ListFiles(asPrincipal("admin"), &pb.ListFilesRequest{Project: &pb.Project{Id: testProject}, Bucket: rival})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Bucket of another project should be denied, got %v", err)
+	}
+	_, err = c.ListFiles(asPrincipal("bob"), &pb.ListFilesRequest{Project: &pb.Project{Id: "rival-music"}, Bucket: rival})
+	if err != nil {
+		t.Errorf("Bucket of the project should be allowed, got %v", err)
+	}
+}
+
+func TestPolicyUploadSessions(t *testing.T) {
+	c, _ := newPolicyProvider(t, testPolicy)
+	project := &pb.Project{Id: testProject}
+	bucket := &pb.Bucket{Name: testBucket}
+	if _, err := c.Create(asPrincipal("admin"), &pb.CreateRequest{Project: project, Bucket: bucket}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.StartUpload(asPrincipal("jane"), &pb.StartUploadRequest{Project: project, Bucket: bucket, File: &pb.File{Name: "artist/jane/big.wav"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.QueryUpload(asPrincipal("jane"), &pb.QueryUploadRequest{SessionId: res.SessionId}); err != nil {
+		t.Errorf("Session should be open to the principal that started it, got %v", err)
+	}
+	// admin is allowed the file, but not the session jane started
+	if _, err := c.QueryUpload(asPrincipal("admin"), &pb.QueryUploadRequest{SessionId: res.SessionId}); status.Code(err) != codes.NotFound {
+		t.Errorf("Session of another principal should be NotFound, got %v", err)
+	}
+	stream, err := c.UploadFile(asPrincipal("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&pb.UploadFileRequest{SessionId: res.SessionId, Chunk: &pb.Chunk{Content: []byte("hijack")}})
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.NotFound {
+		t.Errorf("Resuming the session of another principal should be NotFound, got %v", err)
+	}
+}
@@ -5,17 +5,27 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
-	gstorage "cloud.google.com/go/storage"
+	"github.com/evanharmon/eph-music-micro/storage/backend"
 	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
-	"google.golang.org/api/googleapi"
-	"google.golang.org/api/iterator"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 type ProviderService interface {
@@ -28,16 +38,72 @@ type ProviderService interface {
 	Delete(context.Context, *pb.DeleteRequest) (*pb.DeleteResponse, error)
 	UploadFile(*pb.Storage_UploadFileServer) error
 	DeleteFile(context.Context, *pb.DeleteFileRequest) (*pb.DeleteFileResponse, error)
+	DownloadFile(*pb.DownloadFileRequest, pb.Storage_DownloadFileServer) error
+	ListFiles(context.Context, *pb.ListFilesRequest) (*pb.ListFilesResponse, error)
+	StartUpload(context.Context, *pb.StartUploadRequest) (*pb.StartUploadResponse, error)
+	QueryUpload(context.Context, *pb.QueryUploadRequest) (*pb.QueryUploadResponse, error)
+	StatFile(context.Context, *pb.StatFileRequest) (*pb.StatFileResponse, error)
+	DeleteFiles(context.Context, *pb.DeleteFilesRequest) (*pb.DeleteFilesResponse, error)
+	CopyFile(context.Context, *pb.CopyFileRequest) (*pb.CopyFileResponse, error)
+	MoveFile(context.Context, *pb.MoveFileRequest) (*pb.MoveFileResponse, error)
+	GetBucket(context.Context, *pb.GetBucketRequest) (*pb.GetBucketResponse, error)
+	UpdateBucket(context.Context, *pb.UpdateBucketRequest) (*pb.UpdateBucketResponse, error)
+	ListFileVersions(context.Context, *pb.ListFileVersionsRequest) (*pb.ListFileVersionsResponse, error)
+	RestoreFile(context.Context, *pb.RestoreFileRequest) (*pb.RestoreFileResponse, error)
+	SignURL(context.Context, *pb.SignURLRequest) (*pb.SignURLResponse, error)
 }
 
+const (
+	// maxChunkSize bounds stream messages below the 4MB gRPC default
+	maxChunkSize = 1 << 22
+	// maxPageSize bounds the entries returned by one ListFiles call
+	maxPageSize = 1000
+	// deleteWorkers bounds the deletes one request runs at a time
+	deleteWorkers = 16
+	// maxLabels and maxLabelLen follow the GCS limits on bucket labels
+	maxLabels   = 64
+	maxLabelLen = 63
+	// defaultURLExpiry is how long a signed URL stays valid unless asked
+	defaultURLExpiry = 15 * time.Minute
+)
+
 type ProviderGRPC struct {
-	client *gstorage.Client
-	server *grpc.Server
-	port   int
+	backend  backend.Backend
+	sessions *sessionStore
+	server   *grpc.Server
+	port     int
+	signer   *urlSigner
+	http     *http.Server
+	httpPort int
+	// closeOnce closes the backend and stops the session sweep once,
+	// whether the server is closed or shut down
+	closeOnce sync.Once
 }
 
+// ProviderGRPCConfig for the server
+// UploadDir enables resumable uploads, staging them in that directory
+// UploadTTL is how long an upload session may go without a chunk before it
+// is removed, DefaultUploadTTL when zero
+// HTTPPort serves signed URLs for backends that cannot sign their own; they
+// point at HTTPURL, by default http://localhost:HTTPPort, and are signed with
+// SigningKey, a random key that does not outlive the process when empty
+// TLS serves both gRPC and HTTP over TLS, verifying gRPC client
+// certificates when it has a CAFile
+// Auth rejects RPCs without valid credentials, anyone who can connect may
+// call every RPC when it is nil
+// PolicyFile, which needs Auth, limits what each principal may do, see
+// policy for its format; it is reloaded when it changes
 type ProviderGRPCConfig struct {
-	Port int
+	Port       int
+	Backend    backend.Backend
+	UploadDir  string
+	UploadTTL  time.Duration
+	HTTPPort   int
+	HTTPURL    string
+	SigningKey []byte
+	TLS        *TLSConfig
+	Auth       *AuthConfig
+	PolicyFile string
 }
 
 // NewProviderGRPC creates a new grpc server
@@ -48,16 +114,98 @@ func NewProviderGRPC(cfg ProviderGRPCConfig) (*ProviderGRPC, error) {
 	if port == 0 {
 		return nil, errors.New("Port must be specified")
 	}
+	if cfg.Backend == nil {
+		return nil, errors.New("Backend must be specified")
+	}
 
-	client, err := gstorage.NewClient(context.Background())
-	if err != nil {
-		return nil, err
+	var sessions *sessionStore
+	if cfg.UploadDir != "" {
+		var err error
+		if sessions, err = newSessionStore(cfg.UploadDir, cfg.UploadTTL); err != nil {
+			return nil, err
+		}
 	}
 
-	server := grpc.NewServer()
-	s := &ProviderGRPC{client, server, port}
+	var opts []grpc.ServerOption
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.serverConfig(true)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	if cfg.PolicyFile != "" && cfg.Auth == nil {
+		return nil, errors.New("PolicyFile needs Auth")
+	}
+	// errors are translated last, after auth has had its say
+	unary := []grpc.UnaryServerInterceptor{statusUnary}
+	stream := []grpc.StreamServerInterceptor{statusStream}
+	if cfg.Auth != nil {
+		auth, err := newAuthenticator(cfg.Auth)
+		if err != nil {
+			return nil, err
+		}
+		unary = append(unary, auth.unary)
+		stream = append(stream, auth.stream)
+		if cfg.PolicyFile != "" {
+			pol, err := newPolicyReloader(cfg.PolicyFile)
+			if err != nil {
+				return nil, err
+			}
+			authz := &authorizer{policy: pol, sessions: sessions, backend: cfg.Backend}
+			unary = append(unary, authz.unary)
+			stream = append(stream, authz.stream)
+		}
+	}
+	opts = append(opts, grpc.UnaryInterceptor(chainUnary(unary...)), grpc.StreamInterceptor(chainStream(stream...)))
+
+	server := grpc.NewServer(opts...)
+	s := &ProviderGRPC{
+		backend:  cfg.Backend,
+		sessions: sessions,
+		server:   server,
+		port:     port,
+		httpPort: cfg.HTTPPort,
+	}
 	pb.RegisterStorageServer(server, s)
 
+	baseURL := cfg.HTTPURL
+	if baseURL == "" && cfg.HTTPPort != 0 {
+		scheme := "http"
+		if cfg.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = scheme + "://localhost:" + strconv.Itoa(cfg.HTTPPort)
+	}
+	if baseURL != "" {
+		key := cfg.SigningKey
+		if len(key) == 0 {
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+		}
+		s.signer = &urlSigner{baseURL: baseURL, key: key}
+	}
+	if cfg.HTTPPort != 0 {
+		s.http = &http.Server{Handler: s}
+		if cfg.TLS != nil {
+			tlsCfg, err := cfg.TLS.serverConfig(false)
+			if err != nil {
+				return nil, err
+			}
+			s.http.TLSConfig = tlsCfg
+		}
+	}
+
+	if sessions != nil {
+		interval := time.Hour
+		if sessions.ttl < interval {
+			interval = sessions.ttl
+		}
+		sessions.sweepEvery(interval)
+	}
+
 	return s, nil
 }
 
@@ -69,6 +217,29 @@ func (s *ProviderGRPC) Listen() error {
 	}
 	fmt.Printf("Server listening on port: %v\n", s.port)
 
+	if s.http != nil {
+		hlis, err := net.Listen("tcp", ":"+strconv.Itoa(s.httpPort))
+		if err != nil {
+			lis.Close()
+			s.Close()
+			return fmt.Errorf("Failed to listen for HTTP: %v", err)
+		}
+		fmt.Printf("HTTP server listening on port: %v\n", s.httpPort)
+		if s.http.TLSConfig != nil {
+			hlis = tls.NewListener(hlis, s.http.TLSConfig)
+		}
+		go func() {
+			if err := s.http.Serve(hlis); err != nil && err != http.ErrServerClosed {
+				log.Printf("HTTP server failed: %v", err)
+			}
+		}()
+	}
+
+	return s.Serve(lis)
+}
+
+// Serve accepts gRPC connections on lis until the server is closed
+func (s *ProviderGRPC) Serve(lis net.Listener) error {
 	if err := s.server.Serve(lis); err != nil {
 		s.Close()
 		return fmt.Errorf("Failed to serve: %v", err)
@@ -76,48 +247,159 @@ func (s *ProviderGRPC) Listen() error {
 	return nil
 }
 
+// Close stops the server at once, failing RPCs in flight
 func (s *ProviderGRPC) Close() {
 	if s.server != nil {
 		s.server.Stop()
 	}
-	return
+	if s.http != nil {
+		s.http.Close()
+	}
+	s.close()
+}
+
+// Shutdown stops accepting RPCs and HTTP requests, waits for those in flight
+// to finish and then closes the backend
+// When ctx is done first the remaining RPCs are cancelled, uploads among
+// them are aborted rather than committed, and ctx.Err() is returned
+func (s *ProviderGRPC) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(drained)
+	}()
+
+	var err error
+	if s.http != nil {
+		if err = s.http.Shutdown(ctx); err != nil {
+			s.http.Close()
+		}
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		s.server.Stop()
+		<-drained
+		err = ctx.Err()
+	}
+	s.close()
+	return err
+}
+
+func (s *ProviderGRPC) close() {
+	s.closeOnce.Do(func() {
+		if s.sessions != nil {
+			s.sessions.close()
+		}
+		if s.backend == nil {
+			return
+		}
+		if err := s.backend.Close(); err != nil {
+			fmt.Printf("Error closing backend: %v\n", err)
+		}
+	})
 }
 
 // ListBuckets provides a way to list all storage buckets by Project ID.
 func (s *ProviderGRPC) ListBuckets(ctx context.Context, req *pb.ListBucketsRequest) (*pb.ListBucketsResponse, error) {
-	if req.Project.Id == "" {
-		return nil, errors.New("Project ID is required")
+	if req.GetProject().GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Project ID is required")
 	}
 	var buckets []*pb.Bucket
-	it := s.client.Buckets(ctx, req.Project.Id)
+	it := s.backend.Buckets(ctx, req.Project.Id)
 	for {
 		battrs, err := it.Next()
-		if err == iterator.Done {
+		if err == backend.Done {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("Bucket iterator failed: %v", err)
+			return nil, statusError(err, "", "")
 		}
-		buckets = append(buckets, &pb.Bucket{
-			Name: battrs.Name,
-		})
+		buckets = append(buckets, newBucket(battrs))
 	}
 	return &pb.ListBucketsResponse{Buckets: buckets}, nil
 }
 
+// GetBucket returns the attributes of a bucket
+func (s *ProviderGRPC) GetBucket(ctx context.Context, req *pb.GetBucketRequest) (*pb.GetBucketResponse, error) {
+	if req.GetBucket().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is required")
+	}
+
+	attrs, err := s.backend.Bucket(req.Bucket.Name).Attrs(ctx)
+	if err != nil {
+		return nil, statusError(err, req.Bucket.Name, "")
+	}
+	return &pb.GetBucketResponse{Bucket: newBucket(attrs)}, nil
+}
+
+// UpdateBucket changes the bucket settings named in the update mask
+// Settings left out of the mask are unchanged, an empty mask is rejected
+func (s *ProviderGRPC) UpdateBucket(ctx context.Context, req *pb.UpdateBucketRequest) (*pb.UpdateBucketResponse, error) {
+	if req.GetBucket().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is required")
+	}
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Update mask is required")
+	}
+
+	var (
+		uattrs backend.BucketAttrsToUpdate
+		err    error
+	)
+	for _, path := range paths {
+		switch path {
+		case "versioning":
+			enabled := req.Bucket.Versioning
+			uattrs.VersioningEnabled = &enabled
+		case "lifecycle":
+			uattrs.Lifecycle, err = lifecycleRules(req.Bucket.Lifecycle)
+		case "cors":
+			uattrs.CORS, err = corsRules(req.Bucket.Cors)
+		case "default_object_metadata":
+			uattrs.ObjectDefaults = objectDefaults(req.Bucket.DefaultObjectMetadata)
+		default:
+			err = fmt.Errorf("Bucket field %s cannot be updated", path)
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	attrs, err := s.backend.Bucket(req.Bucket.Name).Update(ctx, uattrs)
+	switch err {
+	case nil:
+	case backend.ErrNotSupported:
+		return nil, status.Errorf(codes.Unimplemented, "Bucket settings %v are %v", paths, err)
+	default:
+		return nil, statusError(err, req.Bucket.Name, "")
+	}
+	return &pb.UpdateBucketResponse{Bucket: newBucket(attrs)}, nil
+}
+
 // Create the bucket
+// The storage class, location and labels are optional and left to the
+// backend's defaults when empty
 func (s *ProviderGRPC) Create(ctx context.Context, req *pb.CreateRequest) (*pb.CreateResponse, error) {
-	bkt := s.client.Bucket(req.Bucket.Name)
-	err := bkt.Create(ctx, req.Project.Id, nil)
-	gerr, ok := err.(*googleapi.Error)
-	if err != nil && !ok {
-		return nil, err
+	if req.GetProject().GetId() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Project ID is required")
+	}
+	if req.GetBucket().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is required")
+	}
+	if err := validateLabels(req.Bucket.Labels); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
 	}
 
-	msg := "You already own this bucket. Please select another name."
-	if err != nil && ok && gerr.Message != msg {
-		fmt.Println("Bucket already created")
-		return nil, err
+	bkt := s.backend.Bucket(req.Bucket.Name)
+	err := bkt.Create(ctx, req.Project.Id, &backend.BucketAttrs{
+		StorageClass: req.Bucket.Class,
+		Location:     req.Bucket.Location,
+		Labels:       req.Bucket.Labels,
+	})
+	if err != nil && err != backend.ErrBucketOwned {
+		return nil, statusError(err, req.Bucket.Name, "")
 	}
 
 	return &pb.CreateResponse{Result: "success"}, nil
@@ -125,9 +407,17 @@ func (s *ProviderGRPC) Create(ctx context.Context, req *pb.CreateRequest) (*pb.C
 
 // Delete the bucket
 func (s *ProviderGRPC) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	bkt := s.client.Bucket(req.Bucket.Name)
+	if req.GetBucket().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is required")
+	}
+	bkt := s.backend.Bucket(req.Bucket.Name)
+	if req.Force {
+		if err := s.emptyBucket(ctx, bkt); err != nil {
+			return nil, statusError(err, req.Bucket.Name, "")
+		}
+	}
 	if err := bkt.Delete(ctx); err != nil {
-		return nil, err
+		return nil, statusError(err, req.Bucket.Name, "")
 	}
 	return &pb.DeleteResponse{Result: "success"}, nil
 }
@@ -135,81 +425,1008 @@ func (s *ProviderGRPC) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.D
 // UploadFile to storage bucket
 // Request Protobuf only available via the stream
 // Response Protobuf is sent back via the closing of the stream
+// Each chunk is written through to the backend as it arrives, so memory use
+// does not grow with the size of the file
+// Chunks carrying a session id are staged for a resumable upload instead
 func (s *ProviderGRPC) UploadFile(stream pb.Storage_UploadFileServer) error {
-	var (
-		buf        []byte
-		err        error
-		fileName   string
-		bucketName string
-	)
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.Errorf(codes.InvalidArgument, "Upload received no chunks")
+	}
+	if err != nil {
+		return err
+	}
+	if req.SessionId != "" {
+		return s.resumeUpload(stream, req)
+	}
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	bucket, name := req.Bucket.Name, req.File.Name
+	attrs := writerAttrs(req.File, req.GetChunk().GetContent())
+	obj := s.backend.Bucket(bucket).Object(name).If(conditions(req.IfGenerationMatch))
+	wc := obj.NewWriter(ctx, attrs)
+	digest := backend.NewDigest()
+	w := io.MultiWriter(wc, digest)
+	var sums *pb.Checksums
 	for {
-		// BEWARE last iteration of Recv(): req = nil, err = io.EOF
-		req, err := stream.Recv()
-		// only set fname once
-		if req != nil && fileName == "" {
-			fileName = req.File.Name
+		if req.Checksums != nil {
+			sums = req.Checksums
 		}
-
-		if req != nil && bucketName == "" {
-			bucketName = req.Bucket.Name
+		if _, err = w.Write(req.GetChunk().GetContent()); err != nil {
+			cancel()
+			wc.Close()
+			return stream.SendAndClose(&pb.UploadFileResponse{
+				Message: fmt.Sprintf("Upload failed writing chunk: %v", err),
+				Code:    pb.UploadStatusCode_Failed,
+			})
 		}
 
+		// BEWARE last iteration of Recv(): req = nil, err = io.EOF
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
-				err = nil
-				goto END
-			}
-
+			// cancelling before Close aborts the object so it is never committed
+			cancel()
+			wc.Close()
 			return err
 		}
-
-		buf = append(buf, req.Chunk.Content...)
 	}
 
-END:
-	// Implement io.Reader on buf and copy to object
-	nr := bytes.NewReader(buf)
-	bkt := s.client.Bucket(bucketName)
-	wc := bkt.Object(fileName).NewWriter(context.Background())
-	if _, err = io.Copy(wc, nr); err != nil {
-		err = stream.SendAndClose(&pb.UploadFileResponse{
-			Message: "Upload failed to copy NewReader to NewWriter",
+	// Close and Upload
+	u := &upload{bucket: bucket, name: name, sums: sums, written: digest}
+	if sums != nil {
+		u.replaced = s.liveGeneration(ctx, bucket, name)
+	}
+	if err := wc.Close(); err == backend.ErrPreconditionFailed {
+		return objectError(err, bucket, name)
+	} else if err != nil {
+		return stream.SendAndClose(&pb.UploadFileResponse{
+			Message: fmt.Sprintf("Upload failed closing writer: %v", err),
 			Code:    pb.UploadStatusCode_Failed,
 		})
+	}
+	u.committed = committedAttrs(wc)
+
+	return s.finishUpload(stream, u)
+}
+
+// upload describes a committed upload for finishUpload
+type upload struct {
+	bucket, name string
+	sums         *pb.Checksums
+	written      *backend.Digest
+	// committed is the object the writer reports committing, nil when the
+	// backend cannot say
+	committed *backend.ObjectAttrs
+	// replaced is the generation that was live before the commit, which is
+	// made live again if the upload is discarded
+	replaced int64
+}
+
+// committedAttrs returns the attributes of the object a closed writer
+// committed, nil when the backend does not report them
+func committedAttrs(wc io.WriteCloser) *backend.ObjectAttrs {
+	if cw, ok := wc.(backend.CommittedWriter); ok {
+		return cw.Attrs()
+	}
+	return nil
+}
+
+// liveGeneration returns the generation of the live object, 0 if there is none
+func (s *ProviderGRPC) liveGeneration(ctx context.Context, bucket, name string) int64 {
+	attrs, err := s.backend.Bucket(bucket).Object(name).Attrs(ctx)
+	if err != nil {
+		return 0
+	}
+	return attrs.Generation
+}
+
+// finishUpload checks the stored object against the checksums the client
+// sent, discarding it on a mismatch, and responds with its metadata
+func (s *ProviderGRPC) finishUpload(stream pb.Storage_UploadFileServer, u *upload) error {
+	ctx := stream.Context()
+	attrs := u.committed
+	if attrs == nil {
+		// without a report from the writer the live object is the best guess,
+		// though a concurrent write may have replaced it already
+		var err error
+		attrs, err = s.backend.Bucket(u.bucket).Object(u.name).Attrs(ctx)
 		if err != nil {
-			return err
+			return stream.SendAndClose(&pb.UploadFileResponse{
+				Message: fmt.Sprintf("Upload failed reading attributes: %v", err),
+				Code:    pb.UploadStatusCode_Failed,
+			})
 		}
 	}
-	// Close and Upload
-	if err = wc.Close(); err != nil {
-		err = stream.SendAndClose(&pb.UploadFileResponse{
-			Message: "Upload failed closing NewWriter",
+
+	if err := verifyChecksums(u.sums, u.written, attrs); err != nil {
+		if derr := s.discardUpload(ctx, u, attrs); derr != nil {
+			log.Printf("Failed to delete corrupt upload %s/%s: %v", u.bucket, u.name, derr)
+		}
+		return stream.SendAndClose(&pb.UploadFileResponse{
+			Message: fmt.Sprintf("Upload failed integrity check: %v", err),
 			Code:    pb.UploadStatusCode_Failed,
 		})
-		if err != nil {
-			return err
-		}
 	}
-	err = stream.SendAndClose(&pb.UploadFileResponse{
+
+	return stream.SendAndClose(&pb.UploadFileResponse{
 		Message: "Upload received with success",
 		Code:    pb.UploadStatusCode_Ok,
+		File:    newFile(attrs),
 	})
-	if err != nil {
+}
+
+// discardUpload deletes the generation an upload wrote and nothing else
+// A versioned bucket keeps the generation it replaced, which is made live
+// again unless another write has taken the name meanwhile
+func (s *ProviderGRPC) discardUpload(ctx context.Context, u *upload, attrs *backend.ObjectAttrs) error {
+	obj := s.backend.Bucket(u.bucket).Object(u.name)
+	if attrs.Generation == 0 {
+		// without generations only the live object can be deleted
+		return obj.Delete(ctx)
+	}
+	gen := obj.Generation(attrs.Generation)
+	err := gen.If(backend.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx)
+	if err == backend.ErrPreconditionFailed {
+		// already replaced, so it is at most a noncurrent version now
+		err = gen.Delete(ctx)
+		if err == backend.ErrObjectNotExist {
+			return nil
+		}
 		return err
 	}
+	if err != nil || u.replaced == 0 {
+		return err
+	}
+	_, err = obj.Generation(u.replaced).CopyTo(ctx, obj.If(backend.Conditions{DoesNotExist: true}))
+	if err == backend.ErrObjectNotExist || err == backend.ErrPreconditionFailed {
+		// unversioned buckets keep nothing to restore
+		return nil
+	}
+	return err
+}
 
+// verifyChecksums compares the checksums the client sent with what was stored
+// Checksums the backend does not report are taken from the bytes written
+// A zero CRC32C counts as not sent, proto3 cannot tell the two apart
+func verifyChecksums(sums *pb.Checksums, written *backend.Digest, attrs *backend.ObjectAttrs) error {
+	if sums == nil {
+		return nil
+	}
+	if sums.Crc32C != 0 {
+		crc := attrs.CRC32C
+		if crc == 0 {
+			crc = written.CRC32C()
+		}
+		if sums.Crc32C != crc {
+			return fmt.Errorf("CRC32C mismatch: sent %08x, stored %08x", sums.Crc32C, crc)
+		}
+	}
+	if len(sums.Md5Hash) == 0 {
+		return nil
+	}
+	md5 := attrs.MD5
+	if md5 == nil {
+		md5 = written.MD5()
+	}
+	if !bytes.Equal(sums.Md5Hash, md5) {
+		return fmt.Errorf("MD5 mismatch: sent %x, stored %x", sums.Md5Hash, md5)
+	}
 	return nil
 }
 
+// StartUpload creates a session for a resumable upload
+// Chunks are then sent via UploadFile with the session id and their offset
+func (s *ProviderGRPC) StartUpload(ctx context.Context, req *pb.StartUploadRequest) (*pb.StartUploadResponse, error) {
+	if s.sessions == nil {
+		return nil, status.Errorf(codes.Unimplemented, "Resumable uploads are not enabled")
+	}
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+	if _, err := s.backend.Bucket(req.Bucket.Name).Attrs(ctx); err != nil {
+		return nil, statusError(err, req.Bucket.Name, "")
+	}
+
+	sess := &uploadSession{
+		Project:            req.GetProject().GetId(),
+		Bucket:             req.Bucket.Name,
+		Name:               req.File.Name,
+		ContentType:        req.File.ContentType,
+		CacheControl:       req.File.CacheControl,
+		ContentDisposition: req.File.ContentDisposition,
+		Metadata:           req.File.Metadata,
+	}
+	if p, ok := PrincipalFromContext(ctx); ok {
+		sess.Principal = p.Name
+	}
+	if req.IfGenerationMatch != nil {
+		gen := req.IfGenerationMatch.Value
+		sess.IfGenerationMatch = &gen
+	}
+	if err := s.sessions.create(sess); err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to create upload session: %v", err)
+	}
+	return &pb.StartUploadResponse{SessionId: sess.ID}, nil
+}
+
+// QueryUpload returns how many bytes of a resumable upload have been received
+func (s *ProviderGRPC) QueryUpload(ctx context.Context, req *pb.QueryUploadRequest) (*pb.QueryUploadResponse, error) {
+	if s.sessions == nil {
+		return nil, status.Errorf(codes.Unimplemented, "Resumable uploads are not enabled")
+	}
+	if _, err := getSession(ctx, s.sessions, req.SessionId); err != nil {
+		return nil, err
+	}
+	offset, err := s.sessions.offset(req.SessionId)
+	if err == errSessionNotExist {
+		return nil, status.Errorf(codes.NotFound, "Upload session %s does not exist", req.SessionId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.QueryUploadResponse{CommittedOffset: offset}, nil
+}
+
+// getSession returns an upload session of the caller; sessions started by
+// another principal are reported missing, like their ids were never issued
+func getSession(ctx context.Context, sessions *sessionStore, id string) (*uploadSession, error) {
+	sess, err := sessions.get(id)
+	if err == nil && !sess.startedBy(ctx) {
+		err = errSessionNotExist
+	}
+	if err == errSessionNotExist {
+		return nil, status.Errorf(codes.NotFound, "Upload session %s does not exist", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// resumeUpload stages the chunks of a stream into its upload session
+// If the stream breaks the staged bytes are kept for the client to resume
+// from, once it closes cleanly the file is committed to the bucket
+func (s *ProviderGRPC) resumeUpload(stream pb.Storage_UploadFileServer, req *pb.UploadFileRequest) error {
+	id := req.SessionId
+	if s.sessions == nil {
+		return status.Errorf(codes.Unimplemented, "Resumable uploads are not enabled")
+	}
+	sess, err := getSession(stream.Context(), s.sessions, id)
+	if err != nil {
+		return err
+	}
+	if err := s.sessions.acquire(id); err != nil {
+		return status.Errorf(codes.Aborted, "%v", err)
+	}
+	defer s.sessions.release(id)
+
+	sums, err := s.stageChunks(stream, req)
+	if err != nil {
+		return err
+	}
+
+	u := &upload{bucket: sess.Bucket, name: sess.Name, sums: sums, written: backend.NewDigest()}
+	if sums != nil {
+		u.replaced = s.liveGeneration(stream.Context(), sess.Bucket, sess.Name)
+	}
+	u.committed, err = s.commitSession(stream.Context(), sess, u.written)
+	s.sessions.remove(id)
+	if err == backend.ErrPreconditionFailed {
+		return objectError(err, sess.Bucket, sess.Name)
+	}
+	if err != nil {
+		return stream.SendAndClose(&pb.UploadFileResponse{
+			Message: fmt.Sprintf("Upload failed committing session: %v", err),
+			Code:    pb.UploadStatusCode_Failed,
+		})
+	}
+	return s.finishUpload(stream, u)
+}
+
+// stageChunks appends chunks to the session data until the stream ends
+// Bytes the session already holds, resent after a reconnect, are skipped
+// The checksums sent with the final chunk are returned
+func (s *ProviderGRPC) stageChunks(stream pb.Storage_UploadFileServer, req *pb.UploadFileRequest) (sums *pb.Checksums, err error) {
+	id := req.SessionId
+	f, err := s.sessions.openAppend(id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// flush what was staged even when the stream broke
+		if serr := f.Sync(); err == nil {
+			err = serr
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size()
+
+	for {
+		if req.SessionId != id {
+			return nil, status.Errorf(codes.InvalidArgument, "Chunks must all belong to session %s", id)
+		}
+		if req.Checksums != nil {
+			sums = req.Checksums
+		}
+		content := req.GetChunk().GetContent()
+		end := req.Offset + int64(len(content))
+		switch {
+		case req.Offset > offset:
+			return nil, status.Errorf(codes.OutOfRange, "Chunk offset %d is past the committed offset %d", req.Offset, offset)
+		case end > offset:
+			if _, err := f.Write(content[offset-req.Offset:]); err != nil {
+				return nil, err
+			}
+			offset = end
+		}
+
+		// BEWARE last iteration of Recv(): req = nil, err = io.EOF
+		req, err = stream.Recv()
+		if err == io.EOF {
+			return sums, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// commitSession copies the staged data of a session into its object,
+// adding it to digest on the way, and returns the object's attributes when
+// the backend reports them
+func (s *ProviderGRPC) commitSession(ctx context.Context, sess *uploadSession, digest *backend.Digest) (*backend.ObjectAttrs, error) {
+	r, err := s.sessions.openRead(sess.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// the head of the data is only needed to detect a missing content type
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	attrs := writerAttrs(&pb.File{
+		Name:               sess.Name,
+		ContentType:        sess.ContentType,
+		CacheControl:       sess.CacheControl,
+		ContentDisposition: sess.ContentDisposition,
+		Metadata:           sess.Metadata,
+	}, head)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var gen *wrappers.Int64Value
+	if sess.IfGenerationMatch != nil {
+		gen = &wrappers.Int64Value{Value: *sess.IfGenerationMatch}
+	}
+	obj := s.backend.Bucket(sess.Bucket).Object(sess.Name).If(conditions(gen))
+	wc := obj.NewWriter(ctx, attrs)
+	if _, err := io.Copy(io.MultiWriter(wc, digest), io.MultiReader(bytes.NewReader(head), r)); err != nil {
+		cancel()
+		wc.Close()
+		return nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return nil, err
+	}
+	return committedAttrs(wc), nil
+}
+
 // DeleteFile from storage bucket
 func (s *ProviderGRPC) DeleteFile(ctx context.Context, req *pb.DeleteFileRequest) (*pb.DeleteFileResponse, error) {
-	if req.File.Name == "" {
-		return nil, fmt.Errorf("File name to delete cannot be an empty string")
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
 	}
 
-	bkt := s.client.Bucket(req.Bucket.Name)
-	if err := bkt.Object(req.File.Name).Delete(ctx); err != nil {
-		return nil, err
+	obj := s.object(req.Bucket.Name, req.File).If(conditions(req.IfGenerationMatch))
+	if err := obj.Delete(ctx); err != nil {
+		return nil, objectError(err, req.Bucket.Name, req.File.Name)
 	}
 	return &pb.DeleteFileResponse{Result: "success"}, nil
 }
+
+// DeleteFiles removes the listed files, or every file under a prefix
+// Files are deleted concurrently and each gets its own result
+func (s *ProviderGRPC) DeleteFiles(ctx context.Context, req *pb.DeleteFilesRequest) (*pb.DeleteFilesResponse, error) {
+	if req.GetBucket().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is required")
+	}
+	if (len(req.Names) == 0) == (req.Prefix == "") {
+		return nil, status.Errorf(codes.InvalidArgument, "Either names or a prefix is required")
+	}
+	bkt := s.backend.Bucket(req.Bucket.Name)
+	if _, err := bkt.Attrs(ctx); err != nil {
+		return nil, statusError(err, req.Bucket.Name, "")
+	}
+
+	// failures of single files are reported in the results instead
+	names := req.Names
+	if req.Prefix != "" {
+		var err error
+		if names, err = listNames(ctx, bkt, req.Prefix); err != nil {
+			return nil, statusError(err, req.Bucket.Name, "")
+		}
+	}
+
+	objs := make([]backend.ObjectHandle, len(names))
+	for i, name := range names {
+		objs[i] = bkt.Object(name)
+	}
+	res := &pb.DeleteFilesResponse{Results: make([]*pb.DeleteFileResult, len(names))}
+	for i, err := range deleteObjects(ctx, objs) {
+		result := &pb.DeleteFileResult{Name: names[i], Deleted: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			res.Failed++
+		} else {
+			res.Deleted++
+		}
+		res.Results[i] = result
+	}
+	return res, nil
+}
+
+// emptyBucket deletes every file in a bucket, with its noncurrent versions
+// Files deleted by someone else in the meantime are not an error
+func (s *ProviderGRPC) emptyBucket(ctx context.Context, bkt backend.BucketHandle) error {
+	objs, err := listVersions(ctx, bkt)
+	if err == backend.ErrNotSupported {
+		var names []string
+		names, err = listNames(ctx, bkt, "")
+		objs = make([]backend.ObjectHandle, len(names))
+		for i, name := range names {
+			objs[i] = bkt.Object(name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	failed := 0
+	var first error
+	for _, err := range deleteObjects(ctx, objs) {
+		if err != nil && err != backend.ErrObjectNotExist {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return status.Errorf(codes.FailedPrecondition, "Failed to empty bucket, %d files not deleted: %v", failed, first)
+	}
+	return nil
+}
+
+// listNames returns the name of every file under prefix
+func listNames(ctx context.Context, bkt backend.BucketHandle, prefix string) ([]string, error) {
+	var names []string
+	it := bkt.Objects(ctx, &backend.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == backend.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+// listVersions returns a handle to every generation of every file,
+// deleting each of which removes it for good
+func listVersions(ctx context.Context, bkt backend.BucketHandle) ([]backend.ObjectHandle, error) {
+	var objs []backend.ObjectHandle
+	it := bkt.Objects(ctx, &backend.Query{Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == backend.Done {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, bkt.Object(attrs.Name).Generation(attrs.Generation))
+	}
+}
+
+// deleteObjects deletes objs with a bounded pool of workers and returns
+// the error for each object in the same order
+func deleteObjects(ctx context.Context, objs []backend.ObjectHandle) []error {
+	errs := make([]error, len(objs))
+	next := make(chan int)
+	workers := deleteWorkers
+	if len(objs) < workers {
+		workers = len(objs)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = objs[i].Delete(ctx)
+			}
+		}()
+	}
+	for i := range objs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return errs
+}
+
+// StatFile returns the metadata of a file without its content
+func (s *ProviderGRPC) StatFile(ctx context.Context, req *pb.StatFileRequest) (*pb.StatFileResponse, error) {
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+
+	attrs, err := s.object(req.Bucket.Name, req.File).Attrs(ctx)
+	if err != nil {
+		return nil, objectError(err, req.Bucket.Name, req.File.Name)
+	}
+	return &pb.StatFileResponse{File: newFile(attrs)}, nil
+}
+
+// CopyFile copies a file server side, within or across buckets, keeping
+// its metadata
+func (s *ProviderGRPC) CopyFile(ctx context.Context, req *pb.CopyFileRequest) (*pb.CopyFileResponse, error) {
+	src, dst, err := copyRefs(req.SourceBucket, req.SourceFile, req.DestinationBucket, req.DestinationFile)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := s.backend.Bucket(src.bucket).Object(src.name).CopyTo(ctx, s.backend.Bucket(dst.bucket).Object(dst.name))
+	if err != nil {
+		return nil, copyError(err, src)
+	}
+	return &pb.CopyFileResponse{File: newFile(attrs)}, nil
+}
+
+// MoveFile copies a file then deletes the source
+// The source is only deleted once the copy is known to match it, so a
+// failure part way through leaves the file in one place or both
+func (s *ProviderGRPC) MoveFile(ctx context.Context, req *pb.MoveFileRequest) (*pb.MoveFileResponse, error) {
+	src, dst, err := copyRefs(req.SourceBucket, req.SourceFile, req.DestinationBucket, req.DestinationFile)
+	if err != nil {
+		return nil, err
+	}
+	if src == dst {
+		return nil, status.Errorf(codes.InvalidArgument, "Source and destination are the same file")
+	}
+
+	obj := s.backend.Bucket(src.bucket).Object(src.name)
+	before, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, copyError(err, src)
+	}
+	attrs, err := obj.CopyTo(ctx, s.backend.Bucket(dst.bucket).Object(dst.name))
+	if err != nil {
+		return nil, copyError(err, src)
+	}
+	if !sameContent(before, attrs) {
+		return nil, status.Errorf(codes.DataLoss, "Copy of %s does not match the source, source kept", src)
+	}
+
+	// a source overwritten while it was being copied is left alone
+	after, err := obj.Attrs(ctx)
+	if err != nil || after.Generation != before.Generation || !after.Updated.Equal(before.Updated) {
+		return nil, status.Errorf(codes.Aborted, "%s changed during the move, both copies kept", src)
+	}
+	// the condition closes the gap between that check and the delete on
+	// backends with generations
+	err = obj.If(backend.Conditions{GenerationMatch: before.Generation}).Delete(ctx)
+	if err == backend.ErrPreconditionFailed {
+		return nil, status.Errorf(codes.Aborted, "Copied to %s but %s changed before it was deleted, both copies kept", dst, src)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Copied to %s but failed deleting the source: %v", dst, err)
+	}
+	return &pb.MoveFileResponse{File: newFile(attrs)}, nil
+}
+
+// objectRef names a file in a bucket
+type objectRef struct {
+	bucket string
+	name   string
+}
+
+func (r objectRef) String() string {
+	return r.bucket + "/" + r.name
+}
+
+// copyRefs validates the source and destination of a copy or move
+// The destination bucket defaults to the source bucket
+func copyRefs(srcBucket *pb.Bucket, srcFile *pb.File, dstBucket *pb.Bucket, dstFile *pb.File) (src, dst objectRef, err error) {
+	src = objectRef{srcBucket.GetName(), srcFile.GetName()}
+	dst = objectRef{dstBucket.GetName(), dstFile.GetName()}
+	if dst.bucket == "" {
+		dst.bucket = src.bucket
+	}
+	if src.bucket == "" || src.name == "" || dst.name == "" {
+		return src, dst, status.Errorf(codes.InvalidArgument, "Source bucket, source file and destination file are required")
+	}
+	return src, dst, nil
+}
+
+// copyError converts the backend errors of a copy or move to statuses
+// Either bucket may be the missing one, so neither is named
+func copyError(err error, src objectRef) error {
+	if err == backend.ErrBucketNotExist {
+		return status.Errorf(codes.NotFound, "Bucket does not exist: %v", err)
+	}
+	return statusError(err, src.bucket, src.name)
+}
+
+// sameContent compares the size and whichever checksums both objects report
+func sameContent(a, b *backend.ObjectAttrs) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	if a.CRC32C != 0 && b.CRC32C != 0 && a.CRC32C != b.CRC32C {
+		return false
+	}
+	if a.MD5 != nil && b.MD5 != nil && !bytes.Equal(a.MD5, b.MD5) {
+		return false
+	}
+	return true
+}
+
+// DownloadFile from storage bucket
+// The object, or the span given by offset and length, is streamed back in
+// chunks of the requested size
+func (s *ProviderGRPC) DownloadFile(req *pb.DownloadFileRequest, stream pb.Storage_DownloadFileServer) error {
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+	if req.Offset < 0 || req.Length < 0 {
+		return status.Errorf(codes.InvalidArgument, "Offset and length must not be negative")
+	}
+	length := req.Length
+	if length == 0 {
+		length = -1
+	}
+
+	chunkSize := int(req.ChunkSize)
+	switch {
+	case chunkSize == 0:
+		chunkSize = 1024
+	case chunkSize < 0 || chunkSize > maxChunkSize:
+		return status.Errorf(codes.InvalidArgument, "Chunksize must be between 1 and %d", maxChunkSize)
+	}
+
+	r, err := s.object(req.Bucket.Name, req.File).NewRangeReader(stream.Context(), req.Offset, length)
+	if err == backend.ErrInvalidRange {
+		return status.Errorf(codes.OutOfRange, "Offset %d is beyond the end of %s", req.Offset, req.File.Name)
+	}
+	if err != nil {
+		return objectError(err, req.Bucket.Name, req.File.Name)
+	}
+	defer r.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := stream.Send(&pb.Chunk{Content: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return statusError(err, req.Bucket.Name, req.File.Name)
+		}
+	}
+}
+
+// ListFileVersions returns every generation of a file, newest first
+// Noncurrent versions are only kept while the bucket has versioning enabled
+func (s *ProviderGRPC) ListFileVersions(ctx context.Context, req *pb.ListFileVersionsRequest) (*pb.ListFileVersionsResponse, error) {
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+
+	name := req.File.Name
+	it := s.backend.Bucket(req.Bucket.Name).Objects(ctx, &backend.Query{Prefix: name, Versions: true})
+	res := &pb.ListFileVersionsResponse{}
+	for {
+		attrs, err := it.Next()
+		if err == backend.Done {
+			break
+		}
+		if err != nil {
+			return nil, objectError(err, req.Bucket.Name, name)
+		}
+		if attrs.Name == name {
+			res.Versions = append(res.Versions, newFile(attrs))
+		}
+	}
+	if len(res.Versions) == 0 {
+		return nil, status.Errorf(codes.NotFound, "File %s does not exist", name)
+	}
+	// the iterator returns each name's versions oldest first
+	for i, j := 0, len(res.Versions)-1; i < j; i, j = i+1, j-1 {
+		res.Versions[i], res.Versions[j] = res.Versions[j], res.Versions[i]
+	}
+	return res, nil
+}
+
+// RestoreFile makes a generation of a file live again by copying it over
+// the live file, which becomes a noncurrent version in turn
+func (s *ProviderGRPC) RestoreFile(ctx context.Context, req *pb.RestoreFileRequest) (*pb.RestoreFileResponse, error) {
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+	if req.File.Generation == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Generation to restore is required")
+	}
+
+	bkt := s.backend.Bucket(req.Bucket.Name)
+	live := bkt.Object(req.File.Name).If(conditions(req.IfGenerationMatch))
+	attrs, err := s.object(req.Bucket.Name, req.File).CopyTo(ctx, live)
+	if err != nil {
+		return nil, objectError(err, req.Bucket.Name, req.File.Name)
+	}
+	return &pb.RestoreFileResponse{File: newFile(attrs)}, nil
+}
+
+// SignURL returns a URL that allows any number of GET or PUT requests for a
+// file without credentials until it expires
+// Backends that cannot sign URLs are served by the HTTP handler instead
+func (s *ProviderGRPC) SignURL(ctx context.Context, req *pb.SignURLRequest) (*pb.SignURLResponse, error) {
+	if req.GetBucket().GetName() == "" || req.GetFile().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket and file name are required")
+	}
+	var method string
+	switch req.Method {
+	case pb.SignedMethod_GET:
+		method = http.MethodGet
+	case pb.SignedMethod_PUT:
+		method = http.MethodPut
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "Method must be GET or PUT")
+	}
+	expiry := time.Duration(req.ExpiresSeconds) * time.Second
+	switch {
+	case expiry == 0:
+		expiry = defaultURLExpiry
+	case expiry < 0 || expiry > backend.MaxSignedURLExpiry:
+		return nil, status.Errorf(codes.InvalidArgument, "Expiry must be between 1 second and %v", backend.MaxSignedURLExpiry)
+	}
+
+	// whole seconds, as that is all a signed URL can express
+	expires := time.Now().Add(expiry).Truncate(time.Second)
+	opts := backend.SignedURLOptions{Method: method, Expires: expires}
+	if method == http.MethodPut {
+		opts.ContentType = req.File.ContentType
+	}
+	u, err := s.backend.Bucket(req.Bucket.Name).SignedURL(req.File.Name, opts)
+	if err == backend.ErrNotSupported {
+		if s.signer == nil {
+			return nil, status.Errorf(codes.Unimplemented, "Signed URLs for this backend need the HTTP server")
+		}
+		u, err = s.signer.sign(req.Bucket.Name, req.File.Name, opts), nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to sign URL: %v", err)
+	}
+	ts, _ := ptypes.TimestampProto(expires)
+	return &pb.SignURLResponse{Url: u, Expires: ts}, nil
+}
+
+// ListFiles in a storage bucket one page at a time
+// With a delimiter, names sharing a prefix are returned once in Prefixes
+func (s *ProviderGRPC) ListFiles(ctx context.Context, req *pb.ListFilesRequest) (*pb.ListFilesResponse, error) {
+	if req.GetBucket().GetName() == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Bucket name is required")
+	}
+
+	pageSize := int(req.PageSize)
+	switch {
+	case pageSize == 0:
+		pageSize = maxPageSize
+	case pageSize < 0 || pageSize > maxPageSize:
+		return nil, status.Errorf(codes.InvalidArgument, "Page size must be between 1 and %d", maxPageSize)
+	}
+	bkt := s.backend.Bucket(req.Bucket.Name)
+	q := &backend.Query{Prefix: req.Prefix, Delimiter: req.Delimiter}
+	if p, ok := bkt.(backend.Pager); ok {
+		page, next, err := p.ObjectsPage(ctx, q, pageSize, req.PageToken)
+		if err != nil {
+			return nil, statusError(err, req.Bucket.Name, "")
+		}
+		res := &pb.ListFilesResponse{NextPageToken: next}
+		for _, attrs := range page {
+			addEntry(res, attrs)
+		}
+		return res, nil
+	}
+
+	startAfter, err := decodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid page token: %v", err)
+	}
+	q.StartAfter = startAfter
+	it := bkt.Objects(ctx, q)
+	res := &pb.ListFilesResponse{}
+	for n, last := 0, ""; ; n++ {
+		attrs, err := it.Next()
+		if err == backend.Done {
+			break
+		}
+		if err != nil {
+			return nil, statusError(err, req.Bucket.Name, "")
+		}
+		// only hand out a token when there is another entry to return
+		if n == pageSize {
+			res.NextPageToken = encodePageToken(last)
+			break
+		}
+		addEntry(res, attrs)
+		last = backend.SortKey(attrs)
+	}
+	return res, nil
+}
+
+// addEntry adds a listing entry to the files or prefixes of res
+func addEntry(res *pb.ListFilesResponse, attrs *backend.ObjectAttrs) {
+	if attrs.Prefix != "" {
+		res.Prefixes = append(res.Prefixes, attrs.Prefix)
+	} else {
+		res.Files = append(res.Files, newFile(attrs))
+	}
+}
+
+// newFile converts backend object attributes to the File message
+func newFile(attrs *backend.ObjectAttrs) *pb.File {
+	updated, _ := ptypes.TimestampProto(attrs.Updated)
+	created, _ := ptypes.TimestampProto(attrs.Created)
+	f := &pb.File{
+		Name:               attrs.Name,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		Updated:            updated,
+		Md5Hash:            attrs.MD5,
+		Crc32C:             attrs.CRC32C,
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		Metadata:           attrs.Metadata,
+		Generation:         attrs.Generation,
+		Created:            created,
+		StorageClass:       attrs.StorageClass,
+	}
+	if !attrs.Deleted.IsZero() {
+		f.Deleted, _ = ptypes.TimestampProto(attrs.Deleted)
+	}
+	return f
+}
+
+// object returns a handle to the file, or to the generation it names
+func (s *ProviderGRPC) object(bucket string, f *pb.File) backend.ObjectHandle {
+	obj := s.backend.Bucket(bucket).Object(f.GetName())
+	if f.GetGeneration() != 0 {
+		obj = obj.Generation(f.Generation)
+	}
+	return obj
+}
+
+// conditions converts an if_generation_match field, where 0 requires that
+// the file does not exist yet
+func conditions(gen *wrappers.Int64Value) backend.Conditions {
+	switch {
+	case gen == nil:
+		return backend.Conditions{}
+	case gen.Value == 0:
+		return backend.Conditions{DoesNotExist: true}
+	}
+	return backend.Conditions{GenerationMatch: gen.Value}
+}
+
+// objectError converts the backend errors of a file operation to statuses
+func objectError(err error, bucket, name string) error {
+	if err == backend.ErrNotSupported {
+		return status.Errorf(codes.Unimplemented, "Versioning is not supported by this backend")
+	}
+	return statusError(err, bucket, name)
+}
+
+func newBucket(attrs *backend.BucketAttrs) *pb.Bucket {
+	created, _ := ptypes.TimestampProto(attrs.Created)
+	return &pb.Bucket{
+		Name:     attrs.Name,
+		Class:    attrs.StorageClass,
+		Location: attrs.Location,
+		Labels:   attrs.Labels,
+		Created:  created,
+
+		Versioning:            attrs.VersioningEnabled,
+		Lifecycle:             newLifecycleRules(attrs.Lifecycle),
+		Cors:                  newCorsRules(attrs.CORS),
+		DefaultObjectMetadata: newObjectDefaults(attrs.ObjectDefaults),
+	}
+}
+
+// validateLabels applies the GCS label rules so every backend accepts the
+// same labels: keys start with a lowercase letter, and keys and values use
+// only lowercase letters, digits, dashes and underscores
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("A bucket can have at most %d labels", maxLabels)
+	}
+	for k, v := range labels {
+		if k == "" || k[0] < 'a' || k[0] > 'z' {
+			return fmt.Errorf("Label key %q must start with a lowercase letter", k)
+		}
+		if !validLabel(k) {
+			return fmt.Errorf("Invalid label key: %q", k)
+		}
+		if !validLabel(v) {
+			return fmt.Errorf("Invalid value for label %s: %q", k, v)
+		}
+	}
+	return nil
+}
+
+func validLabel(s string) bool {
+	if len(s) > maxLabelLen {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// writerAttrs are the metadata an uploaded file is stored with
+// head is the start of the content, used when no content type was given
+func writerAttrs(f *pb.File, head []byte) *backend.ObjectAttrs {
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = detectContentType(f.Name, head)
+	}
+	return &backend.ObjectAttrs{
+		ContentType:        contentType,
+		CacheControl:       f.CacheControl,
+		ContentDisposition: f.ContentDisposition,
+		Metadata:           f.Metadata,
+	}
+}
+
+// encodePageToken hides the name a listing resumes after from clients
+func encodePageToken(startAfter string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(startAfter))
+}
+
+func decodePageToken(token string) (string, error) {
+	startAfter, err := base64.RawURLEncoding.DecodeString(token)
+	return string(startAfter), err
+}
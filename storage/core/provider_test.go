@@ -1,9 +1,33 @@
 package core_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/backendtest"
+	"github.com/evanharmon/eph-music-micro/storage/backend/fs"
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
 	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestNewProviderGRPC(t *testing.T) {
@@ -14,4 +38,2152 @@ func TestNewProviderGRPC(t *testing.T) {
 		}
 	})
 
+	t.Run("Nil backend should return error", func(t *testing.T) {
+		cfg := core.ProviderGRPCConfig{Port: 10013}
+		if _, err := core.NewProviderGRPC(cfg); err == nil {
+			t.Errorf("Nil Backend should throw error")
+		}
+	})
+}
+
+const (
+	testPort    = 10013
+	testProject = "eph-music"
+	testBucket  = "test-eph-music"
+)
+
+func newTestProvider(t *testing.T) *core.ProviderGRPC {
+	t.Helper()
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+		Port:    testPort,
+		Backend: memory.New(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func createTestBucket(t *testing.T, s *core.ProviderGRPC, name string) {
+	t.Helper()
+	_, err := s.Create(context.Background(), &pb.CreateRequest{
+		Project: &pb.Project{Id: testProject},
+		Bucket:  &pb.Bucket{Name: name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uploadStream feeds requests to ProviderGRPC.UploadFile without a network
+// err, when set, is returned in place of io.EOF once reqs are exhausted
+type uploadStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs []*pb.UploadFileRequest
+	res  *pb.UploadFileResponse
+	err  error
+}
+
+func (s *uploadStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *uploadStream) Recv() (*pb.UploadFileRequest, error) {
+	if len(s.reqs) == 0 && s.err != nil {
+		return nil, s.err
+	}
+	if len(s.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *uploadStream) SendAndClose(res *pb.UploadFileResponse) error {
+	s.res = res
+	return nil
+}
+
+func newUploadStream(bucket, name string, chunks ...string) *uploadStream {
+	stream := &uploadStream{ctx: context.Background()}
+	for _, c := range chunks {
+		stream.reqs = append(stream.reqs, &pb.UploadFileRequest{
+			Project: &pb.Project{Id: testProject},
+			Bucket:  &pb.Bucket{Name: bucket},
+			File:    &pb.File{Name: name},
+			Chunk:   &pb.Chunk{Content: []byte(c)},
+		})
+	}
+	return stream
+}
+
+func uploadTestFile(t *testing.T, s *core.ProviderGRPC, bucket, name string, chunks ...string) *pb.UploadFileResponse {
+	t.Helper()
+	stream := newUploadStream(bucket, name, chunks...)
+	if err := s.UploadFile(stream); err != nil {
+		t.Fatal(err)
+	}
+	return stream.res
+}
+
+func TestCreate(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	t.Run("Owned bucket should be idempotent", func(t *testing.T) {
+		createTestBucket(t, s, testBucket)
+	})
+	t.Run("Bucket owned by another project should return error", func(t *testing.T) {
+		_, err := s.Create(context.Background(), &pb.CreateRequest{
+			Project: &pb.Project{Id: "other-project"},
+			Bucket:  &pb.Bucket{Name: testBucket},
+		})
+		if err == nil {
+			t.Errorf("Create on taken bucket should throw error")
+		}
+	})
+}
+
+func TestListBuckets(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	res, err := s.ListBuckets(context.Background(), &pb.ListBucketsRequest{
+		Project: &pb.Project{Id: testProject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Buckets) != 1 || res.Buckets[0].Name != testBucket {
+		t.Errorf("ListBuckets returned %v", res.Buckets)
+	}
+}
+
+func TestBucketAttributes(t *testing.T) {
+	s := newTestProvider(t)
+	labels := map[string]string{"team": "mastering", "tier": "archive"}
+	_, err := s.Create(context.Background(), &pb.CreateRequest{
+		Project: &pb.Project{Id: testProject},
+		Bucket: &pb.Bucket{
+			Name:     testBucket,
+			Class:    "COLDLINE",
+			Location: "US-EAST1",
+			Labels:   labels,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, b *pb.Bucket) {
+		t.Helper()
+		if b.Name != testBucket || b.Class != "COLDLINE" || b.Location != "US-EAST1" {
+			t.Errorf("Bucket = %v, want COLDLINE bucket in US-EAST1", b)
+		}
+		if !reflect.DeepEqual(b.Labels, labels) {
+			t.Errorf("Labels = %v, want %v", b.Labels, labels)
+		}
+		if b.Created == nil || b.Created.Seconds == 0 {
+			t.Errorf("Created should be set")
+		}
+	}
+
+	t.Run("ListBuckets should return attributes", func(t *testing.T) {
+		res, err := s.ListBuckets(context.Background(), &pb.ListBucketsRequest{
+			Project: &pb.Project{Id: testProject},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Buckets) != 1 {
+			t.Fatalf("ListBuckets returned %v", res.Buckets)
+		}
+		check(t, res.Buckets[0])
+	})
+	t.Run("GetBucket should return attributes", func(t *testing.T) {
+		res, err := s.GetBucket(context.Background(), &pb.GetBucketRequest{
+			Project: &pb.Project{Id: testProject},
+			Bucket:  &pb.Bucket{Name: testBucket},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, res.Bucket)
+	})
+	t.Run("GetBucket on missing bucket should return NotFound", func(t *testing.T) {
+		_, err := s.GetBucket(context.Background(), &pb.GetBucketRequest{
+			Project: &pb.Project{Id: testProject},
+			Bucket:  &pb.Bucket{Name: "missing"},
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("GetBucket error = %v, want NotFound", err)
+		}
+	})
+	t.Run("GetBucket without a name should return InvalidArgument", func(t *testing.T) {
+		_, err := s.GetBucket(context.Background(), &pb.GetBucketRequest{
+			Project: &pb.Project{Id: testProject},
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetBucket error = %v, want InvalidArgument", err)
+		}
+	})
+}
+
+func TestUpdateBucket(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	update := func(bucket *pb.Bucket, paths ...string) (*pb.UpdateBucketResponse, error) {
+		return s.UpdateBucket(context.Background(), &pb.UpdateBucketRequest{
+			Project:    &pb.Project{Id: testProject},
+			Bucket:     bucket,
+			UpdateMask: &field_mask.FieldMask{Paths: paths},
+		})
+	}
+
+	lifecycle := []*pb.LifecycleRule{
+		{Action: pb.LifecycleAction_Delete, AgeDays: 7, Prefix: "tmp/"},
+		{Action: pb.LifecycleAction_SetStorageClass, StorageClass: "COLDLINE", AgeDays: 365},
+	}
+	cors := []*pb.CorsRule{
+		{Origins: []string{"https://eph.example.com"}, Methods: []string{"GET"}, MaxAgeSeconds: 3600},
+	}
+	res, err := update(&pb.Bucket{
+		Name:       testBucket,
+		Versioning: true,
+		Lifecycle:  lifecycle,
+		Cors:       cors,
+	}, "versioning", "lifecycle", "cors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Bucket.Versioning || !reflect.DeepEqual(res.Bucket.Lifecycle, lifecycle) || !reflect.DeepEqual(res.Bucket.Cors, cors) {
+		t.Errorf("UpdateBucket returned %v", res.Bucket)
+	}
+
+	t.Run("Fields outside the mask should be unchanged", func(t *testing.T) {
+		res, err := update(&pb.Bucket{Name: testBucket}, "cors")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Bucket.Versioning || len(res.Bucket.Lifecycle) != 2 || len(res.Bucket.Cors) != 0 {
+			t.Errorf("UpdateBucket returned %v, want only cors cleared", res.Bucket)
+		}
+	})
+	t.Run("Default object metadata should apply to uploads", func(t *testing.T) {
+		_, err := update(&pb.Bucket{
+			Name: testBucket,
+			DefaultObjectMetadata: &pb.ObjectDefaults{
+				CacheControl: "public, max-age=86400",
+				Metadata:     map[string]string{"label": "eph"},
+			},
+		}, "default_object_metadata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploadTestFile(t, s, testBucket, "defaults.txt", "content")
+		f := statTestFile(t, s, testBucket, "defaults.txt")
+		if f.CacheControl != "public, max-age=86400" || f.Metadata["label"] != "eph" {
+			t.Errorf("Uploaded file = %v, want the bucket defaults", f)
+		}
+	})
+
+	tests := map[string]struct {
+		bucket *pb.Bucket
+		paths  []string
+		code   codes.Code
+	}{
+		"empty mask":    {&pb.Bucket{Name: testBucket}, nil, codes.InvalidArgument},
+		"unknown field": {&pb.Bucket{Name: testBucket}, []string{"location"}, codes.InvalidArgument},
+		"rule without action": {&pb.Bucket{
+			Name:      testBucket,
+			Lifecycle: []*pb.LifecycleRule{{AgeDays: 30}},
+		}, []string{"lifecycle"}, codes.InvalidArgument},
+		"class rule without class": {&pb.Bucket{
+			Name:      testBucket,
+			Lifecycle: []*pb.LifecycleRule{{Action: pb.LifecycleAction_SetStorageClass, AgeDays: 30}},
+		}, []string{"lifecycle"}, codes.InvalidArgument},
+		"cors rule without origins": {&pb.Bucket{
+			Name: testBucket,
+			Cors: []*pb.CorsRule{{Methods: []string{"GET"}}},
+		}, []string{"cors"}, codes.InvalidArgument},
+		"missing bucket": {&pb.Bucket{Name: "missing"}, []string{"versioning"}, codes.NotFound},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := update(tc.bucket, tc.paths...); status.Code(err) != tc.code {
+				t.Errorf("UpdateBucket error = %v, want %v", err, tc.code)
+			}
+		})
+	}
+}
+
+func TestCreateLabels(t *testing.T) {
+	tests := map[string]struct {
+		labels map[string]string
+		valid  bool
+	}{
+		"lowercase labels":        {map[string]string{"team": "mastering", "year_2018": "q-3"}, true},
+		"empty value":             {map[string]string{"archived": ""}, true},
+		"uppercase key":           {map[string]string{"Team": "mastering"}, false},
+		"key starting with digit": {map[string]string{"2018": "yes"}, false},
+		"empty key":               {map[string]string{"": "yes"}, false},
+		"uppercase value":         {map[string]string{"team": "Mastering"}, false},
+		"value with a space":      {map[string]string{"team": "a b"}, false},
+		"key too long":            {map[string]string{strings.Repeat("k", 64): "v"}, false},
+		"value too long":          {map[string]string{"k": strings.Repeat("v", 64)}, false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newTestProvider(t)
+			_, err := s.Create(context.Background(), &pb.CreateRequest{
+				Project: &pb.Project{Id: testProject},
+				Bucket:  &pb.Bucket{Name: testBucket, Labels: tc.labels},
+			})
+			if tc.valid && err != nil {
+				t.Errorf("Create should accept %v, got %v", tc.labels, err)
+			}
+			if !tc.valid && status.Code(err) != codes.InvalidArgument {
+				t.Errorf("Create error = %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	res := uploadTestFile(t, s, testBucket, "upload-file.txt", "chunk one, ", "chunk two")
+	if res.Code != pb.UploadStatusCode_Ok {
+		t.Errorf("Upload should succeed, got %v: %s", res.Code, res.Message)
+	}
+
+	_, err := s.DeleteFile(context.Background(), &pb.DeleteFileRequest{
+		Bucket: &pb.Bucket{Name: testBucket},
+		File:   &pb.File{Name: "upload-file.txt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Delete(context.Background(), &pb.DeleteRequest{
+		Bucket: &pb.Bucket{Name: testBucket},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withChecksums appends a final message carrying the checksums of content
+func withChecksums(stream *uploadStream, content string) *uploadStream {
+	d := backend.NewDigest()
+	d.Write([]byte(content))
+	last := *stream.reqs[len(stream.reqs)-1]
+	last.Chunk = &pb.Chunk{}
+	last.Offset += int64(len(stream.reqs[len(stream.reqs)-1].GetChunk().GetContent()))
+	last.Checksums = &pb.Checksums{Crc32C: d.CRC32C(), Md5Hash: d.MD5()}
+	stream.reqs = append(stream.reqs, &last)
+	return stream
+}
+
+func TestUploadFileChecksums(t *testing.T) {
+	b := memory.New()
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestBucket(t, s, testBucket)
+
+	t.Run("Matching checksums should succeed", func(t *testing.T) {
+		stream := withChecksums(newUploadStream(testBucket, "good.txt", "hello ", "world"), "hello world")
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+		if stream.res.Code != pb.UploadStatusCode_Ok {
+			t.Fatalf("Upload should succeed, got %v: %s", stream.res.Code, stream.res.Message)
+		}
+		if stream.res.File.GetCrc32C() == 0 || len(stream.res.File.GetMd5Hash()) == 0 {
+			t.Errorf("Response should include stored checksums, got %v", stream.res.File)
+		}
+	})
+
+	t.Run("Mismatched checksums should fail and delete the object", func(t *testing.T) {
+		stream := withChecksums(newUploadStream(testBucket, "bad.txt", "hello ", "world"), "hello there")
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+		if stream.res.Code != pb.UploadStatusCode_Failed {
+			t.Errorf("Corrupt upload should fail, got %v", stream.res.Code)
+		}
+		_, err := b.Bucket(testBucket).Object("bad.txt").Attrs(context.Background())
+		if err != backend.ErrObjectNotExist {
+			t.Errorf("Corrupt upload should be deleted, got %v", err)
+		}
+	})
+
+	t.Run("Only the checksums sent should be compared", func(t *testing.T) {
+		for content, code := range map[string]pb.UploadStatusCode{
+			"hello world": pb.UploadStatusCode_Ok,
+			"hello there": pb.UploadStatusCode_Failed,
+		} {
+			stream := withChecksums(newUploadStream(testBucket, "md5.txt", "hello ", "world"), content)
+			stream.reqs[len(stream.reqs)-1].Checksums.Crc32C = 0
+			if err := s.UploadFile(stream); err != nil {
+				t.Fatal(err)
+			}
+			if stream.res.Code != code {
+				t.Errorf("MD5 of %q should give %v, got %v: %s", content, code, stream.res.Code, stream.res.Message)
+			}
+		}
+	})
+
+	t.Run("Corrupt overwrite should leave the previous version live", func(t *testing.T) {
+		enableVersioning(t, s, testBucket)
+		prev := uploadTestFile(t, s, testBucket, "mix.wav", "take one").File
+		stream := withChecksums(newUploadStream(testBucket, "mix.wav", "take two"), "take 2")
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+		if stream.res.Code != pb.UploadStatusCode_Failed {
+			t.Fatalf("Corrupt upload should fail, got %v", stream.res.Code)
+		}
+		attrs, err := b.Bucket(testBucket).Object("mix.wav").Attrs(context.Background())
+		if err != nil {
+			t.Fatalf("Previous version should be live, got %v", err)
+		}
+		if !bytes.Equal(attrs.MD5, prev.Md5Hash) {
+			t.Errorf("Live object should hold the previous content, got MD5 %x", attrs.MD5)
+		}
+	})
+
+	t.Run("Stored checksums should be listed", func(t *testing.T) {
+		d := backend.NewDigest()
+		d.Write([]byte("hello world"))
+		res, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			Prefix: "good",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 || res.Files[0].Crc32C != d.CRC32C() {
+			t.Errorf("ListFiles should return CRC32C %08x, got %v", d.CRC32C(), res.Files)
+		}
+	})
+}
+
+func TestUploadFileMetadata(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	tests := map[string]struct {
+		file    *pb.File
+		content string
+		want    string
+	}{
+		"explicit":      {&pb.File{Name: "track.bin", ContentType: "audio/mpeg"}, "ID3", "audio/mpeg"},
+		"flac by name":  {&pb.File{Name: "track.FLAC"}, "data", "audio/flac"},
+		"mp3 by name":   {&pb.File{Name: "track.mp3"}, "data", "audio/mpeg"},
+		"flac by magic": {&pb.File{Name: "track"}, "fLaC\x00\x00\x00\x22", "audio/flac"},
+		"mp3 by magic":  {&pb.File{Name: "track"}, "ID3\x03\x00", "audio/mpeg"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			stream := newUploadStream(testBucket, test.file.Name, test.content)
+			stream.reqs[0].File = test.file
+			if err := s.UploadFile(stream); err != nil {
+				t.Fatal(err)
+			}
+			if got := stream.res.File.GetContentType(); got != test.want {
+				t.Errorf("Content type should be %s, got %s", test.want, got)
+			}
+		})
+	}
+
+	t.Run("Cache control, disposition and metadata should be stored", func(t *testing.T) {
+		file := &pb.File{
+			Name:               "mix.wav",
+			CacheControl:       "public, max-age=86400",
+			ContentDisposition: "inline",
+			Metadata:           map[string]string{"artist": "eph"},
+		}
+		stream := newUploadStream(testBucket, file.Name, "RIFF")
+		stream.reqs[0].File = file
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			Prefix: "mix",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("ListFiles should return mix.wav, got %v", res.Files)
+		}
+		got := res.Files[0]
+		if got.CacheControl != file.CacheControl || got.ContentDisposition != file.ContentDisposition || got.Metadata["artist"] != "eph" {
+			t.Errorf("Listed file should keep its metadata, got %v", got)
+		}
+		if got.ContentType != "audio/wav" {
+			t.Errorf("Content type should be audio/wav, got %s", got.ContentType)
+		}
+	})
+}
+
+func TestUploadFileAbort(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	t.Run("Stream error should not commit the file", func(t *testing.T) {
+		stream := newUploadStream(testBucket, "partial.wav", "chunk one", "chunk two")
+		stream.err = errors.New("connection reset")
+		if err := s.UploadFile(stream); err == nil {
+			t.Fatalf("UploadFile should return the stream error")
+		}
+		res, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 0 {
+			t.Errorf("aborted upload committed %v", res.Files)
+		}
+	})
+	t.Run("Missing file name should return InvalidArgument", func(t *testing.T) {
+		stream := newUploadStream(testBucket, "", "chunk one")
+		if err := s.UploadFile(stream); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("UploadFile without a name = %v, want InvalidArgument", err)
+		}
+	})
+	t.Run("Missing bucket should fail", func(t *testing.T) {
+		stream := newUploadStream("missing", "upload-file.txt", "chunk one")
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+		if stream.res.Code != pb.UploadStatusCode_Failed {
+			t.Errorf("Upload to missing bucket returned %v", stream.res.Code)
+		}
+	})
+}
+
+func newSessionProvider(t *testing.T, dir string, b backend.Backend) *core.ProviderGRPC {
+	t.Helper()
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+		Port:      testPort,
+		Backend:   b,
+		UploadDir: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func startTestUpload(t *testing.T, s *core.ProviderGRPC, name string) string {
+	t.Helper()
+	res, err := s.StartUpload(context.Background(), &pb.StartUploadRequest{
+		Project: &pb.Project{Id: testProject},
+		Bucket:  &pb.Bucket{Name: testBucket},
+		File:    &pb.File{Name: name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.SessionId
+}
+
+// newSessionStream sends chunks for a session starting at offset
+func newSessionStream(id string, offset int64, chunks ...string) *uploadStream {
+	stream := &uploadStream{ctx: context.Background()}
+	for _, c := range chunks {
+		stream.reqs = append(stream.reqs, &pb.UploadFileRequest{
+			SessionId: id,
+			Offset:    offset,
+			Chunk:     &pb.Chunk{Content: []byte(c)},
+		})
+		offset += int64(len(c))
+	}
+	return stream
+}
+
+func queryTestUpload(t *testing.T, s *core.ProviderGRPC, id string) int64 {
+	t.Helper()
+	res, err := s.QueryUpload(context.Background(), &pb.QueryUploadRequest{SessionId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.CommittedOffset
+}
+
+func TestResumableUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eph-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := memory.New()
+	s := newSessionProvider(t, dir, b)
+	createTestBucket(t, s, testBucket)
+
+	t.Run("Interrupted upload should resume from committed offset", func(t *testing.T) {
+		id := startTestUpload(t, s, "resume.txt")
+
+		broken := newSessionStream(id, 0, "hello ", "wor")
+		broken.err = errors.New("connection reset")
+		if err := s.UploadFile(broken); err == nil {
+			t.Fatalf("Broken stream should return error")
+		}
+		if offset := queryTestUpload(t, s, id); offset != 9 {
+			t.Fatalf("Committed offset should be 9, got %d", offset)
+		}
+
+		// resending the overlap is harmless
+		stream := newSessionStream(id, 6, "world", "!")
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+		if stream.res.Code != pb.UploadStatusCode_Ok {
+			t.Fatalf("Resumed upload should succeed: %s", stream.res.Message)
+		}
+		if got := string(backendtest.ReadObject(t, b.Bucket(testBucket), "resume.txt")); got != "hello world!" {
+			t.Errorf("Resumed upload should store full content, got %q", got)
+		}
+	})
+
+	t.Run("Committed session should no longer exist", func(t *testing.T) {
+		id := startTestUpload(t, s, "done.txt")
+		if err := s.UploadFile(newSessionStream(id, 0, "done")); err != nil {
+			t.Fatal(err)
+		}
+		_, err := s.QueryUpload(context.Background(), &pb.QueryUploadRequest{SessionId: id})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Query of committed session should return NotFound, got %v", err)
+		}
+	})
+
+	t.Run("Mismatched checksums should fail the commit", func(t *testing.T) {
+		id := startTestUpload(t, s, "corrupt.txt")
+		stream := withChecksums(newSessionStream(id, 0, "hello"), "jello")
+		if err := s.UploadFile(stream); err != nil {
+			t.Fatal(err)
+		}
+		if stream.res.Code != pb.UploadStatusCode_Failed {
+			t.Errorf("Corrupt upload should fail, got %v", stream.res.Code)
+		}
+		_, err := b.Bucket(testBucket).Object("corrupt.txt").Attrs(context.Background())
+		if err != backend.ErrObjectNotExist {
+			t.Errorf("Corrupt upload should be deleted, got %v", err)
+		}
+	})
+
+	t.Run("Session metadata should be applied on commit", func(t *testing.T) {
+		res, err := s.StartUpload(context.Background(), &pb.StartUploadRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "take", Metadata: map[string]string{"take": "3"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UploadFile(newSessionStream(res.SessionId, 0, "fLaC", "\x00\x00")); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := b.Bucket(testBucket).Object("take").Attrs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.ContentType != "audio/flac" || attrs.Metadata["take"] != "3" {
+			t.Errorf("Committed object should keep session metadata, got %+v", attrs)
+		}
+	})
+
+	t.Run("Chunk past committed offset should return OutOfRange", func(t *testing.T) {
+		id := startTestUpload(t, s, "gap.txt")
+		err := s.UploadFile(newSessionStream(id, 4, "gap"))
+		if status.Code(err) != codes.OutOfRange {
+			t.Errorf("Gap in upload should return OutOfRange, got %v", err)
+		}
+	})
+
+	t.Run("Unknown session should return NotFound", func(t *testing.T) {
+		err := s.UploadFile(newSessionStream("../../etc/passwd", 0, "x"))
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Unknown session should return NotFound, got %v", err)
+		}
+	})
+
+	t.Run("Missing bucket should return NotFound", func(t *testing.T) {
+		_, err := s.StartUpload(context.Background(), &pb.StartUploadRequest{
+			Bucket: &pb.Bucket{Name: "missing-bucket"},
+			File:   &pb.File{Name: "x"},
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("StartUpload on missing bucket should return NotFound, got %v", err)
+		}
+	})
+
+	t.Run("Sessions should persist across a restart", func(t *testing.T) {
+		id := startTestUpload(t, s, "restart.txt")
+		broken := newSessionStream(id, 0, "before ")
+		broken.err = errors.New("server stopped")
+		s.UploadFile(broken)
+
+		restarted := newSessionProvider(t, dir, b)
+		if offset := queryTestUpload(t, restarted, id); offset != 7 {
+			t.Fatalf("Committed offset should survive restart, got %d", offset)
+		}
+		if err := restarted.UploadFile(newSessionStream(id, 7, "after")); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(backendtest.ReadObject(t, b.Bucket(testBucket), "restart.txt")); got != "before after" {
+			t.Errorf("Restarted upload should store full content, got %q", got)
+		}
+	})
+
+	t.Run("Provider without upload dir should return Unimplemented", func(t *testing.T) {
+		_, err := newTestProvider(t).StartUpload(context.Background(), &pb.StartUploadRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "x"},
+		})
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("StartUpload without sessions should return Unimplemented, got %v", err)
+		}
+	})
+
+	t.Run("Untouched session should expire and be swept", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+			Port:      testPort,
+			Backend:   b,
+			UploadDir: dir,
+			UploadTTL: 50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		id := startTestUpload(t, s, "abandoned.txt")
+		time.Sleep(200 * time.Millisecond)
+
+		_, err = s.QueryUpload(context.Background(), &pb.QueryUploadRequest{SessionId: id})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Query of expired session should return NotFound, got %v", err)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("Expired session should be removed, found %d files", len(files))
+		}
+	})
+}
+
+func TestMissingBucket(t *testing.T) {
+	s := newTestProvider(t)
+	ctx := context.Background()
+	file := &pb.File{Name: "song.mp3"}
+
+	tests := map[string]func() error{
+		"Create": func() error {
+			_, err := s.Create(ctx, &pb.CreateRequest{Project: &pb.Project{Id: testProject}})
+			return err
+		},
+		"Create without a project": func() error {
+			_, err := s.Create(ctx, &pb.CreateRequest{Bucket: &pb.Bucket{Name: testBucket}})
+			return err
+		},
+		"Delete": func() error {
+			_, err := s.Delete(ctx, &pb.DeleteRequest{})
+			return err
+		},
+		"DeleteFile": func() error {
+			_, err := s.DeleteFile(ctx, &pb.DeleteFileRequest{File: file})
+			return err
+		},
+		"DownloadFile": func() error {
+			return s.DownloadFile(&pb.DownloadFileRequest{File: file}, &downloadStream{})
+		},
+	}
+	for name, call := range tests {
+		t.Run(name+" should be InvalidArgument", func(t *testing.T) {
+			if code := status.Code(call()); code != codes.InvalidArgument {
+				t.Errorf("Expected %v, got %v", codes.InvalidArgument, code)
+			}
+		})
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	t.Run("Missing file should return error", func(t *testing.T) {
+		_, err := s.DeleteFile(context.Background(), &pb.DeleteFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "missing.txt"},
+		})
+		if err == nil {
+			t.Errorf("DeleteFile on missing file should throw error")
+		}
+	})
+	t.Run("Empty file name should return error", func(t *testing.T) {
+		_, err := s.DeleteFile(context.Background(), &pb.DeleteFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: ""},
+		})
+		if err == nil {
+			t.Errorf("DeleteFile with empty name should throw error")
+		}
+	})
+}
+
+func TestStatFile(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+
+	stream := newUploadStream(testBucket, "stat.flac", "fLaC")
+	stream.reqs[0].File.Metadata = map[string]string{"artist": "eph"}
+	if err := s.UploadFile(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.StatFile(context.Background(), &pb.StatFileRequest{
+		Bucket: &pb.Bucket{Name: testBucket},
+		File:   &pb.File{Name: "stat.flac"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := res.File
+	if f.Size != 4 || f.ContentType != "audio/flac" || f.Metadata["artist"] != "eph" {
+		t.Errorf("StatFile returned %v", f)
+	}
+	if f.Generation == 0 || f.Created == nil || f.Updated == nil || f.Crc32C == 0 || len(f.Md5Hash) == 0 {
+		t.Errorf("StatFile should return generation, timestamps and checksums, got %v", f)
+	}
+
+	tests := map[string]struct {
+		bucket string
+		file   string
+		code   codes.Code
+	}{
+		"missing file":   {testBucket, "missing.flac", codes.NotFound},
+		"missing bucket": {"missing-bucket", "stat.flac", codes.NotFound},
+		"empty name":     {testBucket, "", codes.InvalidArgument},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.StatFile(context.Background(), &pb.StatFileRequest{
+				Bucket: &pb.Bucket{Name: test.bucket},
+				File:   &pb.File{Name: test.file},
+			})
+			if status.Code(err) != test.code {
+				t.Errorf("StatFile should return %v, got %v", test.code, err)
+			}
+		})
+	}
+}
+
+func TestDeleteFiles(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	for i := 0; i < 40; i++ {
+		uploadTestFile(t, s, testBucket, fmt.Sprintf("release/track-%02d.flac", i), "track")
+	}
+	uploadTestFile(t, s, testBucket, "keep/track.flac", "track")
+	uploadTestFile(t, s, testBucket, "single.flac", "track")
+
+	t.Run("Names should be deleted with a result each", func(t *testing.T) {
+		res, err := s.DeleteFiles(context.Background(), &pb.DeleteFilesRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			Names:  []string{"single.flac", "missing.flac"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Deleted != 1 || res.Failed != 1 || len(res.Results) != 2 {
+			t.Fatalf("DeleteFiles returned %v", res)
+		}
+		if !res.Results[0].Deleted || res.Results[1].Deleted || res.Results[1].Error == "" {
+			t.Errorf("Results should match the order of names, got %v", res.Results)
+		}
+	})
+
+	t.Run("Backend errors should map to codes", func(t *testing.T) {
+		for berr, code := range map[error]codes.Code{
+			backend.ErrBucketNotExist:   codes.NotFound,
+			backend.ErrPermissionDenied: codes.PermissionDenied,
+			backend.ErrQuotaExceeded:    codes.ResourceExhausted,
+		} {
+			s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: failingBackend{Backend: memory.New(), err: berr}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.DeleteFiles(context.Background(), &pb.DeleteFilesRequest{
+				Bucket: &pb.Bucket{Name: testBucket},
+				Names:  []string{"single.flac"},
+			})
+			if status.Code(err) != code {
+				t.Errorf("%v: expected code %v, got %v", berr, code, err)
+			}
+		}
+	})
+
+	t.Run("Prefix should delete every file under it", func(t *testing.T) {
+		res, err := s.DeleteFiles(context.Background(), &pb.DeleteFilesRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			Prefix: "release/",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Deleted != 40 || res.Failed != 0 {
+			t.Errorf("Prefix delete should remove 40 files, got %d deleted %d failed", res.Deleted, res.Failed)
+		}
+		list, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Files) != 1 || list.Files[0].Name != "keep/track.flac" {
+			t.Errorf("Only keep/track.flac should remain, got %v", list.Files)
+		}
+	})
+
+	tests := map[string]struct {
+		req  *pb.DeleteFilesRequest
+		code codes.Code
+	}{
+		"names and prefix": {&pb.DeleteFilesRequest{Bucket: &pb.Bucket{Name: testBucket}, Names: []string{"a"}, Prefix: "b"}, codes.InvalidArgument},
+		"neither":          {&pb.DeleteFilesRequest{Bucket: &pb.Bucket{Name: testBucket}}, codes.InvalidArgument},
+		"missing bucket":   {&pb.DeleteFilesRequest{Bucket: &pb.Bucket{Name: "missing-bucket"}, Prefix: "a"}, codes.NotFound},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.DeleteFiles(context.Background(), test.req); status.Code(err) != test.code {
+				t.Errorf("DeleteFiles should return %v, got %v", test.code, err)
+			}
+		})
+	}
+}
+
+func TestDeleteForce(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	uploadTestFile(t, s, testBucket, "a/track.flac", "track")
+	uploadTestFile(t, s, testBucket, "b/track.flac", "track")
+
+	_, err := s.Delete(context.Background(), &pb.DeleteRequest{Bucket: &pb.Bucket{Name: testBucket}})
+	if err == nil {
+		t.Fatalf("Delete of non-empty bucket without force should return error")
+	}
+
+	_, err = s.Delete(context.Background(), &pb.DeleteRequest{
+		Bucket: &pb.Bucket{Name: testBucket},
+		Force:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.ListBuckets(context.Background(), &pb.ListBucketsRequest{
+		Project: &pb.Project{Id: testProject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Buckets) != 0 {
+		t.Errorf("Forced delete should remove the bucket, got %v", res.Buckets)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	createTestBucket(t, s, "release-eph-music")
+
+	stream := newUploadStream(testBucket, "staging/master.flac", "master")
+	stream.reqs[0].File.Metadata = map[string]string{"artist": "eph"}
+	if err := s.UploadFile(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.CopyFile(context.Background(), &pb.CopyFileRequest{
+		SourceBucket:      &pb.Bucket{Name: testBucket},
+		SourceFile:        &pb.File{Name: "staging/master.flac"},
+		DestinationBucket: &pb.Bucket{Name: "release-eph-music"},
+		DestinationFile:   &pb.File{Name: "master.flac"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.File.Size != 6 || res.File.ContentType != "audio/flac" || res.File.Metadata["artist"] != "eph" {
+		t.Errorf("Copy should keep size and metadata, got %v", res.File)
+	}
+	statTestFile(t, s, testBucket, "staging/master.flac")
+
+	t.Run("Destination bucket should default to the source", func(t *testing.T) {
+		_, err := s.CopyFile(context.Background(), &pb.CopyFileRequest{
+			SourceBucket:    &pb.Bucket{Name: testBucket},
+			SourceFile:      &pb.File{Name: "staging/master.flac"},
+			DestinationFile: &pb.File{Name: "backup/master.flac"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		statTestFile(t, s, testBucket, "backup/master.flac")
+	})
+
+	t.Run("Missing source should return NotFound", func(t *testing.T) {
+		_, err := s.CopyFile(context.Background(), &pb.CopyFileRequest{
+			SourceBucket:    &pb.Bucket{Name: testBucket},
+			SourceFile:      &pb.File{Name: "missing.flac"},
+			DestinationFile: &pb.File{Name: "copy.flac"},
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Copy of missing file should return NotFound, got %v", err)
+		}
+	})
+}
+
+func TestMoveFile(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	uploadTestFile(t, s, testBucket, "artist/old-name/track.flac", "track")
+
+	res, err := s.MoveFile(context.Background(), &pb.MoveFileRequest{
+		SourceBucket:    &pb.Bucket{Name: testBucket},
+		SourceFile:      &pb.File{Name: "artist/old-name/track.flac"},
+		DestinationFile: &pb.File{Name: "artist/new-name/track.flac"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.File.Name != "artist/new-name/track.flac" {
+		t.Errorf("Move should return the new file, got %v", res.File)
+	}
+	statTestFile(t, s, testBucket, "artist/new-name/track.flac")
+	_, err = s.StatFile(context.Background(), &pb.StatFileRequest{
+		Bucket: &pb.Bucket{Name: testBucket},
+		File:   &pb.File{Name: "artist/old-name/track.flac"},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Moved source should be deleted, got %v", err)
+	}
+
+	t.Run("Missing destination bucket should keep the source", func(t *testing.T) {
+		_, err := s.MoveFile(context.Background(), &pb.MoveFileRequest{
+			SourceBucket:      &pb.Bucket{Name: testBucket},
+			SourceFile:        &pb.File{Name: "artist/new-name/track.flac"},
+			DestinationBucket: &pb.Bucket{Name: "missing-bucket"},
+			DestinationFile:   &pb.File{Name: "track.flac"},
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Move into missing bucket should return NotFound, got %v", err)
+		}
+		statTestFile(t, s, testBucket, "artist/new-name/track.flac")
+	})
+
+	t.Run("Move onto itself should return InvalidArgument", func(t *testing.T) {
+		_, err := s.MoveFile(context.Background(), &pb.MoveFileRequest{
+			SourceBucket:    &pb.Bucket{Name: testBucket},
+			SourceFile:      &pb.File{Name: "artist/new-name/track.flac"},
+			DestinationFile: &pb.File{Name: "artist/new-name/track.flac"},
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Move onto itself should return InvalidArgument, got %v", err)
+		}
+		statTestFile(t, s, testBucket, "artist/new-name/track.flac")
+	})
+}
+
+// racingBackend overwrites one object just before any delete of it, as a
+// client writing between a check and the delete would
+type racingBackend struct {
+	backend.Backend
+	name string
+}
+
+func (b *racingBackend) Bucket(name string) backend.BucketHandle {
+	return &racingBucket{BucketHandle: b.Backend.Bucket(name), b: b}
+}
+
+type racingBucket struct {
+	backend.BucketHandle
+	b *racingBackend
+}
+
+func (h *racingBucket) Object(name string) backend.ObjectHandle {
+	if name != h.b.name {
+		return h.BucketHandle.Object(name)
+	}
+	return &racingObject{ObjectHandle: h.BucketHandle.Object(name), bkt: h.BucketHandle, name: name}
+}
+
+type racingObject struct {
+	backend.ObjectHandle
+	bkt  backend.BucketHandle
+	name string
+}
+
+func (o *racingObject) If(conds backend.Conditions) backend.ObjectHandle {
+	return &racingObject{ObjectHandle: o.ObjectHandle.If(conds), bkt: o.bkt, name: o.name}
+}
+
+func (o *racingObject) Delete(ctx context.Context) error {
+	w := o.bkt.Object(o.name).NewWriter(ctx, nil)
+	w.Write([]byte("overwritten"))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return o.ObjectHandle.Delete(ctx)
+}
+
+func TestMoveFileRace(t *testing.T) {
+	b := &racingBackend{Backend: memory.New(), name: "take.wav"}
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestBucket(t, s, testBucket)
+	uploadTestFile(t, s, testBucket, "take.wav", "take")
+
+	_, err = s.MoveFile(context.Background(), &pb.MoveFileRequest{
+		SourceBucket:    &pb.Bucket{Name: testBucket},
+		SourceFile:      &pb.File{Name: "take.wav"},
+		DestinationFile: &pb.File{Name: "final.wav"},
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("Move of a source overwritten before its delete should return Aborted, got %v", err)
+	}
+	if f := statTestFile(t, s, testBucket, "take.wav"); f.Size != int64(len("overwritten")) {
+		t.Errorf("Overwritten source should be kept, got %v", f)
+	}
+	statTestFile(t, s, testBucket, "final.wav")
+}
+
+func statTestFile(t *testing.T, s *core.ProviderGRPC, bucket, name string) *pb.File {
+	t.Helper()
+	res, err := s.StatFile(context.Background(), &pb.StatFileRequest{
+		Bucket: &pb.Bucket{Name: bucket},
+		File:   &pb.File{Name: name},
+	})
+	if err != nil {
+		t.Fatalf("StatFile(%s/%s) = %v", bucket, name, err)
+	}
+	return res.File
+}
+
+// downloadStream collects the chunks sent by ProviderGRPC.DownloadFile
+type downloadStream struct {
+	grpc.ServerStream
+	chunks []*pb.Chunk
+}
+
+func (s *downloadStream) Context() context.Context {
+	return context.Background()
+}
+
+// Send copies the chunk as the buffer is reused once a real stream has marshalled it
+func (s *downloadStream) Send(c *pb.Chunk) error {
+	s.chunks = append(s.chunks, &pb.Chunk{Content: append([]byte(nil), c.Content...)})
+	return nil
+}
+
+func TestDownloadFile(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	uploadTestFile(t, s, testBucket, "upload-file.txt", "chunk one, ", "chunk two")
+
+	t.Run("Chunks should honour chunk size", func(t *testing.T) {
+		stream := &downloadStream{}
+		err := s.DownloadFile(&pb.DownloadFileRequest{
+			Bucket:    &pb.Bucket{Name: testBucket},
+			File:      &pb.File{Name: "upload-file.txt"},
+			ChunkSize: 4,
+		}, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content string
+		for i, c := range stream.chunks {
+			if i < len(stream.chunks)-1 && len(c.Content) != 4 {
+				t.Errorf("chunk %d has %d bytes, want 4", i, len(c.Content))
+			}
+			content += string(c.Content)
+		}
+		if content != "chunk one, chunk two" {
+			t.Errorf("downloaded %q", content)
+		}
+	})
+	t.Run("Missing file should return error", func(t *testing.T) {
+		err := s.DownloadFile(&pb.DownloadFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "missing.txt"},
+		}, &downloadStream{})
+		if err == nil {
+			t.Errorf("DownloadFile on missing file should throw error")
+		}
+	})
+	t.Run("Range should stream only the requested span", func(t *testing.T) {
+		stream := &downloadStream{}
+		err := s.DownloadFile(&pb.DownloadFileRequest{
+			Bucket:    &pb.Bucket{Name: testBucket},
+			File:      &pb.File{Name: "upload-file.txt"},
+			ChunkSize: 4,
+			Offset:    6,
+			Length:    9,
+		}, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content string
+		for _, c := range stream.chunks {
+			content += string(c.Content)
+		}
+		if content != "one, chun" {
+			t.Errorf("downloaded %q, want %q", content, "one, chun")
+		}
+	})
+	t.Run("Offset past the end should return OutOfRange", func(t *testing.T) {
+		err := s.DownloadFile(&pb.DownloadFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "upload-file.txt"},
+			Offset: 100,
+		}, &downloadStream{})
+		if status.Code(err) != codes.OutOfRange {
+			t.Errorf("DownloadFile past the end = %v, want OutOfRange", err)
+		}
+	})
+	t.Run("Negative offset should return InvalidArgument", func(t *testing.T) {
+		err := s.DownloadFile(&pb.DownloadFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "upload-file.txt"},
+			Offset: -1,
+		}, &downloadStream{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DownloadFile with negative offset = %v, want InvalidArgument", err)
+		}
+	})
+	t.Run("Oversized chunks should return error", func(t *testing.T) {
+		err := s.DownloadFile(&pb.DownloadFileRequest{
+			Bucket:    &pb.Bucket{Name: testBucket},
+			File:      &pb.File{Name: "upload-file.txt"},
+			ChunkSize: 1 << 23,
+		}, &downloadStream{})
+		if err == nil {
+			t.Errorf("DownloadFile with chunk size over 4MB should throw error")
+		}
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	for _, name := range []string{
+		"artist/album-a/01.flac",
+		"artist/album-a/02.flac",
+		"artist/album-b/01.flac",
+		"artist/cover.jpg",
+		"readme.txt",
+	} {
+		uploadTestFile(t, s, testBucket, name, name)
+	}
+
+	t.Run("Pages should cover every entry once", func(t *testing.T) {
+		req := &pb.ListFilesRequest{
+			Bucket:    &pb.Bucket{Name: testBucket},
+			Prefix:    "artist/",
+			Delimiter: "/",
+			PageSize:  2,
+		}
+		var got []string
+		for pages := 0; pages < 5; pages++ {
+			res, err := s.ListFiles(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, res.Prefixes...)
+			for _, f := range res.Files {
+				got = append(got, f.Name)
+				if f.Size != int64(len(f.Name)) || f.Updated == nil {
+					t.Errorf("File %s missing metadata: %v", f.Name, f)
+				}
+			}
+			if res.NextPageToken == "" {
+				break
+			}
+			req.PageToken = res.NextPageToken
+		}
+		want := []string{"artist/album-a/", "artist/album-b/", "artist/cover.jpg"}
+		if len(got) != len(want) {
+			t.Fatalf("ListFiles returned %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("ListFiles returned %v, want %v", got, want)
+			}
+		}
+	})
+	t.Run("Invalid page size should return InvalidArgument", func(t *testing.T) {
+		_, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{
+			Bucket:   &pb.Bucket{Name: testBucket},
+			PageSize: -1,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListFiles with negative page size = %v, want InvalidArgument", err)
+		}
+	})
+}
+
+// pagerBackend lists a fixed page through backend.Pager, recording the
+// token it was asked for
+type pagerBackend struct {
+	backend.Backend
+	token string
+}
+
+func (b *pagerBackend) Bucket(name string) backend.BucketHandle {
+	return &pagerBucket{BucketHandle: b.Backend.Bucket(name), b: b}
+}
+
+type pagerBucket struct {
+	backend.BucketHandle
+	b *pagerBackend
+}
+
+func (h *pagerBucket) ObjectsPage(ctx context.Context, q *backend.Query, pageSize int, token string) ([]*backend.ObjectAttrs, string, error) {
+	h.b.token = token
+	return []*backend.ObjectAttrs{{Name: "song.mp3"}, {Prefix: "album/"}}, "backend-token", nil
+}
+
+func TestListFilesPager(t *testing.T) {
+	b := &pagerBackend{Backend: memory.New()}
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.ListFiles(context.Background(), &pb.ListFilesRequest{
+		Bucket:    &pb.Bucket{Name: testBucket},
+		PageToken: "client-token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.token != "client-token" {
+		t.Errorf("Expected the page token to reach the backend, got %q", b.token)
+	}
+	if res.NextPageToken != "backend-token" {
+		t.Errorf("Expected the backend token, got %q", res.NextPageToken)
+	}
+	if len(res.Files) != 1 || len(res.Prefixes) != 1 {
+		t.Errorf("Expected one file and one prefix, got %v and %v", res.Files, res.Prefixes)
+	}
+}
+
+func enableVersioning(t *testing.T, s *core.ProviderGRPC, bucket string) {
+	t.Helper()
+	_, err := s.UpdateBucket(context.Background(), &pb.UpdateBucketRequest{
+		Project:    &pb.Project{Id: testProject},
+		Bucket:     &pb.Bucket{Name: bucket, Versioning: true},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"versioning"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func downloadTestFile(t *testing.T, s *core.ProviderGRPC, bucket string, f *pb.File) string {
+	t.Helper()
+	stream := &downloadStream{}
+	if err := s.DownloadFile(&pb.DownloadFileRequest{Bucket: &pb.Bucket{Name: bucket}, File: f}, stream); err != nil {
+		t.Fatalf("DownloadFile(%s/%s) = %v", bucket, f.Name, err)
+	}
+	var content string
+	for _, c := range stream.chunks {
+		content += string(c.Content)
+	}
+	return content
+}
+
+func TestFileVersions(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	enableVersioning(t, s, testBucket)
+	first := uploadTestFile(t, s, testBucket, "mix.wav", "first mix").File
+	second := uploadTestFile(t, s, testBucket, "mix.wav", "second mix").File
+	uploadTestFile(t, s, testBucket, "mix.wav.bak", "backup")
+	listVersions := func() []*pb.File {
+		t.Helper()
+		res, err := s.ListFileVersions(context.Background(), &pb.ListFileVersionsRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "mix.wav"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Versions
+	}
+
+	t.Run("Versions should be listed newest first", func(t *testing.T) {
+		versions := listVersions()
+		if len(versions) != 2 || versions[0].Generation != second.Generation || versions[1].Generation != first.Generation {
+			t.Fatalf("ListFileVersions returned %v", versions)
+		}
+		if versions[0].Deleted != nil || versions[1].Deleted == nil {
+			t.Errorf("Only the noncurrent version should have a deleted time, got %v", versions)
+		}
+	})
+	t.Run("A noncurrent generation should be readable", func(t *testing.T) {
+		f := &pb.File{Name: "mix.wav", Generation: first.Generation}
+		if content := downloadTestFile(t, s, testBucket, f); content != "first mix" {
+			t.Errorf("Downloaded generation %d = %q", first.Generation, content)
+		}
+		res, err := s.StatFile(context.Background(), &pb.StatFileRequest{Bucket: &pb.Bucket{Name: testBucket}, File: f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.File.Size != int64(len("first mix")) || res.File.Deleted == nil {
+			t.Errorf("StatFile of generation %d returned %v", first.Generation, res.File)
+		}
+	})
+	t.Run("Missing generation should return NotFound", func(t *testing.T) {
+		_, err := s.StatFile(context.Background(), &pb.StatFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "mix.wav", Generation: 1},
+		})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("StatFile of missing generation = %v, want NotFound", err)
+		}
+	})
+	t.Run("Restore should make an older generation live", func(t *testing.T) {
+		_, err := s.RestoreFile(context.Background(), &pb.RestoreFileRequest{
+			Bucket:            &pb.Bucket{Name: testBucket},
+			File:              &pb.File{Name: "mix.wav", Generation: first.Generation},
+			IfGenerationMatch: &wrappers.Int64Value{Value: first.Generation},
+		})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("Restore with stale if_generation_match = %v, want FailedPrecondition", err)
+		}
+
+		res, err := s.RestoreFile(context.Background(), &pb.RestoreFileRequest{
+			Bucket:            &pb.Bucket{Name: testBucket},
+			File:              &pb.File{Name: "mix.wav", Generation: first.Generation},
+			IfGenerationMatch: &wrappers.Int64Value{Value: second.Generation},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content := downloadTestFile(t, s, testBucket, &pb.File{Name: "mix.wav"}); content != "first mix" {
+			t.Errorf("Live file after restore = %q", content)
+		}
+		if versions := listVersions(); len(versions) != 3 || versions[0].Generation != res.File.Generation {
+			t.Errorf("Restore should add a live version, got %v", versions)
+		}
+	})
+	t.Run("Deleting a generation should remove it for good", func(t *testing.T) {
+		_, err := s.DeleteFile(context.Background(), &pb.DeleteFileRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "mix.wav", Generation: first.Generation},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range listVersions() {
+			if v.Generation == first.Generation {
+				t.Errorf("Generation %d still listed after delete", first.Generation)
+			}
+		}
+	})
+	t.Run("Forced delete should remove noncurrent versions", func(t *testing.T) {
+		_, err := s.Delete(context.Background(), &pb.DeleteRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			Force:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGenerationPreconditions(t *testing.T) {
+	s := newTestProvider(t)
+	createTestBucket(t, s, testBucket)
+	live := uploadTestFile(t, s, testBucket, "mix.wav", "mix").File
+	upload := func(gen int64) error {
+		stream := newUploadStream(testBucket, "mix.wav", "new mix")
+		stream.reqs[0].IfGenerationMatch = &wrappers.Int64Value{Value: gen}
+		return s.UploadFile(stream)
+	}
+
+	tests := map[string]struct {
+		run  func() error
+		code codes.Code
+	}{
+		"Upload of a new file over a live one": {
+			run:  func() error { return upload(0) },
+			code: codes.FailedPrecondition,
+		},
+		"Upload over a stale generation": {
+			run:  func() error { return upload(live.Generation + 1) },
+			code: codes.FailedPrecondition,
+		},
+		"Delete of a stale generation": {
+			run: func() error {
+				_, err := s.DeleteFile(context.Background(), &pb.DeleteFileRequest{
+					Bucket:            &pb.Bucket{Name: testBucket},
+					File:              &pb.File{Name: "mix.wav"},
+					IfGenerationMatch: &wrappers.Int64Value{Value: live.Generation + 1},
+				})
+				return err
+			},
+			code: codes.FailedPrecondition,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name+" should return "+tc.code.String(), func(t *testing.T) {
+			if err := tc.run(); status.Code(err) != tc.code {
+				t.Errorf("got %v, want %v", err, tc.code)
+			}
+		})
+	}
+
+	t.Run("Upload over the live generation should succeed", func(t *testing.T) {
+		if err := upload(live.Generation); err != nil {
+			t.Fatal(err)
+		}
+		if f := statTestFile(t, s, testBucket, "mix.wav"); f.Generation == live.Generation {
+			t.Errorf("Upload should replace generation %d", live.Generation)
+		}
+	})
+}
+
+// newHTTPProvider serves the provider's HTTP handler from a test server its
+// signed URLs point at
+func newHTTPProvider(t *testing.T) (*core.ProviderGRPC, *httptest.Server) {
+	t.Helper()
+	var s *core.ProviderGRPC
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+		Port:       testPort,
+		Backend:    memory.New(),
+		HTTPURL:    ts.URL,
+		SigningKey: []byte("test-key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ts
+}
+
+func signTestURL(t *testing.T, s *core.ProviderGRPC, req *pb.SignURLRequest) string {
+	t.Helper()
+	req.Bucket = &pb.Bucket{Name: testBucket}
+	res, err := s.SignURL(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Url
+}
+
+func TestSignURL(t *testing.T) {
+	s, _ := newHTTPProvider(t)
+	createTestBucket(t, s, testBucket)
+	uploadTestFile(t, s, testBucket, "artist/track one.mp3", "ID3 track")
+
+	t.Run("GET URL should download the file", func(t *testing.T) {
+		u := signTestURL(t, s, &pb.SignURLRequest{File: &pb.File{Name: "artist/track one.mp3"}, Method: pb.SignedMethod_GET})
+		res, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(body) != "ID3 track" {
+			t.Errorf("GET %s = %d %q", u, res.StatusCode, body)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "audio/mpeg" {
+			t.Errorf("Content-Type = %q, want audio/mpeg", ct)
+		}
+	})
+	t.Run("PUT URL should upload the file", func(t *testing.T) {
+		u := signTestURL(t, s, &pb.SignURLRequest{
+			File:   &pb.File{Name: "submissions/demo.flac", ContentType: "audio/flac"},
+			Method: pb.SignedMethod_PUT,
+		})
+		put := func(contentType string) int {
+			req, err := http.NewRequest(http.MethodPut, u, strings.NewReader("fLaC demo"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+		if code := put("text/plain"); code != http.StatusForbidden {
+			t.Errorf("PUT with another content type = %d, want 403", code)
+		}
+		if code := put("audio/flac"); code != http.StatusOK {
+			t.Fatalf("PUT = %d, want 200", code)
+		}
+		if f := statTestFile(t, s, testBucket, "submissions/demo.flac"); f.Size != 9 || f.ContentType != "audio/flac" {
+			t.Errorf("Uploaded file = %v", f)
+		}
+	})
+
+	tests := map[string]struct {
+		url  func(u string) string
+		code int
+	}{
+		"Tampered object": {
+			url:  func(u string) string { return strings.Replace(u, "track%20one", "track%20two", 1) },
+			code: http.StatusForbidden,
+		},
+		"Missing signature": {
+			url:  func(u string) string { return strings.Split(u, "?")[0] },
+			code: http.StatusForbidden,
+		},
+		"Newline moved between bucket and name": {
+			url: func(string) string {
+				u := signTestURL(t, s, &pb.SignURLRequest{File: &pb.File{Name: "a\nb"}, Method: pb.SignedMethod_GET})
+				return strings.Replace(u, "/"+testBucket+"/a%0Ab", "/"+testBucket+"%0Aa/b", 1)
+			},
+			code: http.StatusForbidden,
+		},
+	}
+	u := signTestURL(t, s, &pb.SignURLRequest{File: &pb.File{Name: "artist/track one.mp3"}, Method: pb.SignedMethod_GET})
+	for name, tc := range tests {
+		t.Run(name+" should be refused", func(t *testing.T) {
+			res, err := http.Get(tc.url(u))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tc.code {
+				t.Errorf("GET = %d, want %d", res.StatusCode, tc.code)
+			}
+		})
+	}
+
+	t.Run("A GET URL should not allow PUT", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPut, u, strings.NewReader("overwrite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("PUT with a GET URL = %d, want 403", res.StatusCode)
+		}
+	})
+	t.Run("Invalid expiry should return InvalidArgument", func(t *testing.T) {
+		_, err := s.SignURL(context.Background(), &pb.SignURLRequest{
+			Bucket:         &pb.Bucket{Name: testBucket},
+			File:           &pb.File{Name: "artist/track one.mp3"},
+			Method:         pb.SignedMethod_GET,
+			ExpiresSeconds: 8 * 24 * 3600,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SignURL for 8 days = %v, want InvalidArgument", err)
+		}
+	})
+	t.Run("Without the HTTP server should return Unimplemented", func(t *testing.T) {
+		_, err := newTestProvider(t).SignURL(context.Background(), &pb.SignURLRequest{
+			Bucket: &pb.Bucket{Name: testBucket},
+			File:   &pb.File{Name: "artist/track one.mp3"},
+			Method: pb.SignedMethod_GET,
+		})
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("SignURL = %v, want Unimplemented", err)
+		}
+	})
+}
+
+func TestHTTPDownload(t *testing.T) {
+	s, _ := newHTTPProvider(t)
+	createTestBucket(t, s, testBucket)
+	f := uploadTestFile(t, s, testBucket, "track.mp3", "0123456789").File
+	u := signTestURL(t, s, &pb.SignURLRequest{File: &pb.File{Name: "track.mp3"}, Method: pb.SignedMethod_GET})
+
+	first := httpTestGet(t, u, nil)
+	tag, modified := first.Header.Get("ETag"), first.Header.Get("Last-Modified")
+	if tag != fmt.Sprintf(`"%x"`, f.Md5Hash) || modified == "" || first.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("GET returned headers %v", first.Header)
+	}
+	past := time.Unix(0, 0).UTC().Format(http.TimeFormat)
+
+	tests := map[string]struct {
+		header  map[string]string
+		code    int
+		body    string
+		content string
+	}{
+		"Range": {
+			header:  map[string]string{"Range": "bytes=2-5"},
+			code:    http.StatusPartialContent,
+			body:    "2345",
+			content: "bytes 2-5/10",
+		},
+		"Open range": {
+			header:  map[string]string{"Range": "bytes=7-"},
+			code:    http.StatusPartialContent,
+			body:    "789",
+			content: "bytes 7-9/10",
+		},
+		"Suffix range": {
+			header:  map[string]string{"Range": "bytes=-3"},
+			code:    http.StatusPartialContent,
+			body:    "789",
+			content: "bytes 7-9/10",
+		},
+		"Range beyond the end": {
+			header:  map[string]string{"Range": "bytes=10-"},
+			code:    http.StatusRequestedRangeNotSatisfiable,
+			content: "bytes */10",
+		},
+		"Multiple ranges": {
+			header: map[string]string{"Range": "bytes=0-1,4-5"},
+			code:   http.StatusOK,
+			body:   "0123456789",
+		},
+		"If-Range with a stale ETag": {
+			header: map[string]string{"Range": "bytes=2-5", "If-Range": `"stale"`},
+			code:   http.StatusOK,
+			body:   "0123456789",
+		},
+		"If-Range with the ETag": {
+			header:  map[string]string{"Range": "bytes=2-5", "If-Range": tag},
+			code:    http.StatusPartialContent,
+			body:    "2345",
+			content: "bytes 2-5/10",
+		},
+		"If-None-Match with the ETag": {
+			header: map[string]string{"If-None-Match": tag},
+			code:   http.StatusNotModified,
+		},
+		"If-None-Match with another ETag": {
+			header: map[string]string{"If-None-Match": `"stale", W/"old"`},
+			code:   http.StatusOK,
+			body:   "0123456789",
+		},
+		"If-Modified-Since the last modification": {
+			header: map[string]string{"If-Modified-Since": modified},
+			code:   http.StatusNotModified,
+		},
+		"If-Match with another ETag": {
+			header: map[string]string{"If-Match": `"stale"`},
+			code:   http.StatusPreconditionFailed,
+		},
+		"If-Unmodified-Since the epoch": {
+			header: map[string]string{"If-Unmodified-Since": past},
+			code:   http.StatusPreconditionFailed,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name+" should return "+strconv.Itoa(tc.code), func(t *testing.T) {
+			res := httpTestGet(t, u, tc.header)
+			if res.StatusCode != tc.code {
+				t.Fatalf("GET = %d, want %d", res.StatusCode, tc.code)
+			}
+			if tc.body != "" && res.body != tc.body {
+				t.Errorf("GET returned %q, want %q", res.body, tc.body)
+			}
+			if got := res.Header.Get("Content-Range"); got != tc.content {
+				t.Errorf("Content-Range = %q, want %q", got, tc.content)
+			}
+		})
+	}
+}
+
+// httpTestResponse is a response with its body read
+type httpTestResponse struct {
+	*http.Response
+	body string
+}
+
+func httpTestGet(t *testing.T, u string, header map[string]string) httpTestResponse {
+	t.Helper()
+	return httpTestDo(t, http.MethodGet, u, "", header)
+}
+
+func httpTestDo(t *testing.T, method, u, body string, header map[string]string) httpTestResponse {
+	t.Helper()
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httpTestResponse{res, string(data)}
+}
+
+func TestHTTPUploadPreconditions(t *testing.T) {
+	s, _ := newHTTPProvider(t)
+	createTestBucket(t, s, testBucket)
+	u := signTestURL(t, s, &pb.SignURLRequest{File: &pb.File{Name: "demo.wav"}, Method: pb.SignedMethod_PUT})
+
+	res := httpTestDo(t, http.MethodPut, u, "first", map[string]string{"If-None-Match": "*"})
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") == "" {
+		t.Fatalf("PUT of a new file = %d %v", res.StatusCode, res.Header)
+	}
+	tag := res.Header.Get("ETag")
+
+	tests := map[string]struct {
+		header map[string]string
+		code   int
+	}{
+		"If-None-Match * over an existing file": {
+			header: map[string]string{"If-None-Match": "*"},
+			code:   http.StatusPreconditionFailed,
+		},
+		"If-Match with another ETag": {
+			header: map[string]string{"If-Match": `"stale"`},
+			code:   http.StatusPreconditionFailed,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name+" should return "+strconv.Itoa(tc.code), func(t *testing.T) {
+			if res := httpTestDo(t, http.MethodPut, u, "second", tc.header); res.StatusCode != tc.code {
+				t.Errorf("PUT = %d, want %d", res.StatusCode, tc.code)
+			}
+		})
+	}
+
+	t.Run("If-Match with the ETag should replace the file", func(t *testing.T) {
+		res := httpTestDo(t, http.MethodPut, u, "second", map[string]string{"If-Match": tag})
+		if res.StatusCode != http.StatusOK || res.Header.Get("ETag") == tag {
+			t.Errorf("PUT = %d with ETag %s", res.StatusCode, res.Header.Get("ETag"))
+		}
+	})
+}
+
+func TestHTTPCORS(t *testing.T) {
+	s, ts := newHTTPProvider(t)
+	createTestBucket(t, s, testBucket)
+	_, err := s.UpdateBucket(context.Background(), &pb.UpdateBucketRequest{
+		Bucket: &pb.Bucket{Name: testBucket, Cors: []*pb.CorsRule{{
+			Origins:         []string{"https://player.eph.example.com"},
+			Methods:         []string{"GET", "PUT"},
+			ResponseHeaders: []string{"Content-Range"},
+			MaxAgeSeconds:   600,
+		}}},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"cors"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	preflight := func(origin string) httpTestResponse {
+		return httpTestDo(t, http.MethodOptions, ts.URL+"/"+testBucket+"/track.mp3", "", map[string]string{
+			"Origin":                        origin,
+			"Access-Control-Request-Method": "PUT",
+		})
+	}
+
+	t.Run("Preflight from an allowed origin should succeed", func(t *testing.T) {
+		res := preflight("https://player.eph.example.com")
+		if res.StatusCode != http.StatusOK ||
+			res.Header.Get("Access-Control-Allow-Origin") != "https://player.eph.example.com" ||
+			res.Header.Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("Preflight = %d %v", res.StatusCode, res.Header)
+		}
+	})
+	t.Run("Preflight from another origin should be refused", func(t *testing.T) {
+		if res := preflight("https://evil.example.com"); res.StatusCode != http.StatusForbidden {
+			t.Errorf("Preflight = %d, want 403", res.StatusCode)
+		}
+	})
+	t.Run("Responses should expose the rule's headers", func(t *testing.T) {
+		uploadTestFile(t, s, testBucket, "track.mp3", "ID3")
+		u := signTestURL(t, s, &pb.SignURLRequest{File: &pb.File{Name: "track.mp3"}, Method: pb.SignedMethod_GET})
+		res := httpTestGet(t, u, map[string]string{"Origin": "https://player.eph.example.com"})
+		if res.Header.Get("Access-Control-Expose-Headers") != "Content-Range" {
+			t.Errorf("GET returned headers %v", res.Header)
+		}
+	})
+}
+
+// failingBackend fails every bucket lookup with err
+type failingBackend struct {
+	backend.Backend
+	err error
+}
+
+func (b failingBackend) Bucket(name string) backend.BucketHandle {
+	return failingBucket{BucketHandle: b.Backend.Bucket(name), err: b.err}
+}
+
+type failingBucket struct {
+	backend.BucketHandle
+	err error
+}
+
+func (h failingBucket) Attrs(ctx context.Context) (*backend.BucketAttrs, error) {
+	return nil, h.err
+}
+
+func newErrorsClient(t *testing.T, b backend.Backend) (*core.ProviderGRPC, core.ClientGRPC) {
+	t.Helper()
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := core.NewClientGRPC(core.ClientGRPCConfig{Address: serveTestProvider(t, s)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return s, c
+}
+
+func TestErrors(t *testing.T) {
+	s, c := newErrorsClient(t, memory.New())
+	createTestBucket(t, s, testBucket)
+	live := uploadTestFile(t, s, testBucket, "song.mp3", "la la").File
+	ctx := context.Background()
+	project := &pb.Project{Id: testProject}
+	bucket := &pb.Bucket{Name: testBucket}
+
+	tests := map[string]struct {
+		call      func() error
+		kind      error
+		code      codes.Code
+		resource  string
+		violation string
+	}{
+		"Missing bucket should be NotFound": {
+			call: func() error {
+				_, err := c.GetBucket(ctx, &pb.GetBucketRequest{Project: project, Bucket: &pb.Bucket{Name: "missing"}})
+				return err
+			},
+			kind: core.ErrNotFound, code: codes.NotFound, resource: "missing",
+		},
+		"Missing file should be NotFound": {
+			call: func() error {
+				_, err := c.StatFile(ctx, &pb.StatFileRequest{Project: project, Bucket: bucket, File: &pb.File{Name: "missing.mp3"}})
+				return err
+			},
+			kind: core.ErrNotFound, code: codes.NotFound, resource: testBucket + "/missing.mp3",
+		},
+		"Missing file download should be NotFound": {
+			call: func() error {
+				return c.DownloadFile(ctx, &pb.DownloadFileRequest{Project: project, Bucket: bucket, File: &pb.File{Name: "missing.mp3", Path: filepath.Join(t.TempDir(), "out")}})
+			},
+			kind: core.ErrNotFound, code: codes.NotFound, resource: testBucket + "/missing.mp3",
+		},
+		"Bucket of another project should be AlreadyExists": {
+			call: func() error {
+				_, err := c.Create(ctx, &pb.CreateRequest{Project: &pb.Project{Id: "other"}, Bucket: bucket})
+				return err
+			},
+			kind: core.ErrAlreadyExists, code: codes.AlreadyExists, resource: testBucket,
+		},
+		"Non-empty bucket should be BucketNotEmpty": {
+			call: func() error {
+				_, err := c.Delete(ctx, &pb.DeleteRequest{Project: project, Bucket: bucket})
+				return err
+			},
+			kind: core.ErrBucketNotEmpty, code: codes.FailedPrecondition, resource: testBucket,
+			violation: core.ViolationBucketNotEmpty,
+		},
+		"Stale generation should be PreconditionFailed": {
+			call: func() error {
+				_, err := c.DeleteFile(ctx, &pb.DeleteFileRequest{
+					Project:           project,
+					Bucket:            bucket,
+					File:              &pb.File{Name: "song.mp3"},
+					IfGenerationMatch: &wrappers.Int64Value{Value: live.Generation + 1},
+				})
+				return err
+			},
+			kind: core.ErrPreconditionFailed, code: codes.FailedPrecondition, resource: testBucket + "/song.mp3",
+			violation: core.ViolationGeneration,
+		},
+		"Invalid bucket name should be InvalidArgument": {
+			call: func() error {
+				_, err := c.Create(ctx, &pb.CreateRequest{Project: project, Bucket: &pb.Bucket{Name: "a/b"}})
+				return err
+			},
+			kind: core.ErrInvalidArgument, code: codes.InvalidArgument,
+		},
+		"Missing project should be InvalidArgument": {
+			call: func() error {
+				_, err := c.ListBuckets(ctx, &pb.ListBucketsRequest{Project: &pb.Project{}})
+				return err
+			},
+			kind: core.ErrInvalidArgument, code: codes.InvalidArgument,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tc.call()
+			if !errors.Is(err, tc.kind) {
+				t.Fatalf("Expected %v, got %v", tc.kind, err)
+			}
+			if got := status.Code(err); got != tc.code {
+				t.Errorf("Expected code %v, got %v", tc.code, got)
+			}
+			var e *core.Error
+			if !errors.As(err, &e) {
+				t.Fatalf("Expected a *core.Error, got %T", err)
+			}
+			if e.Resource != tc.resource || e.Violation != tc.violation {
+				t.Errorf("Expected resource %q and violation %q, got %q and %q", tc.resource, tc.violation, e.Resource, e.Violation)
+			}
+		})
+	}
+
+	t.Run("Backend conditions should map to codes", func(t *testing.T) {
+		conditions := map[error]struct {
+			kind error
+			code codes.Code
+		}{
+			backend.ErrPermissionDenied: {core.ErrPermissionDenied, codes.PermissionDenied},
+			backend.ErrQuotaExceeded:    {core.ErrQuotaExceeded, codes.ResourceExhausted},
+			errors.New("disk on fire"):  {nil, codes.Unknown},
+			context.DeadlineExceeded:    {nil, codes.DeadlineExceeded},
+			backend.ErrBucketNotExist:   {core.ErrNotFound, codes.NotFound},
+		}
+		for berr, want := range conditions {
+			_, c := newErrorsClient(t, failingBackend{Backend: memory.New(), err: berr})
+			_, err := c.GetBucket(ctx, &pb.GetBucketRequest{Project: project, Bucket: bucket})
+			if got := status.Code(err); got != want.code {
+				t.Errorf("%v: expected code %v, got %v", berr, want.code, got)
+			}
+			if want.kind != nil && !errors.Is(err, want.kind) {
+				t.Errorf("%v: expected %v, got %v", berr, want.kind, err)
+			}
+			if !strings.Contains(err.Error(), want.code.String()) {
+				t.Errorf("%v: expected the code in %q", berr, err)
+			}
+		}
+	})
+}
+
+func TestClientDownloadFile(t *testing.T) {
+	s, c := newErrorsClient(t, memory.New())
+	createTestBucket(t, s, testBucket)
+	uploadTestFile(t, s, testBucket, "song.mp3", "la la")
+	ctx := context.Background()
+	out := filepath.Join(t.TempDir(), "song.mp3")
+	download := func(name string) error {
+		return c.DownloadFile(ctx, &pb.DownloadFileRequest{
+			Project: &pb.Project{Id: testProject},
+			Bucket:  &pb.Bucket{Name: testBucket},
+			File:    &pb.File{Name: name, Path: out},
+		})
+	}
+
+	if err := ioutil.WriteFile(out, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := download("missing.mp3"); !errors.Is(err, core.ErrNotFound) {
+		t.Fatalf("Expected %v, got %v", core.ErrNotFound, err)
+	}
+	if data, err := ioutil.ReadFile(out); err != nil || string(data) != "local" {
+		t.Errorf("Failed download should keep the local file, got %q, %v", data, err)
+	}
+
+	if err := download("song.mp3"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(out); err != nil || string(data) != "la la" {
+		t.Errorf("Download should replace the local file, got %q, %v", data, err)
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Download should leave no temp files, found %d files", len(files))
+	}
+}
+
+// benchStream replays one chunk until size bytes have been sent, so the only
+// memory that can grow with size is what UploadFile itself holds on to
+type benchStream struct {
+	grpc.ServerStream
+	req  *pb.UploadFileRequest
+	left int
+}
+
+func (s *benchStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *benchStream) Recv() (*pb.UploadFileRequest, error) {
+	if s.left <= 0 {
+		return nil, io.EOF
+	}
+	s.left -= len(s.req.Chunk.Content)
+	return s.req, nil
+}
+
+func (s *benchStream) SendAndClose(res *pb.UploadFileResponse) error {
+	if res.Code != pb.UploadStatusCode_Ok {
+		return errors.New(res.Message)
+	}
+	return nil
+}
+
+// BenchmarkUploadFile reports B/op per file size; with uploads streamed to
+// the backend it stays flat rather than growing with the file
+func BenchmarkUploadFile(b *testing.B) {
+	fsBackend, err := fs.New(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: fsBackend})
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = s.Create(context.Background(), &pb.CreateRequest{
+		Project: &pb.Project{Id: testProject},
+		Bucket:  &pb.Bucket{Name: testBucket},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := &pb.UploadFileRequest{
+		Bucket: &pb.Bucket{Name: testBucket},
+		File:   &pb.File{Name: "session.wav"},
+		Chunk:  &pb.Chunk{Content: make([]byte, 1<<16)},
+	}
+
+	for _, size := range []int{1 << 20, 1 << 24, 1 << 27} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				if err := s.UploadFile(&benchStream{req: req, left: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
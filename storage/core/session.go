@@ -0,0 +1,237 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUploadTTL is how long an untouched upload session is kept, the
+// week GCS keeps its resumable sessions for
+const DefaultUploadTTL = 7 * 24 * time.Hour
+
+var (
+	// errSessionNotExist is returned for unknown or expired upload sessions
+	errSessionNotExist = errors.New("upload session does not exist")
+	// errSessionBusy is returned when a session already has a stream attached
+	errSessionBusy = errors.New("upload session is in use by another stream")
+)
+
+// uploadSession is the state of a resumable upload
+type uploadSession struct {
+	ID                 string            `json:"id"`
+	Project            string            `json:"project"`
+	Bucket             string            `json:"bucket"`
+	Name               string            `json:"name"`
+	ContentType        string            `json:"content_type,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	IfGenerationMatch  *int64            `json:"if_generation_match,omitempty"`
+	// Principal started the session, empty without authentication
+	Principal string    `json:"principal,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// startedBy reports whether the caller is the principal that started the
+// session, only they may resume or query it
+func (sess *uploadSession) startedBy(ctx context.Context) bool {
+	name := ""
+	if p, ok := PrincipalFromContext(ctx); ok {
+		name = p.Name
+	}
+	return sess.Principal == name
+}
+
+// sessionStore stages resumable uploads on disk until they are committed
+// Each session is a metadata file and a data file in dir, so sessions
+// survive a server restart
+// A session no chunk was staged to for ttl expires, and is removed by the
+// next sweep unless a stream is attached to it
+type sessionStore struct {
+	dir  string
+	ttl  time.Duration
+	stop chan struct{}
+
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newSessionStore(dir string, ttl time.Duration) (*sessionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		ttl = DefaultUploadTTL
+	}
+	return &sessionStore{dir: dir, ttl: ttl, stop: make(chan struct{}), active: map[string]bool{}}, nil
+}
+
+// sweepEvery removes expired sessions now and then every interval until
+// close is called
+func (st *sessionStore) sweepEvery(interval time.Duration) {
+	st.sweep(time.Now())
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case now := <-t.C:
+				st.sweep(now)
+			case <-st.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (st *sessionStore) close() {
+	close(st.stop)
+}
+
+// sweep removes the sessions that expired by now
+func (st *sessionStore) sweep(now time.Time) {
+	files, err := ioutil.ReadDir(st.dir)
+	if err != nil {
+		log.Printf("Failed to sweep upload sessions: %v", err)
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".json")
+		if id == f.Name() || !validSessionID(id) || !st.expired(id, now) {
+			continue
+		}
+		st.mu.Lock()
+		if !st.active[id] {
+			if err := st.remove(id); err != nil {
+				log.Printf("Failed to remove expired upload session %s: %v", id, err)
+			}
+		}
+		st.mu.Unlock()
+	}
+}
+
+// expired reports whether the session was last written to more than ttl
+// before now
+func (st *sessionStore) expired(id string, now time.Time) bool {
+	info, err := os.Stat(st.dataPath(id))
+	if os.IsNotExist(err) {
+		info, err = os.Stat(st.metaPath(id))
+	}
+	return err == nil && now.Sub(info.ModTime()) > st.ttl
+}
+
+func (st *sessionStore) metaPath(id string) string {
+	return filepath.Join(st.dir, id+".json")
+}
+
+func (st *sessionStore) dataPath(id string) string {
+	return filepath.Join(st.dir, id+".data")
+}
+
+// create a session with a new random id and an empty data file
+func (st *sessionStore) create(sess *uploadSession) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	sess.ID = hex.EncodeToString(id)
+	sess.Created = time.Now().UTC()
+
+	if err := ioutil.WriteFile(st.dataPath(sess.ID), nil, 0644); err != nil {
+		return err
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	// the metadata file is written last, a session without one does not exist
+	tmp := st.metaPath(sess.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.metaPath(sess.ID))
+}
+
+func (st *sessionStore) get(id string) (*uploadSession, error) {
+	if !validSessionID(id) || st.expired(id, time.Now()) {
+		return nil, errSessionNotExist
+	}
+	data, err := ioutil.ReadFile(st.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, errSessionNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	sess := &uploadSession{}
+	if err := json.Unmarshal(data, sess); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// offset returns the number of bytes staged for the session
+func (st *sessionStore) offset(id string) (int64, error) {
+	if _, err := st.get(id); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(st.dataPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// acquire marks the session as attached to a stream
+func (st *sessionStore) acquire(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.active[id] {
+		return errSessionBusy
+	}
+	st.active[id] = true
+	return nil
+}
+
+func (st *sessionStore) release(id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.active, id)
+}
+
+// openAppend opens the staged data for appending chunks
+func (st *sessionStore) openAppend(id string) (*os.File, error) {
+	return os.OpenFile(st.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// openRead opens the staged data to commit it to the backend
+func (st *sessionStore) openRead(id string) (io.ReadCloser, error) {
+	return os.Open(st.dataPath(id))
+}
+
+func (st *sessionStore) remove(id string) error {
+	if err := os.Remove(st.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(st.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// validSessionID guards against ids that would escape the session directory
+func validSessionID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 16
+}
@@ -0,0 +1,99 @@
+package core_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend"
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+	"google.golang.org/grpc"
+)
+
+// startShutdown shuts s down in the background once an upload to it is in
+// flight, returning when it no longer accepts connections
+func startShutdown(t *testing.T, s *core.ProviderGRPC, addr string, timeout time.Duration) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return done
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Server still accepts connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	upload := func(t *testing.T) (*memory.Backend, *core.ProviderGRPC, string, pb.Storage_UploadFileClient) {
+		b := memory.New()
+		s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{Port: testPort, Backend: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		createTestBucket(t, s, testBucket)
+		addr := serveTestProvider(t, s)
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		stream, err := pb.NewStorageClient(conn).UploadFile(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := newUploadStream(testBucket, "song.mp3", "la la ").reqs[0]
+		if err := stream.Send(first); err != nil {
+			t.Fatal(err)
+		}
+		return b, s, addr, stream
+	}
+
+	t.Run("Upload in flight should finish", func(t *testing.T) {
+		b, s, addr, stream := upload(t)
+		done := startShutdown(t, s, addr, 5*time.Second)
+
+		if err := stream.Send(&pb.UploadFileRequest{Chunk: &pb.Chunk{Content: []byte("la")}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.CloseAndRecv(); err != nil {
+			t.Fatalf("Expected the upload to finish, got %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("Expected a clean shutdown, got %v", err)
+		}
+		attrs, err := b.Bucket(testBucket).Object("song.mp3").Attrs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Size != int64(len("la la la")) {
+			t.Errorf("Expected the whole file, got %d bytes", attrs.Size)
+		}
+	})
+	t.Run("Upload past the drain timeout should be aborted", func(t *testing.T) {
+		b, s, addr, stream := upload(t)
+		done := startShutdown(t, s, addr, 100*time.Millisecond)
+
+		if err := <-done; err != context.DeadlineExceeded {
+			t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+		if _, err := stream.CloseAndRecv(); err == nil {
+			t.Fatal("Expected the upload to fail")
+		}
+		if _, err := b.Bucket(testBucket).Object("song.mp3").Attrs(context.Background()); err != backend.ErrObjectNotExist {
+			t.Errorf("Expected the upload not to be committed, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig locates the PEM files for TLS
+// CertFile and KeyFile are the certificate this side presents, required on
+// a server and only needed by clients of a server that verifies them
+// CAFile verifies the other side: on a server it turns on client
+// certificate verification, on a client it replaces the system roots
+// ServerName is the name clients expect in the server certificate, by
+// default the host they dial
+// Certificates are reloaded when their files change, so they can be rotated
+// without a restart
+type TLSConfig struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+}
+
+// serverConfig builds the TLS config of a server, verifying client
+// certificates against CAFile when clientAuth is set
+func (c *TLSConfig) serverConfig(clientAuth bool) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("TLS certificate and key files are required")
+	}
+	pair, err := newKeyPairReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return pair.get()
+		},
+	}
+	if !clientAuth || c.CAFile == "" {
+		return cfg, nil
+	}
+
+	cas, err := newPoolReloader(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	// each handshake gets the client CAs as they are on disk now
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := cas.get()
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cfg.GetCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      pool,
+			NextProtos:     []string{"h2"},
+		}, nil
+	}
+	return cfg, nil
+}
+
+// clientConfig builds the TLS config of a client
+func (c *TLSConfig) clientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if c.CAFile != "" {
+		pool, err := loadPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		pair, err := newKeyPairReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return pair.get()
+		}
+	}
+	return cfg, nil
+}
+
+// keyPairReloader loads a certificate and key again once either file has
+// a new modification time
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	r := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// get returns the current pair
+// A pair that fails to load, say half way through a rotation, leaves the
+// last good one in use
+func (r *keyPairReloader) get() (*tls.Certificate, error) {
+	var keyInfo os.FileInfo
+	certInfo, err := os.Stat(r.certFile)
+	if err == nil {
+		keyInfo, err = os.Stat(r.keyFile)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+			return r.cert, nil
+		}
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err == nil {
+			r.cert, r.certMod, r.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+			return r.cert, nil
+		}
+	}
+	if r.cert != nil {
+		log.Printf("Keeping the current TLS certificate, failed to reload %s: %v", r.certFile, err)
+		return r.cert, nil
+	}
+	return nil, fmt.Errorf("Failed to load TLS certificate %s: %v", r.certFile, err)
+}
+
+// poolReloader loads a CA bundle again once its file has a new
+// modification time
+type poolReloader struct {
+	file string
+
+	mu   sync.Mutex
+	pool *x509.CertPool
+	mod  time.Time
+}
+
+func newPoolReloader(file string) (*poolReloader, error) {
+	r := &poolReloader{file: file}
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *poolReloader) get() (*x509.CertPool, error) {
+	info, err := os.Stat(r.file)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		if r.pool != nil && info.ModTime().Equal(r.mod) {
+			return r.pool, nil
+		}
+		var pool *x509.CertPool
+		if pool, err = loadPool(r.file); err == nil {
+			r.pool, r.mod = pool, info.ModTime()
+			return r.pool, nil
+		}
+	}
+	if r.pool != nil {
+		log.Printf("Keeping the current CA bundle, failed to reload %s: %v", r.file, err)
+		return r.pool, nil
+	}
+	return nil, err
+}
+
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in CA file %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,238 @@
+package core_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanharmon/eph-music-micro/storage/backend/memory"
+	"github.com/evanharmon/eph-music-micro/storage/core"
+	pb "github.com/evanharmon/eph-music-micro/storage/proto/storagepb"
+)
+
+// testPKI issues certificates from a throwaway CA written to dir/ca.pem
+type testPKI struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "eph test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: t.TempDir(), cert: cert, key: key}
+	writeTestPEM(t, p.file("ca.pem"), "CERTIFICATE", der)
+	return p
+}
+
+func (p *testPKI) file(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// issue writes a certificate for localhost to name.pem and name-key.pem,
+// good for both servers and clients
+func (p *testPKI) issue(t *testing.T, name string, serial int64) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := p.file(name+".pem"), p.file(name+"-key.pem")
+	writeTestPEM(t, certFile, "CERTIFICATE", der)
+	writeTestPEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writeTestPEM(t *testing.T, file, typ string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTLSProvider(t *testing.T, cfg *core.TLSConfig) string {
+	t.Helper()
+	s, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+		Port:    testPort,
+		Backend: memory.New(),
+		TLS:     cfg,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestProvider(t, s)
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	serverCert, serverKey := pki.issue(t, "server", 2)
+	clientCert, clientKey := pki.issue(t, "client", 3)
+	ca := pki.file("ca.pem")
+
+	serverTLS := &core.TLSConfig{CertFile: serverCert, KeyFile: serverKey}
+	mutualTLS := &core.TLSConfig{CertFile: serverCert, KeyFile: serverKey, CAFile: ca}
+
+	tests := map[string]struct {
+		server *core.TLSConfig
+		client *core.TLSConfig
+		ok     bool
+	}{
+		"TLS client should reach a TLS server": {
+			server: serverTLS,
+			client: &core.TLSConfig{CAFile: ca},
+			ok:     true,
+		},
+		"Plaintext client should be refused by a TLS server": {
+			server: serverTLS,
+			client: nil,
+		},
+		"Client should reject a server its CA did not sign": {
+			server: serverTLS,
+			client: &core.TLSConfig{},
+		},
+		"Client should reject a server with the wrong name": {
+			server: serverTLS,
+			client: &core.TLSConfig{CAFile: ca, ServerName: "storage.example.com"},
+		},
+		"Mutual TLS should refuse a client without a certificate": {
+			server: mutualTLS,
+			client: &core.TLSConfig{CAFile: ca},
+		},
+		"Mutual TLS should accept a client certificate": {
+			server: mutualTLS,
+			client: &core.TLSConfig{CAFile: ca, CertFile: clientCert, KeyFile: clientKey},
+			ok:     true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			addr := newTLSProvider(t, tc.server)
+			c, err := core.NewClientGRPC(core.ClientGRPCConfig{Address: addr, TLS: tc.client})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = c.ListBuckets(ctx, &pb.ListBucketsRequest{Project: &pb.Project{Id: testProject}})
+			if tc.ok && err != nil {
+				t.Errorf("Expected the call to succeed, got %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("Expected the call to fail")
+			}
+		})
+	}
+
+	t.Run("Missing key pair should fail to create the server", func(t *testing.T) {
+		_, err := core.NewProviderGRPC(core.ProviderGRPCConfig{
+			Port:    testPort,
+			Backend: memory.New(),
+			TLS:     &core.TLSConfig{CertFile: pki.file("missing.pem"), KeyFile: serverKey},
+		})
+		if err == nil {
+			t.Errorf("Expected an error for a missing certificate")
+		}
+	})
+}
+
+func TestTLSReload(t *testing.T) {
+	pki := newTestPKI(t)
+	certFile, keyFile := pki.issue(t, "server", 2)
+	addr := newTLSProvider(t, &core.TLSConfig{CertFile: certFile, KeyFile: keyFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.cert)
+	serial := func(t *testing.T) int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, NextProtos: []string{"h2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	// mtimes can be coarse, so push them forward instead of relying on the
+	// clock moving between writes
+	touch := func(t *testing.T, mod time.Time, files ...string) {
+		t.Helper()
+		for _, f := range files {
+			if err := os.Chtimes(f, mod, mod); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got := serial(t); got != 2 {
+		t.Fatalf("Expected serial 2, got %d", got)
+	}
+
+	t.Run("Rotated certificate should be served without a restart", func(t *testing.T) {
+		pki.issue(t, "server", 3)
+		touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+		if got := serial(t); got != 3 {
+			t.Errorf("Expected serial 3, got %d", got)
+		}
+	})
+
+	t.Run("Broken certificate should leave the last good one in use", func(t *testing.T) {
+		if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		touch(t, time.Now().Add(2*time.Minute), certFile)
+		if got := serial(t); got != 3 {
+			t.Errorf("Expected serial 3, got %d", got)
+		}
+	})
+}
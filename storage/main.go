@@ -14,7 +14,20 @@ func main() {
 		Commands: []*cli.Command{
 			&cmd.Serve,
 			&cmd.Upload,
+			&cmd.Download,
 			&cmd.ListBuckets,
+			&cmd.CreateBucket,
+			&cmd.GetBucket,
+			&cmd.UpdateBucket,
+			&cmd.ListFiles,
+			&cmd.Stat,
+			&cmd.Versions,
+			&cmd.Restore,
+			&cmd.SignURL,
+			&cmd.Copy,
+			&cmd.Move,
+			&cmd.DeleteFiles,
+			&cmd.DeleteBucket,
 		},
 	}
 